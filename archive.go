@@ -0,0 +1,563 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	ArchiveExport = "export"
+	ArchiveImport = "import"
+)
+
+// archiveFormatVersion is written to every archive manifest. Imports reject
+// archives written in a newer format.
+const archiveFormatVersion = 1
+
+const (
+	archiveManifestFile        = "manifest.json"
+	archiveRegistryFile        = "registry.json"
+	archiveDevicesFile         = "devices.jsonl"
+	archiveConfigHistoryDir    = "config-history"
+	archiveGatewayBindingsFile = "gateway_bindings.json"
+)
+
+// archiveMode is set by the export-archive and import-archive commands. It
+// is empty for a registry to registry migration.
+var archiveMode string
+
+// ArchiveManifest describes an archive written by export-archive. Files maps
+// every other file in the archive, by slash separated path, to its SHA-256
+// checksum.
+type ArchiveManifest struct {
+	FormatVersion        int               `json:"formatVersion"`
+	ToolVersion          string            `json:"toolVersion"`
+	CreatedAt            time.Time         `json:"createdAt"`
+	Devices              int               `json:"devices"`
+	ConfigHistory        bool              `json:"configHistory"`
+	ConfigHistoryDevices int               `json:"configHistoryDevices"`
+	Gateways             int               `json:"gateways"`
+	Files                map[string]string `json:"files"`
+}
+
+// ArchiveRegistry holds the settings of a source registry. Archives of a
+// -mergeSourcesCsv export hold one per merge source.
+type ArchiveRegistry struct {
+	Tag          string                    `json:"tag,omitempty"`
+	RegistryName string                    `json:"registryName"`
+	Region       string                    `json:"region"`
+	Settings     *cbiotcore.DeviceRegistry `json:"settings"`
+}
+
+// RegistryArchive is an archive extracted and verified by openArchive.
+type RegistryArchive struct {
+	dir        string
+	Manifest   ArchiveManifest
+	Registries []ArchiveRegistry
+}
+
+func archiveFile() string {
+	if Args.archiveFile != "" {
+		return Args.archiveFile
+	}
+	return filepath.Join(Args.workDir, "registry_archive.tar.gz")
+}
+
+// archiveImportFile is recorded in the checkpoint fingerprint so that an
+// import never resumes a checkpoint of a different archive or of a registry
+// to registry migration.
+func archiveImportFile() string {
+	if archiveMode != ArchiveImport {
+		return ""
+	}
+	return archiveFile()
+}
+
+func validateArchiveFlags() {
+	switch archiveMode {
+	case ArchiveExport:
+		if isSplitMode() {
+			log.Fatalln("-splitDestinationsCsv applies to import-archive, not export-archive")
+		}
+		if Args.exportConfigHistory {
+			log.Fatalln("-exportConfigHistory cannot be used with export-archive")
+		}
+	case ArchiveImport:
+		if isMergeMode() {
+			log.Fatalln("-mergeSourcesCsv applies to export-archive, not import-archive")
+		}
+	}
+}
+
+// exportArchive writes the devices, config history and gateway bindings
+// fetched from the source, together with the source registry settings, to a
+// gzipped tar archive. Devices are archived as fetched, before validation and
+// transformation, which happen when the archive is imported.
+func exportArchive(sourceService *cbiotcore.Service, devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) {
+	staging := filepath.Join(Args.workDir, "archive-export")
+	if err := os.RemoveAll(staging); err != nil {
+		log.Fatalf("Unable to clear archive staging directory: %s\n", err)
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		log.Fatalf("Unable to create archive staging directory: %s\n", err)
+	}
+	defer os.RemoveAll(staging)
+
+	registries, err := fetchArchiveRegistries(sourceService)
+	if err != nil {
+		log.Fatalf("Unable to fetch source registry settings: %s\n", err)
+	}
+	if err := writeJSONFile(filepath.Join(staging, archiveRegistryFile), registries); err != nil {
+		log.Fatalf("Unable to write registry settings: %s\n", err)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Id < devices[j].Id })
+	if err := writeDevicesJSONL(filepath.Join(staging, archiveDevicesFile), devices); err != nil {
+		log.Fatalf("Unable to write devices: %s\n", err)
+	}
+
+	manifest := ArchiveManifest{
+		FormatVersion: archiveFormatVersion,
+		ToolVersion:   cbIotCoreMigrationVersion,
+		CreatedAt:     time.Now().UTC(),
+		Devices:       len(devices),
+		ConfigHistory: Args.configHistory,
+		Gateways:      len(gatewayBindings),
+	}
+
+	if Args.configHistory {
+		historyDir := filepath.Join(staging, archiveConfigHistoryDir)
+		if err := os.MkdirAll(historyDir, 0755); err != nil {
+			log.Fatalf("Unable to create config history directory: %s\n", err)
+		}
+		for deviceId, history := range deviceConfigs {
+			historyMap, _ := history.(map[string]interface{})
+			if _, err := writeConfigHistoryFile(historyDir, deviceId, historyMap); err != nil {
+				log.Fatalf("Unable to write config history of device %s: %s\n", deviceId, err)
+			}
+		}
+		manifest.ConfigHistoryDevices = len(deviceConfigs)
+	}
+
+	if gatewayBindings == nil {
+		gatewayBindings = map[string][]*cbiotcore.Device{}
+	}
+	if err := writeJSONFile(filepath.Join(staging, archiveGatewayBindingsFile), gatewayBindings); err != nil {
+		log.Fatalf("Unable to write gateway bindings: %s\n", err)
+	}
+
+	manifest.Files, err = checksumDir(staging)
+	if err != nil {
+		log.Fatalf("Unable to checksum archive contents: %s\n", err)
+	}
+	if err := writeJSONFile(filepath.Join(staging, archiveManifestFile), manifest); err != nil {
+		log.Fatalf("Unable to write archive manifest: %s\n", err)
+	}
+
+	target := archiveFile()
+	if err := writeTarGz(target, staging); err != nil {
+		log.Fatalf("Unable to write archive %s: %s\n", target, err)
+	}
+	writeArchiveManifest(target, devices, deviceConfigs, gatewayBindings)
+	printfColored(colorGreen, " \u2713 Archived %d devices, config history of %d devices and %d gateways to %s", manifest.Devices, manifest.ConfigHistoryDevices, manifest.Gateways, target)
+}
+
+func fetchArchiveRegistries(sourceService *cbiotcore.Service) ([]ArchiveRegistry, error) {
+	type source struct {
+		tag      string
+		endpoint *ClearBladeEndpoint
+		service  *cbiotcore.Service
+	}
+	var sources []source
+	if isMergeMode() {
+		for _, src := range mergeSources {
+			sources = append(sources, source{src.Tag, src.Endpoint, src.service})
+		}
+	} else {
+		sources = append(sources, source{"", sourceEndpoint, sourceService})
+	}
+
+	registries := make([]ArchiveRegistry, 0, len(sources))
+	for _, src := range sources {
+		registryService := cbiotcore.NewProjectsLocationsRegistriesService(src.service)
+		settings, err := registryService.Get(src.endpoint.RegistryPath()).Do()
+		if err != nil {
+			return nil, err
+		}
+		registries = append(registries, ArchiveRegistry{
+			Tag:          src.tag,
+			RegistryName: src.endpoint.RegistryName,
+			Region:       src.endpoint.Region,
+			Settings:     settings,
+		})
+	}
+	return registries, nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+func writeDevicesJSONL(path string, devices []*cbiotcore.Device) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, device := range devices {
+		if err := enc.Encode(device); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// checksumDir returns the SHA-256 checksum of every file below dir, keyed by
+// slash separated path relative to dir.
+func checksumDir(dir string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := sha256File(p)
+		if err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return sums, err
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeTarGz writes every file below dir to a gzipped tar at target, with the
+// manifest first so that it can be read without scanning the whole archive.
+func writeTarGz(target, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	var names []string
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel != archiveManifestFile {
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	names = append([]string{archiveManifestFile}, names...)
+
+	for _, name := range names {
+		if err := addTarFile(tw, filepath.Join(dir, filepath.FromSlash(name)), name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addTarFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// openArchive extracts the archive to dir and verifies its format version
+// and every checksum in the manifest before anything is read.
+func openArchive(source, dir string) (*RegistryArchive, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := extractTarGz(source, dir); err != nil {
+		return nil, err
+	}
+
+	archive := &RegistryArchive{dir: dir}
+	content, err := os.ReadFile(filepath.Join(dir, archiveManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("archive has no manifest: %w", err)
+	}
+	if err := json.Unmarshal(content, &archive.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if v := archive.Manifest.FormatVersion; v < 1 || v > archiveFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %d, this tool reads versions up to %d", v, archiveFormatVersion)
+	}
+
+	for name, want := range archive.Manifest.Files {
+		got, err := sha256File(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if got != want {
+			return nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	content, err = os.ReadFile(filepath.Join(dir, archiveRegistryFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &archive.Registries); err != nil {
+		return nil, fmt.Errorf("invalid registry settings: %w", err)
+	}
+	return archive, nil
+}
+
+func extractTarGz(source, dir string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q is outside the archive", header.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Devices returns the archived devices. Like fetchDevices, it stores them in
+// the checkpoint so that a resumed import skips reading them again, and
+// applies -devicesCsv.
+func (a *RegistryArchive) Devices() []*cbiotcore.Device {
+	checkpoint := GetCheckpoint()
+
+	var devices []*cbiotcore.Device
+	if checkpoint.IsPhaseCompleted(PhaseDeviceFetch) {
+		printfColored(colorGreen, "\u2713 Device fetch phase already completed, loading from checkpoint")
+		devices = checkpoint.GetFetchedDevices()
+	} else {
+		var err error
+		devices, err = readDevicesJSONL(filepath.Join(a.dir, archiveDevicesFile))
+		if err != nil {
+			log.Fatalf("Unable to read archived devices: %s\n", err)
+		}
+		checkpoint.SetTotalDevices(len(devices))
+		for _, device := range devices {
+			checkpoint.AddFetchedDevice(device)
+		}
+		checkpoint.SetPhase(PhaseDeviceMigrate)
+		printfColored(colorGreen, " \u2713 Read %d devices from archive", len(devices))
+	}
+
+	if Args.devicesCsvFile == "" {
+		return devices
+	}
+	csvData, err := readCsvFile(Args.devicesCsvFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceIds, err := parseDeviceIds(csvData)
+	if err != nil {
+		log.Fatal(err)
+	}
+	byId := make(map[string]*cbiotcore.Device, len(devices))
+	for _, device := range devices {
+		byId[device.Id] = device
+	}
+	selected := make([]*cbiotcore.Device, 0, len(deviceIds))
+	for _, id := range deviceIds {
+		if device, ok := byId[id]; ok {
+			selected = append(selected, device)
+		}
+	}
+	if missing := len(deviceIds) - len(selected); missing > 0 {
+		printfColored(colorYellow, " %d devices listed in %s are not in the archive", missing, Args.devicesCsvFile)
+	}
+	return selected
+}
+
+func readDevicesJSONL(path string) ([]*cbiotcore.Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var devices []*cbiotcore.Device
+	dec := json.NewDecoder(f)
+	for {
+		var device cbiotcore.Device
+		if err := dec.Decode(&device); errors.Is(err, io.EOF) {
+			return devices, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("device %d: %w", len(devices)+1, err)
+		}
+		devices = append(devices, &device)
+	}
+}
+
+// ConfigHistory returns the archived config history of devices, or nil when
+// -configHistory is false or the archive was written without history.
+func (a *RegistryArchive) ConfigHistory(devices []*cbiotcore.Device) map[string]interface{} {
+	if !Args.configHistory {
+		return nil
+	}
+	if !a.Manifest.ConfigHistory {
+		printfColored(colorYellow, " Archive was exported without config history")
+		return nil
+	}
+	all, err := readConfigHistoryDir(filepath.Join(a.dir, archiveConfigHistoryDir))
+	if err != nil {
+		log.Fatalf("Unable to read archived config history: %s\n", err)
+	}
+	deviceConfigs := make(map[string]interface{}, len(devices))
+	for _, device := range devices {
+		if history, ok := all[device.Id]; ok {
+			deviceConfigs[device.Id] = history
+		}
+	}
+	return deviceConfigs
+}
+
+// GatewayBindings returns the archived bound devices of the gateways among
+// devices.
+func (a *RegistryArchive) GatewayBindings(devices []*cbiotcore.Device) map[string][]*cbiotcore.Device {
+	content, err := os.ReadFile(filepath.Join(a.dir, archiveGatewayBindingsFile))
+	if err != nil {
+		log.Fatalf("Unable to read archived gateway bindings: %s\n", err)
+	}
+	var all map[string][]*cbiotcore.Device
+	if err := json.Unmarshal(content, &all); err != nil {
+		log.Fatalf("Invalid archived gateway bindings: %s\n", err)
+	}
+
+	var bindings map[string][]*cbiotcore.Device
+	for _, device := range devices {
+		if bound, ok := all[device.Id]; ok {
+			if bindings == nil {
+				bindings = make(map[string][]*cbiotcore.Device)
+			}
+			bindings[device.Id] = bound
+		}
+	}
+	return bindings
+}
+
+func (a *RegistryArchive) printSummary(source string) {
+	m := a.Manifest
+	printfColored(colorGreen, "\u2713 Verified archive %s: format version %d, written by %s at %s", source, m.FormatVersion, m.ToolVersion, m.CreatedAt.Format(time.RFC3339))
+	for _, r := range a.Registries {
+		if r.Tag != "" {
+			printfColored(colorCyan, "  Source %s: registry %s (region: %s)", r.Tag, r.RegistryName, r.Region)
+		} else {
+			printfColored(colorCyan, "  Source registry %s (region: %s)", r.RegistryName, r.Region)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	ShardBySequential = "sequential"
+	ShardByHash       = "hash"
+	ShardByGateway    = "gateway"
+)
+
+const (
+	ExportFormatCsv   = "csv"
+	ExportFormatJsonl = "jsonl"
+)
+
+// batchFilePattern matches the files written by exportDeviceBatches, so that
+// files left over from an earlier export with more batches are removed.
+var batchFilePattern = regexp.MustCompile(`^batch_\d+\.(csv|jsonl)(\.gz)?$`)
+
+// exportColumnNames are the -exportColumns accepted in addition to
+// metadata.<key>.
+var exportColumnNames = map[string]func(*cbiotcore.Device) string{
+	"numId":             func(d *cbiotcore.Device) string { return strconv.FormatUint(d.NumId, 10) },
+	"blocked":           func(d *cbiotcore.Device) string { return strconv.FormatBool(d.Blocked) },
+	"gatewayType":       deviceGatewayType,
+	"logLevel":          func(d *cbiotcore.Device) string { return d.LogLevel },
+	"lastEventTime":     func(d *cbiotcore.Device) string { return d.LastEventTime },
+	"lastHeartbeatTime": func(d *cbiotcore.Device) string { return d.LastHeartbeatTime },
+	"configVersion": func(d *cbiotcore.Device) string {
+		if d.Config == nil {
+			return ""
+		}
+		return strconv.FormatInt(d.Config.Version, 10)
+	},
+}
+
+func validateBatchExportFlags() {
+	if Args.exportBatchSize < 0 {
+		log.Fatalln("-exportBatchSize cannot be negative")
+	}
+	if Args.exportShards < 0 {
+		log.Fatalln("-exportShards cannot be negative")
+	}
+	switch Args.exportShardBy {
+	case ShardBySequential, ShardByHash, ShardByGateway:
+	default:
+		log.Fatalf("Invalid -exportShardBy %q. Must be one of: sequential, hash, gateway\n", Args.exportShardBy)
+	}
+	switch Args.exportFormat {
+	case ExportFormatCsv:
+	case ExportFormatJsonl:
+		if Args.exportColumns != "" {
+			log.Fatalln("-exportColumns only applies to -exportFormat csv")
+		}
+	default:
+		log.Fatalf("Invalid -exportFormat %q. Must be csv or jsonl\n", Args.exportFormat)
+	}
+	if _, err := parseExportColumns(Args.exportColumns); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func parseExportColumns(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var columns []string
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if _, ok := exportColumnNames[column]; !ok && !strings.HasPrefix(column, "metadata.") {
+			return nil, fmt.Errorf("unknown -exportColumns column %q", column)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func exportDir() string {
+	if Args.exportDir != "" {
+		return Args.exportDir
+	}
+	return filepath.Join(Args.workDir, "batches")
+}
+
+// exportDeviceBatches writes devices to batch files in the export directory,
+// sharded by -exportShardBy. Batches and the devices within them are always
+// in the same order for the same input.
+func exportDeviceBatches(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) {
+	sorted := make([]*cbiotcore.Device, len(devices))
+	copy(sorted, devices)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+
+	var batches [][]*cbiotcore.Device
+	switch Args.exportShardBy {
+	case ShardByHash:
+		batches = hashBatches(sorted, Args.exportBatchSize, Args.exportShards)
+	case ShardByGateway:
+		batches = gatewayBatches(sorted, gatewayBindings, Args.exportBatchSize)
+	default:
+		batches = sequentialBatches(sorted, Args.exportBatchSize)
+	}
+
+	dir := exportDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Unable to create export directory: %s\n", err)
+	}
+	if err := removeBatchFiles(dir); err != nil {
+		log.Fatalf("Unable to remove earlier batch files: %s\n", err)
+	}
+
+	columns, _ := parseExportColumns(Args.exportColumns)
+	for i, batch := range batches {
+		name := fmt.Sprintf("batch_%d.%s", i, Args.exportFormat)
+		if Args.exportGzip {
+			name += ".gz"
+		}
+		if err := writeBatchFile(filepath.Join(dir, name), batch, columns); err != nil {
+			log.Fatalf("Unable to write %s: %s\n", name, err)
+		}
+	}
+	printfColored(colorGreen, " \u2713 Exported %d devices in %d batches to %s", len(sorted), len(batches), dir)
+}
+
+func sequentialBatches(devices []*cbiotcore.Device, batchSize int64) [][]*cbiotcore.Device {
+	var batches [][]*cbiotcore.Device
+	for start := 0; start < len(devices); start += int(batchSize) {
+		end := start + int(batchSize)
+		if end > len(devices) {
+			end = len(devices)
+		}
+		batches = append(batches, devices[start:end])
+	}
+	return batches
+}
+
+// hashBatches assigns each device to shard fnv32a(id) mod shards, so that a
+// device stays in the same shard across exports with the same shard count.
+// Without -exportShards the count is derived from -exportBatchSize.
+func hashBatches(devices []*cbiotcore.Device, batchSize int64, shards int) [][]*cbiotcore.Device {
+	if shards == 0 {
+		shards = int((int64(len(devices)) + batchSize - 1) / batchSize)
+	}
+	if shards == 0 {
+		return nil
+	}
+	batches := make([][]*cbiotcore.Device, shards)
+	for _, device := range devices {
+		h := fnv.New32a()
+		h.Write([]byte(device.Id))
+		shard := h.Sum32() % uint32(shards)
+		batches[shard] = append(batches[shard], device)
+	}
+	return batches
+}
+
+// gatewayBatches keeps every gateway in the same batch as the devices bound
+// to it. Groups from gatewayGroups are filled into batches of up to batchSize
+// devices in order of their first device ID, and a group larger than
+// batchSize gets a batch of its own.
+func gatewayBatches(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device, batchSize int64) [][]*cbiotcore.Device {
+	var batches [][]*cbiotcore.Device
+	var current []*cbiotcore.Device
+	for _, group := range gatewayGroups(devices, gatewayBindings) {
+		if len(current) > 0 && int64(len(current)+len(group)) > batchSize {
+			batches = append(batches, current)
+			current = nil
+		}
+		current = append(current, group...)
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// gatewayGroups splits devices into groups of a gateway and the devices bound
+// to it. Gateways that share bound devices form one group, and every other
+// device is a group of its own. Groups are returned in the order of their
+// first device in devices. Bound devices missing from devices are ignored.
+func gatewayGroups(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) [][]*cbiotcore.Device {
+	parent := make(map[string]string, len(devices))
+	for _, device := range devices {
+		parent[device.Id] = device.Id
+	}
+	var find func(id string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+	union := func(a, b string) {
+		ra, rb := find(a), find(b)
+		if ra == rb {
+			return
+		}
+		// The smaller ID becomes the root so that grouping is deterministic.
+		if rb < ra {
+			ra, rb = rb, ra
+		}
+		parent[rb] = ra
+	}
+	for gatewayId, bound := range gatewayBindings {
+		if _, ok := parent[gatewayId]; !ok {
+			continue
+		}
+		for _, device := range bound {
+			if _, ok := parent[device.Id]; ok {
+				union(gatewayId, device.Id)
+			}
+		}
+	}
+
+	var order []string
+	groups := make(map[string][]*cbiotcore.Device)
+	for _, device := range devices {
+		root := find(device.Id)
+		if _, ok := groups[root]; !ok {
+			order = append(order, root)
+		}
+		groups[root] = append(groups[root], device)
+	}
+
+	result := make([][]*cbiotcore.Device, 0, len(order))
+	for _, root := range order {
+		result = append(result, groups[root])
+	}
+	return result
+}
+
+func removeBatchFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && batchFilePattern.MatchString(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeBatchFile(path string, devices []*cbiotcore.Device, columns []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if Args.exportGzip {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	if Args.exportFormat == ExportFormatJsonl {
+		enc := json.NewEncoder(w)
+		for _, device := range devices {
+			if err := enc.Encode(device); err != nil {
+				return err
+			}
+		}
+	} else if err := writeBatchCsv(w, devices, columns); err != nil {
+		return err
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func writeBatchCsv(w io.Writer, devices []*cbiotcore.Device, columns []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"deviceId"}, columns...)); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		record := []string{device.Id}
+		for _, column := range columns {
+			if key, ok := strings.CutPrefix(column, "metadata."); ok {
+				record = append(record, device.Metadata[key])
+			} else {
+				record = append(record, exportColumnNames[column](device))
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
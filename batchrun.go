@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const batchRunStateFile = "batch_runs.json"
+
+const (
+	BatchPending   = "pending"
+	BatchRunning   = "running"
+	BatchCompleted = "completed"
+	BatchFailed    = "failed"
+)
+
+// batchRunFlags are set by run-batches for each batch and are not passed on
+// from the orchestrator's own command line.
+var batchRunFlags = map[string]struct{}{
+	"batchDir":         {},
+	"batchParallelism": {},
+	"workDir":          {},
+	"devicesCsv":       {},
+	"silentMode":       {},
+	"failedDevicesDir": {},
+	"checkpointStore":  {},
+}
+
+// BatchRunState is saved to batch_runs.json in the work directory, or in
+// -checkpointStore, after every change, so an interrupted run-batches resumes
+// with the batches that did not complete.
+type BatchRunState struct {
+	BatchDir    string               `json:"batch_dir"`
+	StartTime   time.Time            `json:"start_time"`
+	LastUpdated time.Time            `json:"last_updated"`
+	Batches     map[string]*BatchRun `json:"batches"`
+	store       CheckpointStore      `json:"-"`
+	mutex       sync.Mutex           `json:"-"`
+}
+
+type BatchRun struct {
+	File          string    `json:"file"`
+	Sha256        string    `json:"sha256"`
+	Devices       int       `json:"devices"`
+	WorkDir       string    `json:"work_dir"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	FailedDevices int       `json:"failed_devices"`
+	StartedAt     time.Time `json:"started_at,omitempty"`
+	FinishedAt    time.Time `json:"finished_at,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// runBatches migrates every CSV batch file in batchDir as its own migration,
+// running up to parallelism batches at once. Each batch is a separate run of
+// this tool with the orchestrator's flags, -devicesCsv set to the batch file
+// and its own work directory, so it keeps its own checkpoint. It returns false
+// if any batch failed.
+func runBatches(batchDir string, parallelism int) bool {
+	if parallelism < 1 {
+		log.Fatalln("-batchParallelism must be at least 1")
+	}
+	if Args.exportBatchSize != 0 || Args.exportConfigHistory {
+		log.Fatalln("run-batches cannot be used with -exportBatchSize or -exportConfigHistory")
+	}
+	if Args.cleanupCbRegistry {
+		log.Fatalln("run-batches cannot be used with -cleanupCbRegistry, since every batch would clean up the destination")
+	}
+	if Args.cbServiceAccount == "-" || Args.cbSourceServiceAccount == "-" {
+		log.Fatalln("run-batches cannot read service accounts from stdin. Use a file path or env:VAR_NAME")
+	}
+	if batchDir == "" {
+		batchDir = exportDir()
+	}
+	batchDir, err := filepath.Abs(batchDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	files, err := listBatchFiles(batchDir)
+	if err != nil {
+		log.Fatalf("Unable to read batch directory %s: %s\n", batchDir, err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("No CSV batch files found in %s. Export them with -exportBatchSize\n", batchDir)
+	}
+
+	loadCheckpointStore()
+	state, err := loadBatchRunState(workDirCheckpointStore(Args.workDir), batchDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := state.sync(files); err != nil {
+		log.Fatalln(err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to locate the migration tool executable: %s\n", err)
+	}
+	childArgs := batchChildArgs()
+
+	var pending []*BatchRun
+	for _, name := range files {
+		run := state.Batches[name]
+		if run.Status == BatchCompleted {
+			printfColored(colorGreen, "\u2713 Batch %s already completed", name)
+			continue
+		}
+		pending = append(pending, run)
+	}
+	printfColored(colorCyan, "================= Running %d of %d batches, %d at a time =================", len(pending), len(files), parallelism)
+
+	wp := NewWorkerPoolWithSize(parallelism)
+	wp.Run()
+	for _, run := range pending {
+		run := run
+		wp.AddTask(func() {
+			runBatch(state, run, executable, childArgs)
+		})
+	}
+	wp.Wait()
+
+	reportFile := filepath.Join(Args.workDir, "batch_summary.csv")
+	if err := writeBatchSummary(reportFile, files, state); err != nil {
+		log.Printf("Unable to write batch summary: %s\n", err)
+	} else {
+		printfColored(colorGreen, "\u2713 Batch summary written to %s", reportFile)
+	}
+	return printBatchSummary(files, state)
+}
+
+// listBatchFiles returns the CSV batch files in dir in batch number order.
+// JSONL batches cannot be passed as -devicesCsv and are ignored.
+func listBatchFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !batchFilePattern.MatchString(name) || !strings.Contains(name, ".csv") {
+			continue
+		}
+		files = append(files, name)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return batchNumber(files[i]) < batchNumber(files[j])
+	})
+	return files, nil
+}
+
+func batchNumber(name string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(strings.SplitN(name, ".", 2)[0], "batch_"))
+	return n
+}
+
+func loadBatchRunState(store CheckpointStore, batchDir string) (*BatchRunState, error) {
+	data, err := store.Read(batchRunStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		printfColored(colorCyan, "Starting fresh batch run with state tracking")
+		return &BatchRunState{
+			BatchDir:  batchDir,
+			StartTime: time.Now(),
+			Batches:   make(map[string]*BatchRun),
+			store:     store,
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch run state: %w", err)
+	}
+
+	var state BatchRunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse batch run state: %w", err)
+	}
+	if state.BatchDir != batchDir {
+		return nil, fmt.Errorf("batch run state in %s was created for batch directory %s. Use the original -batchDir, a different -workDir, or remove %s to start over", Args.workDir, state.BatchDir, store.Location(batchRunStateFile))
+	}
+	state.store = store
+	printfColored(colorCyan, "Found existing batch run state - resuming batches that did not complete")
+	return &state, nil
+}
+
+// sync adds new batch files to the state. A batch whose file changed since it
+// was recorded is run again.
+func (s *BatchRunState) sync(files []string) error {
+	for _, name := range files {
+		sum, err := sha256File(filepath.Join(s.BatchDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read batch file %s: %w", name, err)
+		}
+		run, ok := s.Batches[name]
+		if ok && run.Sha256 == sum {
+			continue
+		}
+		if ok {
+			printfColored(colorYellow, "Warning: Batch file %s changed since it was last run. It will be run again", name)
+		}
+		rows, err := readCsvFile(filepath.Join(s.BatchDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read batch file %s: %w", name, err)
+		}
+		ids, err := parseDeviceIds(rows)
+		if err != nil {
+			return fmt.Errorf("invalid batch file %s: %w", name, err)
+		}
+		s.Batches[name] = &BatchRun{
+			File:    name,
+			Sha256:  sum,
+			Devices: len(ids),
+			WorkDir: filepath.Join(Args.workDir, "batch-runs", strings.SplitN(name, ".", 2)[0]),
+			Status:  BatchPending,
+		}
+	}
+	return s.save()
+}
+
+func (s *BatchRunState) update(run *BatchRun, fn func(run *BatchRun)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fn(run)
+	if err := s.save(); err != nil {
+		log.Fatalf("failed to save batch run state: %s\n", err)
+	}
+}
+
+func (s *BatchRunState) save() error {
+	s.LastUpdated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch run state: %w", err)
+	}
+	if err := s.store.Write(batchRunStateFile, data); err != nil {
+		return fmt.Errorf("failed to write batch run state: %w", err)
+	}
+	return nil
+}
+
+// batchChildArgs returns the flags given to the orchestrator that are passed
+// on to every batch.
+func batchChildArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := batchRunFlags[f.Name]; ok {
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+// runBatch runs one batch to completion. Its output is written to
+// migration.log in the batch's work directory. A batch that was interrupted
+// resumes from its own checkpoint.
+func runBatch(state *BatchRunState, run *BatchRun, executable string, childArgs []string) {
+	started := time.Now()
+	state.update(run, func(run *BatchRun) {
+		run.Status = BatchRunning
+		run.Attempts++
+		run.StartedAt = started
+		run.FinishedAt = time.Time{}
+		run.Error = ""
+	})
+	printfColored(colorCyan, "Batch %s started (%d devices)", run.File, run.Devices)
+
+	err := execBatch(state.BatchDir, run, executable, childArgs)
+	failed, countErr := countBatchFailedDevices(run.WorkDir, started)
+	if countErr != nil {
+		printfColored(colorYellow, "Warning: Unable to read failed devices of batch %s: %s", run.File, countErr)
+	}
+
+	state.update(run, func(run *BatchRun) {
+		run.FinishedAt = time.Now()
+		run.FailedDevices = failed
+		if err != nil {
+			run.Status = BatchFailed
+			run.Error = err.Error()
+		} else {
+			run.Status = BatchCompleted
+		}
+	})
+	if err != nil {
+		printfColored(colorRed, "\u2715 Batch %s failed: %s. See %s", run.File, err, filepath.Join(run.WorkDir, "migration.log"))
+	} else {
+		printfColored(colorGreen, "\u2713 Batch %s completed in %s", run.File, run.FinishedAt.Sub(started).Round(time.Second))
+	}
+}
+
+func execBatch(batchDir string, run *BatchRun, executable string, childArgs []string) error {
+	if err := os.MkdirAll(run.WorkDir, 0755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(run.WorkDir, "migration.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	args := append([]string{}, childArgs...)
+	args = append(args,
+		"-silentMode",
+		"-devicesCsv="+filepath.Join(batchDir, run.File),
+		"-workDir="+run.WorkDir,
+		"-failedDevicesDir="+run.WorkDir,
+	)
+	if Args.checkpointStore != "" {
+		args = append(args, "-checkpointStore="+joinStoreLocation(Args.checkpointStore, "batch-runs/"+strings.SplitN(run.File, ".", 2)[0]))
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("exited with status %d", exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// countBatchFailedDevices counts the distinct devices in the failed devices
+// CSVs a batch wrote since it started.
+func countBatchFailedDevices(dir string, since time.Time) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "failed_devices_*.csv"))
+	if err != nil {
+		return 0, err
+	}
+	ids := make(map[string]struct{})
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return 0, err
+		}
+		if info.ModTime().Before(since.Truncate(time.Second)) {
+			continue
+		}
+		f, err := os.Open(match)
+		if err != nil {
+			return 0, err
+		}
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return 0, err
+			}
+			if len(record) == 3 && record[2] != "deviceId" && record[2] != "" {
+				ids[record[2]] = struct{}{}
+			}
+		}
+		f.Close()
+	}
+	return len(ids), nil
+}
+
+func writeBatchSummary(path string, files []string, state *BatchRunState) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"batch", "devices", "status", "failedDevices", "attempts", "duration", "workDir", "error"}); err != nil {
+		return err
+	}
+	for _, name := range files {
+		run := state.Batches[name]
+		if err := w.Write([]string{run.File, strconv.Itoa(run.Devices), run.Status, strconv.Itoa(run.FailedDevices), strconv.Itoa(run.Attempts), batchDuration(run), run.WorkDir, run.Error}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func batchDuration(run *BatchRun) string {
+	if run.StartedAt.IsZero() || run.FinishedAt.IsZero() {
+		return ""
+	}
+	return run.FinishedAt.Sub(run.StartedAt).Round(time.Second).String()
+}
+
+func printBatchSummary(files []string, state *BatchRunState) bool {
+	ok := true
+	var devices, failedDevices, completed int
+	for _, name := range files {
+		run := state.Batches[name]
+		devices += run.Devices
+		failedDevices += run.FailedDevices
+		switch {
+		case run.Status != BatchCompleted:
+			ok = false
+			printfColored(colorRed, " %s: %s, attempts: %d, %s", run.File, run.Status, run.Attempts, run.Error)
+		case run.FailedDevices > 0:
+			completed++
+			printfColored(colorYellow, " %s: completed, %d/%d devices failed", run.File, run.FailedDevices, run.Devices)
+		default:
+			completed++
+			printfColored(colorGreen, " %s: completed, %d devices", run.File, run.Devices)
+		}
+	}
+	if ok {
+		printfColored(colorGreen, "\u2713 Completed %d/%d batches with %d devices, %d failed devices", completed, len(files), devices, failedDevices)
+	} else {
+		printfColored(colorRed, "\u2715 Completed %d/%d batches with %d devices, %d failed devices. Run the same command again to resume", completed, len(files), devices, failedDevices)
+	}
+	return ok
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
@@ -22,6 +24,17 @@ const (
 	PhaseComplete       MigrationPhase = "complete"
 )
 
+// DeviceStage records how far a device got in a streaming migration, where
+// devices move through the phases independently of each other.
+type DeviceStage string
+
+const (
+	StageNone     DeviceStage = ""
+	StageCreated  DeviceStage = "created"
+	StageHistory  DeviceStage = "history"
+	StageComplete DeviceStage = "complete"
+)
+
 type CheckpointState struct {
 	StartTime         time.Time                    `json:"start_time"`
 	LastUpdated       time.Time                    `json:"last_updated"`
@@ -34,18 +47,53 @@ type CheckpointState struct {
 	GatewaysProcessed map[string]struct{}          `json:"gateways_processed"`
 	TotalDevices      int                          `json:"total_devices"`
 	Args              DeviceMigratorArgs           `json:"args"`
+	Fingerprint       string                       `json:"fingerprint"`
+	DeviceOrigins     map[string]DeviceOrigin      `json:"device_origins,omitempty"`
+	DestinationsDone  map[string]struct{}          `json:"destinations_done,omitempty"`
+	DeviceStages      map[string]DeviceStage       `json:"device_stages,omitempty"`
+	UnitsInProgress   map[string][]string          `json:"-"`
+	VersionsAligned   map[string]struct{}          `json:"versions_aligned,omitempty"`
+	store             CheckpointStore              `json:"-"`
 	mutex             sync.RWMutex                 `json:"-"`
 	dirty             bool                         `json:"-"`
 	saveTimer         *time.Timer                  `json:"-"`
+	closed            bool                         `json:"-"`
+	// completedUnits are units in UnitsInProgress that CompleteUnit recorded
+	// since the last save. They are removed once the checkpoint is saved.
+	completedUnits map[string]struct{} `json:"-"`
 }
 
 var globalCheckpoint *CheckpointState
 
-func getCheckpointFilePath() string {
-	return filepath.Join(Args.workDir, "migration_checkpoint.json")
+// computeFingerprint hashes the arguments that select which devices are
+// migrated. Maps are marshalled with sorted keys, so the result is stable.
+func computeFingerprint() string {
+	data, err := json.Marshal(selectionFingerprintFields())
+	if err != nil {
+		log.Fatalf("failed to compute checkpoint fingerprint: %s\n", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
+const checkpointFileName = "migration_checkpoint.json"
+
+// unitsFileName holds the devices created by -perDeviceTransaction units in
+// progress. It is kept apart from the checkpoint, which lists every fetched
+// device, so that it can be saved before each create.
+const unitsFileName = "units_in_progress.json"
+
+// NewCheckpointState creates a checkpoint saved in the work directory, or in
+// -checkpointStore.
 func NewCheckpointState() *CheckpointState {
+	return NewCheckpointStateIn(workDirCheckpointStore(Args.workDir))
+}
+
+// NewCheckpointStateIn creates a checkpoint saved in store. The store is
+// fixed when the checkpoint is created or loaded, so a split or distributed
+// migration can keep one checkpoint per destination or shard alongside the
+// main one.
+func NewCheckpointStateIn(store CheckpointStore) *CheckpointState {
 	c := &CheckpointState{
 		StartTime:         time.Now(),
 		LastUpdated:       time.Now(),
@@ -57,6 +105,8 @@ func NewCheckpointState() *CheckpointState {
 		ConfigHistory:     make(map[string]interface{}),
 		GatewaysProcessed: make(map[string]struct{}),
 		Args:              Args,
+		Fingerprint:       computeFingerprint(),
+		store:             store,
 		dirty:             false,
 	}
 	c.startSaveTimer()
@@ -64,13 +114,16 @@ func NewCheckpointState() *CheckpointState {
 }
 
 func LoadCheckpoint() (*CheckpointState, error) {
-	checkpointPath := getCheckpointFilePath()
+	return LoadCheckpointFrom(workDirCheckpointStore(Args.workDir))
+}
 
-	if _, err := os.Stat(checkpointPath); os.IsNotExist(err) {
+// LoadCheckpointFrom loads the checkpoint saved in store. It returns nil if
+// there is none.
+func LoadCheckpointFrom(store CheckpointStore) (*CheckpointState, error) {
+	data, err := store.Read(checkpointFileName)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil, nil
 	}
-
-	data, err := os.ReadFile(checkpointPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
 	}
@@ -80,29 +133,74 @@ func LoadCheckpoint() (*CheckpointState, error) {
 		return nil, fmt.Errorf("failed to parse checkpoint file: %w", err)
 	}
 
+	state.store = store
 	state.dirty = false
+	if err := state.loadUnits(); err != nil {
+		return nil, err
+	}
 	state.startSaveTimer()
 	return &state, nil
 }
 
-func (c *CheckpointState) Save() error {
-	c.LastUpdated = time.Now()
+// loadUnits reads the units in progress. Units whose devices the checkpoint
+// already records as complete finished before their record was removed.
+func (c *CheckpointState) loadUnits() error {
+	data, err := c.store.Read(unitsFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read units in progress: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.UnitsInProgress); err != nil {
+		return fmt.Errorf("failed to parse units in progress: %w", err)
+	}
+	for unit, deviceIds := range c.UnitsInProgress {
+		complete := true
+		for _, deviceId := range deviceIds {
+			if c.DeviceStages[deviceId] != StageComplete {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			delete(c.UnitsInProgress, unit)
+		}
+	}
+	return nil
+}
 
-	if err := os.MkdirAll(Args.workDir, 0755); err != nil {
-		return fmt.Errorf("failed to create work directory: %w", err)
+func (c *CheckpointState) saveUnits() error {
+	data, err := json.MarshalIndent(c.UnitsInProgress, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal units in progress: %w", err)
+	}
+	if err := c.store.Write(unitsFileName, data); err != nil {
+		return fmt.Errorf("failed to write units in progress: %w", err)
 	}
+	return nil
+}
+
+func (c *CheckpointState) Save() error {
+	c.LastUpdated = time.Now()
 
 	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal checkpoint state: %w", err)
 	}
 
-	checkpointPath := getCheckpointFilePath()
-	if err := os.WriteFile(checkpointPath, data, 0644); err != nil {
+	if err := c.store.Write(checkpointFileName, data); err != nil {
 		return fmt.Errorf("failed to write checkpoint file: %w", err)
 	}
-
 	c.dirty = false
+
+	if len(c.completedUnits) > 0 {
+		for unit := range c.completedUnits {
+			delete(c.UnitsInProgress, unit)
+		}
+		c.completedUnits = nil
+		return c.saveUnits()
+	}
 	return nil
 }
 
@@ -117,8 +215,15 @@ func (c *CheckpointState) startSaveTimer() {
 	c.saveTimer = time.AfterFunc(5*time.Second, func() {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
+		if c.closed {
+			return
+		}
 		if c.dirty {
-			if err := c.Save(); err != nil {
+			err := c.Save()
+			if errors.Is(err, ErrObjectModified) {
+				log.Fatalf("Stopping: %s\n", err)
+			}
+			if err != nil {
 				printfColored(colorYellow, "Warning: Failed to auto-save checkpoint: %v", err)
 			}
 		}
@@ -126,6 +231,39 @@ func (c *CheckpointState) startSaveTimer() {
 	})
 }
 
+// Close saves pending changes and stops saving the checkpoint in the
+// background. It is used when a process is done with one of several
+// checkpoints, such as a shard of a distributed migration.
+func (c *CheckpointState) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+	}
+	if c.dirty {
+		return c.Save()
+	}
+	return nil
+}
+
+// Reopen marks the phases after the device fetch as not completed and saves
+// the checkpoint, so that a rerun retries the devices that were not migrated.
+// Devices, config history and gateways already processed are kept.
+func (c *CheckpointState) Reopen() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	phases := []MigrationPhase{}
+	if c.phaseCompleted(PhaseDeviceFetch) {
+		phases = append(phases, PhaseDeviceFetch)
+	}
+	c.CompletedPhases = phases
+	c.CurrentPhase = PhaseDeviceMigrate
+	return c.Save()
+}
+
 func (c *CheckpointState) FlushToDisk() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -164,6 +302,14 @@ func (c *CheckpointState) AddMigratedDevice(deviceId string) {
 	c.markDirty()
 }
 
+func (c *CheckpointState) IsDeviceMigrated(deviceId string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	_, ok := c.DevicesMigrated[deviceId]
+	return ok
+}
+
 func (c *CheckpointState) AddProcessedConfig(deviceId string, deviceConfig map[string]interface{}) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -181,6 +327,186 @@ func (c *CheckpointState) AddProcessedGateway(gatewayId string) {
 	c.markDirty()
 }
 
+// SetDeviceStage records the stage a device reached in a streaming
+// migration. Created devices are also recorded as migrated, so that the
+// checkpoint stays valid for a migration resumed without -streaming.
+func (c *CheckpointState) SetDeviceStage(deviceId string, stage DeviceStage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.DeviceStages == nil {
+		c.DeviceStages = make(map[string]DeviceStage)
+	}
+	c.DeviceStages[deviceId] = stage
+	c.DevicesMigrated[deviceId] = struct{}{}
+	c.markDirty()
+}
+
+// GetDeviceStage returns the stage a device reached. Devices without a stage
+// record, such as those of a checkpoint written without -streaming, get theirs
+// from the phase records.
+func (c *CheckpointState) GetDeviceStage(deviceId string, gateway bool) DeviceStage {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if stage, ok := c.DeviceStages[deviceId]; ok {
+		return stage
+	}
+	if _, ok := c.DevicesMigrated[deviceId]; !ok {
+		return StageNone
+	}
+	if !c.phaseCompleted(PhaseConfigHistory) {
+		return StageCreated
+	}
+	if !gateway || c.phaseCompleted(PhaseGatewayBinding) {
+		return StageComplete
+	}
+	if _, ok := c.GatewaysProcessed[deviceId]; ok {
+		return StageComplete
+	}
+	return StageHistory
+}
+
+// AddUnitCreatedDevice records a device that an incomplete
+// -perDeviceTransaction unit is about to create and saves the units in
+// progress, so that the device can be rolled back if the migration is
+// interrupted.
+func (c *CheckpointState) AddUnitCreatedDevice(unit, deviceId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.UnitsInProgress == nil {
+		c.UnitsInProgress = make(map[string][]string)
+	}
+	c.UnitsInProgress[unit] = append(c.UnitsInProgress[unit], deviceId)
+	return c.saveUnits()
+}
+
+// RemoveUnitCreatedDevice forgets a device recorded by AddUnitCreatedDevice
+// that the unit did not create after all.
+func (c *CheckpointState) RemoveUnitCreatedDevice(unit, deviceId string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deviceIds := c.UnitsInProgress[unit]
+	for i, id := range deviceIds {
+		if id == deviceId {
+			c.UnitsInProgress[unit] = append(deviceIds[:i:i], deviceIds[i+1:]...)
+			break
+		}
+	}
+	return c.saveUnits()
+}
+
+// GetUnitsInProgress returns the devices created by units that were neither
+// completed nor rolled back, by unit.
+func (c *CheckpointState) GetUnitsInProgress() map[string][]string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	units := make(map[string][]string, len(c.UnitsInProgress))
+	for unit, deviceIds := range c.UnitsInProgress {
+		units[unit] = append([]string(nil), deviceIds...)
+	}
+	return units
+}
+
+// RollbackUnit records the devices of a rolled back unit that could not be
+// deleted, so that a resumed migration tries again. The unit is forgotten
+// once none are left.
+func (c *CheckpointState) RollbackUnit(unit string, remaining []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(remaining) == 0 {
+		delete(c.UnitsInProgress, unit)
+	} else {
+		c.UnitsInProgress[unit] = remaining
+	}
+	return c.saveUnits()
+}
+
+// CompleteUnit marks every device and gateway of a unit complete in one
+// update. The checkpoint is only saved while no update is in progress, so a
+// saved checkpoint holds either the whole unit or none of it. The unit stays
+// in progress until the checkpoint is saved.
+func (c *CheckpointState) CompleteUnit(unit string, deviceIds, gatewayIds []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.DeviceStages == nil {
+		c.DeviceStages = make(map[string]DeviceStage)
+	}
+	for _, deviceId := range deviceIds {
+		c.DeviceStages[deviceId] = StageComplete
+		c.DevicesMigrated[deviceId] = struct{}{}
+	}
+	for _, gatewayId := range gatewayIds {
+		c.GatewaysProcessed[gatewayId] = struct{}{}
+	}
+	if c.completedUnits == nil {
+		c.completedUnits = make(map[string]struct{})
+	}
+	c.completedUnits[unit] = struct{}{}
+	c.markDirty()
+}
+
+// AddAlignedVersion records a device whose destination config version matches
+// its source version.
+func (c *CheckpointState) AddAlignedVersion(deviceId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.VersionsAligned == nil {
+		c.VersionsAligned = make(map[string]struct{})
+	}
+	c.VersionsAligned[deviceId] = struct{}{}
+	c.markDirty()
+}
+
+func (c *CheckpointState) IsVersionAligned(deviceId string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	_, ok := c.VersionsAligned[deviceId]
+	return ok
+}
+
+func (c *CheckpointState) SetDeviceOrigins(origins map[string]DeviceOrigin) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.DeviceOrigins = origins
+	c.markDirty()
+}
+
+func (c *CheckpointState) GetDeviceOrigins() map[string]DeviceOrigin {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.DeviceOrigins
+}
+
+func (c *CheckpointState) AddCompletedDestination(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.DestinationsDone == nil {
+		c.DestinationsDone = make(map[string]struct{})
+	}
+	c.DestinationsDone[name] = struct{}{}
+	if err := c.Save(); err != nil {
+		log.Fatalf("failed to save checkpoint state: %s\n", err)
+	}
+}
+
+func (c *CheckpointState) IsDestinationCompleted(name string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	_, ok := c.DestinationsDone[name]
+	return ok
+}
+
 func (c *CheckpointState) SetTotalDevices(count int) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -192,7 +518,10 @@ func (c *CheckpointState) SetTotalDevices(count int) {
 func (c *CheckpointState) IsPhaseCompleted(phase MigrationPhase) bool {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
+	return c.phaseCompleted(phase)
+}
 
+func (c *CheckpointState) phaseCompleted(phase MigrationPhase) bool {
 	for _, completed := range c.CompletedPhases {
 		if completed == phase {
 			return true
@@ -281,10 +610,12 @@ func (c *CheckpointState) Complete() error {
 		return err
 	}
 
-	checkpointPath := getCheckpointFilePath()
-	if err := os.Remove(checkpointPath); err != nil {
+	if err := c.store.Delete(checkpointFileName); err != nil {
 		printfColored(colorYellow, "Warning: Could not remove checkpoint file: %v", err)
 	}
+	if err := c.store.Delete(unitsFileName); err != nil {
+		printfColored(colorYellow, "Warning: Could not remove units in progress: %v", err)
+	}
 
 	return nil
 }
@@ -298,6 +629,16 @@ func InitializeCheckpointSystem() error {
 	}
 
 	if globalCheckpoint != nil {
+		fingerprint := computeFingerprint()
+		switch globalCheckpoint.Fingerprint {
+		case fingerprint:
+		case "":
+			// Checkpoints written before fingerprints were recorded adopt the current selection.
+			globalCheckpoint.Fingerprint = fingerprint
+		default:
+			return fmt.Errorf("checkpoint in %s was created with a different device selection (registry, CSV or filters). Use the original flags, a different -workDir, or remove %s to start over", Args.workDir, globalCheckpoint.store.Location(checkpointFileName))
+		}
+
 		printfColored(colorCyan, "Found existing checkpoint - resuming migration from phase: %s", globalCheckpoint.CurrentPhase)
 		printfColored(colorCyan, "Progress: %d devices fetched, %d migrated, %d configs processed",
 			len(globalCheckpoint.DevicesFetched),
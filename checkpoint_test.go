@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointUnitsInProgress(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+	checkpoint := NewCheckpointStateIn(store)
+	defer checkpoint.Close()
+
+	// Recording a create saves only the units, not the checkpoint.
+	if err := checkpoint.AddUnitCreatedDevice("a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoint.AddUnitCreatedDevice("b", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read(checkpointFileName); err == nil {
+		t.Error("checkpoint saved with the units in progress")
+	}
+	readUnits := func() map[string][]string {
+		t.Helper()
+		data, err := store.Read(unitsFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var units map[string][]string
+		if err := json.Unmarshal(data, &units); err != nil {
+			t.Fatal(err)
+		}
+		return units
+	}
+	if units := readUnits(); !reflect.DeepEqual(units, map[string][]string{"a": {"a"}, "b": {"b"}}) {
+		t.Errorf("units = %v", units)
+	}
+
+	// A completed unit is kept until the checkpoint that completes it is
+	// saved.
+	checkpoint.CompleteUnit("a", []string{"a"}, nil)
+	if units := readUnits(); len(units) != 2 {
+		t.Errorf("units = %v before the checkpoint is saved", units)
+	}
+	if err := checkpoint.FlushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if units := readUnits(); !reflect.DeepEqual(units, map[string][]string{"b": {"b"}}) {
+		t.Errorf("units = %v, want b only", units)
+	}
+	if data, _ := store.Read(checkpointFileName); strings.Contains(string(data), "units_in_progress") {
+		t.Error("checkpoint holds the units in progress")
+	}
+
+	// Devices that could not be rolled back stay recorded.
+	if err := checkpoint.RollbackUnit("b", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCheckpointFrom(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if units := loaded.GetUnitsInProgress(); !reflect.DeepEqual(units, map[string][]string{"b": {"b"}}) {
+		t.Errorf("loaded units = %v, want b", units)
+	}
+	if err := loaded.RollbackUnit("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if units := readUnits(); len(units) != 0 {
+		t.Errorf("units = %v, want none", units)
+	}
+}
+
+func TestLoadCheckpointDropsCompletedUnits(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+	checkpoint := NewCheckpointStateIn(store)
+	checkpoint.AddUnitCreatedDevice("a", "a")
+	checkpoint.AddUnitCreatedDevice("b", "b")
+	checkpoint.CompleteUnit("a", []string{"a"}, nil)
+	// The checkpoint was saved, but the process stopped before the units.
+	checkpoint.completedUnits = nil
+	if err := checkpoint.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadCheckpointFrom(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if units := loaded.GetUnitsInProgress(); !reflect.DeepEqual(units, map[string][]string{"b": {"b"}}) {
+		t.Errorf("units = %v, want b only", units)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrObjectExists is returned by CheckpointStore.Create when the object was
+// already written, possibly by another worker.
+var ErrObjectExists = errors.New("object already exists")
+
+// ErrObjectModified is returned by CheckpointStore.Write when the object was
+// changed by another process since the store last read or wrote it.
+var ErrObjectModified = errors.New("object was modified by another process")
+
+var (
+	// checkpointStoreRoot holds the checkpoints of checkpointRootDir and the
+	// directories below it when -checkpointStore is set. Otherwise
+	// checkpoints are saved in the work directory.
+	checkpointStoreRoot CheckpointStore
+	checkpointRootDir   string
+)
+
+// CheckpointStore persists checkpoints and the state shared by cooperating
+// workers as named objects. Names are slash separated paths relative to the
+// store. Read returns an error wrapping os.ErrNotExist for missing objects.
+type CheckpointStore interface {
+	Read(name string) ([]byte, error)
+	// Write creates or replaces the object. Stores that support conditional
+	// writes fail with ErrObjectModified instead of replacing an object that
+	// changed since they last read or wrote it.
+	Write(name string, data []byte) error
+	// Create writes the object only if it does not exist yet. Exactly one
+	// of several concurrent callers succeeds, the others get ErrObjectExists.
+	Create(name string, data []byte) error
+	Delete(name string) error
+	// List returns the names of the objects directly under prefix, without
+	// the prefix, in sorted order.
+	List(prefix string) ([]string, error)
+	// Location describes where an object is stored, for messages.
+	Location(name string) string
+}
+
+// openCheckpointStore returns the store for location: an s3://bucket/prefix
+// URL or a directory.
+func openCheckpointStore(location string) (CheckpointStore, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return NewS3CheckpointStore(location, Args.s3Endpoint, Args.s3Region)
+	}
+	return NewDirCheckpointStore(location), nil
+}
+
+// joinStoreLocation returns the location of sub below an s3:// URL or
+// directory location.
+func joinStoreLocation(location, sub string) string {
+	if strings.HasPrefix(location, "s3://") {
+		return strings.TrimSuffix(location, "/") + "/" + sub
+	}
+	return filepath.Join(location, filepath.FromSlash(sub))
+}
+
+// loadCheckpointStore opens -checkpointStore, so that checkpoints of the work
+// directory are saved there and resumed from there on the next start.
+func loadCheckpointStore() {
+	if Args.checkpointStore == "" {
+		return
+	}
+	store, err := openCheckpointStore(Args.checkpointStore)
+	if err != nil {
+		log.Fatalf("Invalid -checkpointStore: %s\n", err)
+	}
+	checkpointStoreRoot = store
+	checkpointRootDir = Args.workDir
+	printfColored(colorGreen, "\u2713 Saving checkpoints to %s", Args.checkpointStore)
+}
+
+// workDirCheckpointStore returns the store for the checkpoints of dir, the
+// work directory or a directory below it.
+func workDirCheckpointStore(dir string) CheckpointStore {
+	if checkpointStoreRoot == nil {
+		return NewDirCheckpointStore(dir)
+	}
+	rel, err := filepath.Rel(checkpointRootDir, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		log.Fatalf("Checkpoint directory %s is outside of the work directory %s\n", dir, checkpointRootDir)
+	}
+	if rel == "." {
+		return checkpointStoreRoot
+	}
+	return SubCheckpointStore(checkpointStoreRoot, filepath.ToSlash(rel))
+}
+
+// dirCheckpointStore stores objects as files under a local or shared
+// directory. Writes are not conditional.
+type dirCheckpointStore struct {
+	dir string
+}
+
+func NewDirCheckpointStore(dir string) CheckpointStore {
+	return &dirCheckpointStore{dir: dir}
+}
+
+func (s *dirCheckpointStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *dirCheckpointStore) Read(name string) ([]byte, error) {
+	return os.ReadFile(s.path(name))
+}
+
+// Write replaces the file through a rename, so that readers on other hosts
+// never see a partly written object.
+func (s *dirCheckpointStore) Write(name string, data []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Create relies on O_EXCL, which is atomic on local file systems and on NFS
+// version 3 and later.
+func (s *dirCheckpointStore) Create(name string, data []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return ErrObjectExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *dirCheckpointStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *dirCheckpointStore) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.path(prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *dirCheckpointStore) Location(name string) string {
+	return s.path(name)
+}
+
+// prefixedCheckpointStore scopes a store to the objects under prefix.
+type prefixedCheckpointStore struct {
+	store  CheckpointStore
+	prefix string
+}
+
+// SubCheckpointStore returns a store for the objects under prefix in store.
+func SubCheckpointStore(store CheckpointStore, prefix string) CheckpointStore {
+	return &prefixedCheckpointStore{store: store, prefix: strings.Trim(prefix, "/")}
+}
+
+func (s *prefixedCheckpointStore) name(name string) string {
+	return s.prefix + "/" + name
+}
+
+func (s *prefixedCheckpointStore) Read(name string) ([]byte, error) {
+	return s.store.Read(s.name(name))
+}
+
+func (s *prefixedCheckpointStore) Write(name string, data []byte) error {
+	return s.store.Write(s.name(name), data)
+}
+
+func (s *prefixedCheckpointStore) Create(name string, data []byte) error {
+	return s.store.Create(s.name(name), data)
+}
+
+func (s *prefixedCheckpointStore) Delete(name string) error {
+	return s.store.Delete(s.name(name))
+}
+
+func (s *prefixedCheckpointStore) List(prefix string) ([]string, error) {
+	return s.store.List(s.name(prefix))
+}
+
+func (s *prefixedCheckpointStore) Location(name string) string {
+	return s.store.Location(s.name(name))
+}
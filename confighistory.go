@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// configHistorySince is the parsed -configHistorySince. It is zero when
+// history is not limited by time.
+var configHistorySince time.Time
+
+func validateConfigHistoryFlags() {
+	if Args.configHistoryMaxVersions < 0 {
+		log.Fatalln("-configHistoryMaxVersions cannot be negative")
+	}
+	if Args.configHistorySince != "" {
+		since, err := time.Parse(time.RFC3339, Args.configHistorySince)
+		if err != nil {
+			log.Fatalf("Invalid -configHistorySince: %s\n", err)
+		}
+		configHistorySince = since
+	}
+}
+
+// trimConfigHistory drops config versions of one device that are older than
+// -configHistorySince and keeps at most -configHistoryMaxVersions of the
+// newest remaining versions. history is keyed by version number as returned
+// by fetchConfigVersionHistory.
+func trimConfigHistory(history map[string]interface{}) map[string]interface{} {
+	if Args.configHistoryMaxVersions == 0 && configHistorySince.IsZero() {
+		return history
+	}
+
+	type version struct {
+		key    string
+		number int64
+	}
+	var versions []version
+	for key, config := range history {
+		if !configHistorySince.IsZero() {
+			configMap, _ := config.(map[string]interface{})
+			updated, _ := configMap["cloudUpdateTime"].(string)
+			t, err := time.Parse(time.RFC3339Nano, updated)
+			if err != nil || t.Before(configHistorySince) {
+				continue
+			}
+		}
+		number, _ := strconv.ParseInt(key, 10, 64)
+		versions = append(versions, version{key: key, number: number})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].number > versions[j].number })
+	if limit := Args.configHistoryMaxVersions; limit > 0 && len(versions) > limit {
+		versions = versions[:limit]
+	}
+
+	trimmed := make(map[string]interface{}, len(versions))
+	for _, v := range versions {
+		trimmed[v.key] = history[v.key]
+	}
+	return trimmed
+}
+
+// trimDeviceConfigs applies trimConfigHistory to every device, dropping
+// devices left without history.
+func trimDeviceConfigs(deviceConfigs map[string]interface{}) map[string]interface{} {
+	if Args.configHistoryMaxVersions == 0 && configHistorySince.IsZero() {
+		return deviceConfigs
+	}
+	trimmed := make(map[string]interface{}, len(deviceConfigs))
+	for deviceId, history := range deviceConfigs {
+		historyMap, ok := history.(map[string]interface{})
+		if !ok {
+			trimmed[deviceId] = history
+			continue
+		}
+		if h := trimConfigHistory(historyMap); len(h) > 0 {
+			trimmed[deviceId] = h
+		}
+	}
+	return trimmed
+}
+
+// dropMatchingConfigHistory removes devices whose destination config history
+// already contains every version being uploaded with the same data, so reruns
+// do not upload history again.
+func dropMatchingConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]interface{}) map[string]interface{} {
+	if !Args.skipMatchingConfigHistory || len(deviceConfigs) == 0 {
+		return deviceConfigs
+	}
+
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+	bar := getProgressBar(len(deviceConfigs), "Comparing config history with destination registry...")
+
+	remaining := make(map[string]interface{}, len(deviceConfigs))
+	var remainingMutex sync.Mutex
+	wp := NewWorkerPool()
+	wp.Run()
+	for deviceId, history := range deviceConfigs {
+		wp.AddTask(func() {
+			defer bar.Add(1)
+			historyMap, _ := history.(map[string]interface{})
+			if historyMap != nil && destinationHistoryMatches(deviceService, deviceId, historyMap) {
+				return
+			}
+			remainingMutex.Lock()
+			remaining[deviceId] = history
+			remainingMutex.Unlock()
+		})
+	}
+	wp.Wait()
+	bar.Finish()
+
+	printfColored(colorGreen, " \u2713 %d of %d devices already have matching config history in the destination", len(deviceConfigs)-len(remaining), len(deviceConfigs))
+	return remaining
+}
+
+func destinationHistoryMatches(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, deviceId string, history map[string]interface{}) bool {
+	resp, err := deviceService.ConfigVersions.List(getCBDevicePath(deviceId)).Do()
+	if err != nil {
+		// Missing devices and transient errors fall back to uploading.
+		return false
+	}
+
+	destination := make(map[string]string, len(resp.DeviceConfigs))
+	for _, config := range resp.DeviceConfigs {
+		destination[fmt.Sprint(config.Version)] = base64.StdEncoding.EncodeToString([]byte(config.BinaryData))
+	}
+	for version, config := range history {
+		configMap, _ := config.(map[string]interface{})
+		data, _ := configMap["binaryData"].(string)
+		if existing, ok := destination[version]; !ok || existing != data {
+			return false
+		}
+	}
+	return true
+}
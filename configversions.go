@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const configVersionContext = "Config Version Alignment"
+
+// ConfigVersionResult is one row of the config version report.
+type ConfigVersionResult struct {
+	DeviceId           string
+	SourceVersion      int64
+	DestinationVersion int64
+	Status             string
+	Detail             string
+}
+
+// alignConfigVersions makes the latest config version of every migrated
+// device in the destination match its source Config.Version. Config history
+// is uploaded keyed by source version, but the latest version of a created or
+// patched device starts from the destination's own numbering, so devices that
+// are behind get their latest source config uploaded again under the source
+// version. No configs are sent to the devices. Devices whose version still
+// differs are reported in config_versions.csv. Existing devices that
+// -onConflict left untouched are not aligned.
+func alignConfigVersions(service *cbiotcore.Service, devices []*cbiotcore.Device) {
+	if !Args.preserveConfigVersions || len(devices) == 0 {
+		return
+	}
+
+	bar := getProgressBar(len(devices), "Aligning config versions with source registry...")
+
+	var results []ConfigVersionResult
+	var resultsMutex sync.Mutex
+	wp := NewWorkerPool()
+	wp.Run()
+	for _, device := range devices {
+		if conflictReport.Untouched(device.Id) {
+			bar.Add(1)
+			continue
+		}
+		wp.AddTask(func() {
+			result := alignConfigVersion(service, device)
+			if result.Status == "failed" || result.Status == "not aligned" {
+				errorLogger.AddError(configVersionContext, device.Id, errors.New(result.Detail))
+			}
+			resultsMutex.Lock()
+			results = append(results, result)
+			resultsMutex.Unlock()
+			bar.Add(1)
+		})
+	}
+	wp.Wait()
+	bar.Finish()
+
+	counts := make(map[string]int)
+	var report []ConfigVersionResult
+	for _, result := range results {
+		counts[result.Status]++
+		if result.Status != "aligned" {
+			report = append(report, result)
+		}
+	}
+	printfColored(colorGreen, " \u2713 Config versions: %d aligned, %d set to match source", counts["aligned"], counts["set"])
+	if failed := counts["not aligned"] + counts["failed"]; failed > 0 {
+		printfColored(colorYellow, " %d devices could not be aligned with their source config version", failed)
+	}
+	saveConfigVersionReport(report)
+}
+
+// saveConfigVersionReport writes the devices whose config version was not
+// already aligned to config_versions.csv in the work directory.
+func saveConfigVersionReport(report []ConfigVersionResult) {
+	if len(report) == 0 {
+		return
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].DeviceId < report[j].DeviceId })
+	reportFile := filepath.Join(Args.workDir, "config_versions.csv")
+	if err := writeConfigVersionReport(reportFile, report); err != nil {
+		log.Printf("Unable to write config version report: %s\n", err)
+		return
+	}
+	printfColored(colorGreen, " \u2713 Config version report written to %s", reportFile)
+}
+
+// alignConfigVersion sets the latest config version of one destination
+// device to its source version through the config history upload, and checks
+// the result. Aligned devices are recorded in the checkpoint, so a resumed
+// migration does not fetch them again.
+func alignConfigVersion(service *cbiotcore.Service, device *cbiotcore.Device) ConfigVersionResult {
+	result := ConfigVersionResult{DeviceId: device.Id}
+	if device.Config == nil || device.Config.Version == 0 {
+		result.Status = "aligned"
+		return result
+	}
+	result.SourceVersion = device.Config.Version
+
+	checkpoint := GetCheckpoint()
+	if checkpoint.IsVersionAligned(device.Id) {
+		result.DestinationVersion = result.SourceVersion
+		result.Status = "aligned"
+		return result
+	}
+
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+	if err := fetchDestinationConfigVersion(deviceService, &result); err != nil {
+		return result
+	}
+	switch {
+	case result.DestinationVersion == result.SourceVersion:
+		result.Status = "aligned"
+		checkpoint.AddAlignedVersion(device.Id)
+		return result
+	case result.DestinationVersion > result.SourceVersion:
+		result.Status = "not aligned"
+		result.Detail = "destination config version is ahead of the source"
+		return result
+	}
+
+	latest := map[string]interface{}{
+		"binaryData": base64.StdEncoding.EncodeToString([]byte(device.Config.BinaryData)),
+	}
+	if device.Config.CloudUpdateTime != "" {
+		latest["cloudUpdateTime"] = device.Config.CloudUpdateTime
+	}
+	if device.Config.DeviceAckTime != "" {
+		latest["deviceAckTime"] = device.Config.DeviceAckTime
+	}
+	history := map[string]interface{}{
+		device.Id: map[string]interface{}{strconv.FormatInt(result.SourceVersion, 10): latest},
+	}
+	if err := uploadConfigHistory(service, history); err != nil {
+		result.Status = "failed"
+		result.Detail = fmt.Sprintf("unable to upload config version %d: %s", result.SourceVersion, err)
+		return result
+	}
+
+	if err := fetchDestinationConfigVersion(deviceService, &result); err != nil {
+		return result
+	}
+	if result.DestinationVersion != result.SourceVersion {
+		result.Status = "not aligned"
+		result.Detail = fmt.Sprintf("destination config version is still %d after uploading version %d", result.DestinationVersion, result.SourceVersion)
+		return result
+	}
+	result.Status = "set"
+	checkpoint.AddAlignedVersion(device.Id)
+	return result
+}
+
+// fetchDestinationConfigVersion stores the latest config version of the
+// destination device in result, or marks the result failed.
+func fetchDestinationConfigVersion(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, result *ConfigVersionResult) error {
+	existing, err := deviceService.Get(getCBDevicePath(result.DeviceId)).Do()
+	if err != nil {
+		result.Status = "failed"
+		result.Detail = fmt.Sprintf("unable to fetch destination device: %s", err)
+		return err
+	}
+	result.DestinationVersion = 0
+	if existing.Config != nil {
+		result.DestinationVersion = existing.Config.Version
+	}
+	return nil
+}
+
+func writeConfigVersionReport(path string, report []ConfigVersionResult) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "sourceVersion", "destinationVersion", "status", "detail"}); err != nil {
+		return err
+	}
+	for _, r := range report {
+		if err := w.Write([]string{r.DeviceId, strconv.FormatInt(r.SourceVersion, 10), strconv.FormatInt(r.DestinationVersion, 10), r.Status, r.Detail}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	ConflictOverwrite     = "overwrite"
+	ConflictSkip          = "skip"
+	ConflictMergeMetadata = "merge-metadata"
+	ConflictFail          = "fail"
+	ConflictNewerWins     = "newer-wins"
+)
+
+const (
+	MetadataWinnerSource      = "source"
+	MetadataWinnerDestination = "destination"
+)
+
+const conflictContext = "Device Conflict"
+
+// ConflictOutcome records which -onConflict branch was taken for a device
+// that already existed in the destination registry.
+type ConflictOutcome struct {
+	DeviceId string
+	Action   string
+	Detail   string
+}
+
+type conflictRecorder struct {
+	outcomes  []ConflictOutcome
+	untouched map[string]struct{}
+	lock      sync.Mutex
+}
+
+var conflictReport = &conflictRecorder{untouched: make(map[string]struct{})}
+
+func (r *conflictRecorder) Add(outcome ConflictOutcome) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.outcomes = append(r.outcomes, outcome)
+	if outcome.Action == "skipped" || outcome.Action == "failed" {
+		r.untouched[outcome.DeviceId] = struct{}{}
+	}
+}
+
+// Untouched reports whether -onConflict left an existing device unmodified
+// in this run.
+func (r *conflictRecorder) Untouched(deviceId string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.untouched[deviceId]
+	return ok
+}
+
+func validateConflictFlags() {
+	switch Args.onConflict {
+	case ConflictOverwrite, ConflictSkip, ConflictMergeMetadata, ConflictFail, ConflictNewerWins:
+	default:
+		log.Fatalf("Invalid -onConflict %q. Must be one of: overwrite, skip, merge-metadata, fail, newer-wins\n", Args.onConflict)
+	}
+	switch Args.metadataConflictWinner {
+	case MetadataWinnerSource, MetadataWinnerDestination:
+	default:
+		log.Fatalf("Invalid -metadataConflictWinner %q. Must be source or destination\n", Args.metadataConflictWinner)
+	}
+}
+
+// resolveDeviceConflict applies -onConflict to a device whose Create returned
+// 409. cbDevice is the transformed copy of device. A nil error means the
+// device is considered migrated.
+func resolveDeviceConflict(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, device, cbDevice *cbiotcore.Device) error {
+	outcome := ConflictOutcome{DeviceId: device.Id}
+	var existing *cbiotcore.Device
+	err := func() error {
+		switch Args.onConflict {
+		case ConflictSkip:
+			outcome.Action = "skipped"
+			return nil
+
+		case ConflictFail:
+			outcome.Action = "failed"
+			outcome.Detail = "device already exists in destination registry"
+			return errors.New(outcome.Detail)
+
+		case ConflictMergeMetadata:
+			var err error
+			existing, err = deviceService.Get(getCBDevicePath(device.Id)).Do()
+			if err != nil {
+				outcome.Action = "failed"
+				outcome.Detail = fmt.Sprintf("unable to fetch destination device: %s", err)
+				return err
+			}
+			merged := *cbDevice
+			merged.Metadata = mergeMetadata(cbDevice.Metadata, existing.Metadata, Args.metadataConflictWinner)
+			diff, err := updateDevice(deviceService, device, &merged, existing)
+			if err != nil {
+				outcome.Action = "failed"
+				outcome.Detail = err.Error()
+				return err
+			}
+			outcome.Action = "merged"
+			if diff.Unchanged() {
+				outcome.Action = "unchanged"
+			}
+			outcome.Detail = fmt.Sprintf("%s metadata wins, %s", Args.metadataConflictWinner, diff)
+			return nil
+
+		case ConflictNewerWins:
+			var err error
+			existing, err = deviceService.Get(getCBDevicePath(device.Id)).Do()
+			if err != nil {
+				outcome.Action = "failed"
+				outcome.Detail = fmt.Sprintf("unable to fetch destination device: %s", err)
+				return err
+			}
+			newer, reason := sourceIsNewer(device, existing)
+			outcome.Detail = reason + ", "
+			if !newer {
+				outcome.Action = "skipped"
+				outcome.Detail = reason
+				return nil
+			}
+		}
+
+		diff, err := updateDevice(deviceService, device, cbDevice, existing)
+		if err != nil {
+			outcome.Action = "failed"
+			outcome.Detail = err.Error()
+			return err
+		}
+		outcome.Action = "overwritten"
+		if diff.Unchanged() {
+			outcome.Action = "unchanged"
+		}
+		outcome.Detail += diff.String()
+		return nil
+	}()
+	conflictReport.Add(outcome)
+	return err
+}
+
+// mergeMetadata returns the union of the source and destination metadata.
+// Keys present in both take the value from winner.
+func mergeMetadata(source, destination map[string]string, winner string) map[string]string {
+	merged := make(map[string]string, len(source)+len(destination))
+	first, second := destination, source
+	if winner == MetadataWinnerDestination {
+		first, second = source, destination
+	}
+	for k, v := range first {
+		merged[k] = v
+	}
+	for k, v := range second {
+		merged[k] = v
+	}
+	return merged
+}
+
+// sourceIsNewer compares the latest config of a source device with the one
+// already in the destination, first by config version and then by cloud
+// update time. Ties go to the destination.
+func sourceIsNewer(source, existing *cbiotcore.Device) (bool, string) {
+	var sourceConfig, destConfig cbiotcore.DeviceConfig
+	if source.Config != nil {
+		sourceConfig = *source.Config
+	}
+	if existing.Config != nil {
+		destConfig = *existing.Config
+	}
+
+	if sourceConfig.Version != destConfig.Version {
+		return sourceConfig.Version > destConfig.Version,
+			fmt.Sprintf("source config version %d, destination config version %d", sourceConfig.Version, destConfig.Version)
+	}
+
+	sourceTime, _ := time.Parse(time.RFC3339Nano, sourceConfig.CloudUpdateTime)
+	destTime, _ := time.Parse(time.RFC3339Nano, destConfig.CloudUpdateTime)
+	return sourceTime.After(destTime),
+		fmt.Sprintf("config version %d on both, source updated %s, destination updated %s", sourceConfig.Version, sourceConfig.CloudUpdateTime, destConfig.CloudUpdateTime)
+}
+
+// writeConflictReport writes the conflict outcomes recorded since the last
+// call to conflict_report.csv in the work directory and prints a count per
+// action.
+func writeConflictReport() {
+	conflictReport.lock.Lock()
+	outcomes := conflictReport.outcomes
+	conflictReport.outcomes = nil
+	conflictReport.lock.Unlock()
+
+	if len(outcomes) == 0 {
+		return
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].DeviceId < outcomes[j].DeviceId })
+
+	counts := make(map[string]int)
+	for _, outcome := range outcomes {
+		counts[outcome.Action]++
+	}
+	printfColored(colorYellow, " %d devices already existed in the destination registry (-onConflict %s): %d overwritten, %d merged, %d unchanged, %d skipped, %d failed",
+		len(outcomes), Args.onConflict, counts["overwritten"], counts["merged"], counts["unchanged"], counts["skipped"], counts["failed"])
+
+	reportFile := filepath.Join(Args.workDir, "conflict_report.csv")
+	if err := writeConflictOutcomes(reportFile, outcomes); err != nil {
+		log.Printf("Unable to write conflict report: %s\n", err)
+		return
+	}
+	printfColored(colorGreen, " \u2713 Conflict report written to %s", reportFile)
+}
+
+func writeConflictOutcomes(path string, outcomes []ConflictOutcome) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "policy", "action", "detail"}); err != nil {
+		return err
+	}
+	for _, o := range outcomes {
+		if err := w.Write([]string{o.DeviceId, Args.onConflict, o.Action, o.Detail}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
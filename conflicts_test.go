@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func TestMergeMetadata(t *testing.T) {
+	source := map[string]string{"fleet": "a", "only-source": "s"}
+	destination := map[string]string{"fleet": "b", "only-destination": "d"}
+
+	tests := []struct {
+		winner string
+		want   map[string]string
+	}{
+		{MetadataWinnerSource, map[string]string{"fleet": "a", "only-source": "s", "only-destination": "d"}},
+		{MetadataWinnerDestination, map[string]string{"fleet": "b", "only-source": "s", "only-destination": "d"}},
+	}
+	for _, tt := range tests {
+		if got := mergeMetadata(source, destination, tt.winner); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeMetadata(%s) = %v, want %v", tt.winner, got, tt.want)
+		}
+	}
+
+	if got := mergeMetadata(nil, nil, MetadataWinnerSource); got == nil || len(got) != 0 {
+		t.Errorf("mergeMetadata(nil, nil) = %#v, want an empty map", got)
+	}
+	// The inputs are never modified.
+	if source["fleet"] != "a" || destination["fleet"] != "b" || len(source) != 2 || len(destination) != 2 {
+		t.Errorf("inputs changed: %v %v", source, destination)
+	}
+}
+
+func TestSourceIsNewer(t *testing.T) {
+	config := func(version int64, updated string) *cbiotcore.Device {
+		return &cbiotcore.Device{Config: &cbiotcore.DeviceConfig{Version: version, CloudUpdateTime: updated}}
+	}
+
+	tests := []struct {
+		name             string
+		source, existing *cbiotcore.Device
+		want             bool
+	}{
+		{"higher version", config(3, "2020-01-01T00:00:00Z"), config(2, "2024-01-01T00:00:00Z"), true},
+		{"lower version", config(1, "2024-01-01T00:00:00Z"), config(2, "2020-01-01T00:00:00Z"), false},
+		{"same version, newer", config(2, "2024-01-01T00:00:00.5Z"), config(2, "2024-01-01T00:00:00Z"), true},
+		{"same version, older", config(2, "2023-01-01T00:00:00Z"), config(2, "2024-01-01T00:00:00Z"), false},
+		{"tie", config(2, "2024-01-01T00:00:00Z"), config(2, "2024-01-01T00:00:00Z"), false},
+		{"no source config", &cbiotcore.Device{}, config(1, ""), false},
+		{"no destination config", config(1, ""), &cbiotcore.Device{}, true},
+		{"no configs", &cbiotcore.Device{}, &cbiotcore.Device{}, false},
+	}
+	for _, tt := range tests {
+		got, reason := sourceIsNewer(tt.source, tt.existing)
+		if got != tt.want {
+			t.Errorf("%s: sourceIsNewer = %v (%s), want %v", tt.name, got, reason, tt.want)
+		}
+		if reason == "" {
+			t.Errorf("%s: no reason", tt.name)
+		}
+	}
+}
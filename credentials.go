@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+var (
+	sourceEndpoint      *ClearBladeEndpoint
+	destinationEndpoint *ClearBladeEndpoint
+
+	// serviceConstructionLock serializes the short window in which
+	// CLEARBLADE_CONFIGURATION is pointed at a temporary credentials file
+	// so that cbiotcore.NewService can initialize its HTTP client.
+	serviceConstructionLock sync.Mutex
+
+	credentialsCache     = make(map[string]*cbiotcore.ServiceAccountCredentials)
+	credentialsCacheLock sync.Mutex
+)
+
+const serviceAccountEnvPrefix = "env:"
+
+// ClearBladeEndpoint ties a registry to the service account credentials used
+// to reach it. Credentials are held in memory so that source and destination
+// services can be used side by side without touching the process environment.
+type ClearBladeEndpoint struct {
+	Credentials  *cbiotcore.ServiceAccountCredentials
+	RegistryName string
+	Region       string
+}
+
+func NewClearBladeEndpoint(serviceAccount, registryName, region string) (*ClearBladeEndpoint, error) {
+	creds, err := loadServiceAccountCredentials(serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+	return &ClearBladeEndpoint{
+		Credentials:  creds,
+		RegistryName: registryName,
+		Region:       region,
+	}, nil
+}
+
+func (e *ClearBladeEndpoint) RegistryPath() string {
+	return fmt.Sprintf("projects/%s/locations/%s/registries/%s", e.Credentials.Project, e.Region, e.RegistryName)
+}
+
+func (e *ClearBladeEndpoint) DevicePath(deviceId string) string {
+	return fmt.Sprintf("%s/devices/%s", e.RegistryPath(), deviceId)
+}
+
+// NewService builds an IoT Core service bound to this endpoint's credentials.
+func (e *ClearBladeEndpoint) NewService() (*cbiotcore.Service, error) {
+	return newIoTCoreService(e.Credentials)
+}
+
+// namedEndpoint is one row of a registry list CSV.
+type namedEndpoint struct {
+	Name     string
+	Endpoint *ClearBladeEndpoint
+}
+
+// readEndpointsCsv reads a CSV listing one registry per row, with the columns
+// nameColumn, registryName, region and, optionally, serviceAccount. Rows
+// without a service account use defaultServiceAccount, which is set by the
+// flag named defaultFlag.
+func readEndpointsCsv(path, nameColumn, defaultServiceAccount, defaultFlag string) ([]namedEndpoint, error) {
+	rows, err := readCsvFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("%s must list at least one registry", path)
+	}
+
+	columns := map[string]int{nameColumn: -1, "registryName": -1, "region": -1, "serviceAccount": -1}
+	for i, name := range rows[0] {
+		if _, ok := columns[name]; ok {
+			columns[name] = i
+		}
+	}
+	for _, required := range []string{nameColumn, "registryName", "region"} {
+		if columns[required] == -1 {
+			return nil, fmt.Errorf("%s must have %s, registryName and region columns", path, nameColumn)
+		}
+	}
+	column := func(row []string, name string) string {
+		if idx := columns[name]; idx != -1 && idx < len(row) {
+			return strings.TrimSpace(row[idx])
+		}
+		return ""
+	}
+
+	var entries []namedEndpoint
+	names := make(map[string]struct{})
+	for line, row := range rows[1:] {
+		name := column(row, nameColumn)
+		if name == "" {
+			return nil, fmt.Errorf("%s line %d: %s is required", path, line+2, nameColumn)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("%s line %d: duplicate %s %q", path, line+2, nameColumn, name)
+		}
+		names[name] = struct{}{}
+
+		registryName, region := column(row, "registryName"), column(row, "region")
+		if registryName == "" || region == "" {
+			return nil, fmt.Errorf("%s line %d: registryName and region are required", path, line+2)
+		}
+
+		serviceAccount := column(row, "serviceAccount")
+		if serviceAccount == "" {
+			serviceAccount = defaultServiceAccount
+		}
+		if serviceAccount == "" {
+			return nil, fmt.Errorf("%s line %d: no serviceAccount and %s is not set", path, line+2, defaultFlag)
+		}
+		if err := validateServiceAccountFlag(serviceAccount); err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid service account: %w", path, line+2, err)
+		}
+
+		endpoint, err := NewClearBladeEndpoint(serviceAccount, registryName, region)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line+2, err)
+		}
+		entries = append(entries, namedEndpoint{Name: name, Endpoint: endpoint})
+	}
+	return entries, nil
+}
+
+// loadServiceAccountCredentials resolves a service account reference and
+// validates its contents. The reference may be a file path, "-" to read the
+// JSON document from stdin, or "env:VAR_NAME" to read it from an environment
+// variable. Results are cached per reference since stdin can only be read once.
+func loadServiceAccountCredentials(serviceAccount string) (*cbiotcore.ServiceAccountCredentials, error) {
+	credentialsCacheLock.Lock()
+	defer credentialsCacheLock.Unlock()
+
+	if creds, ok := credentialsCache[serviceAccount]; ok {
+		return creds, nil
+	}
+
+	content, source, err := readServiceAccount(serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := parseServiceAccountCredentials(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account from %s: %w", source, err)
+	}
+
+	credentialsCache[serviceAccount] = creds
+	return creds, nil
+}
+
+func readServiceAccount(serviceAccount string) ([]byte, string, error) {
+	switch {
+	case serviceAccount == "":
+		return nil, "", errors.New("no service account supplied")
+	case serviceAccount == "-":
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, "stdin", fmt.Errorf("failed to read service account from stdin: %w", err)
+		}
+		return content, "stdin", nil
+	case strings.HasPrefix(serviceAccount, serviceAccountEnvPrefix):
+		name := strings.TrimPrefix(serviceAccount, serviceAccountEnvPrefix)
+		if name == "" {
+			return nil, serviceAccount, fmt.Errorf("no environment variable name given in %q", serviceAccount)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return nil, serviceAccount, fmt.Errorf("environment variable %s is not set or empty", name)
+		}
+		return []byte(value), fmt.Sprintf("environment variable %s", name), nil
+	default:
+		path, err := getAbsPath(serviceAccount)
+		if err != nil {
+			return nil, serviceAccount, err
+		}
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, path, fmt.Errorf("could not locate service account file %s. Please make sure the path is correct", path)
+		}
+		if err != nil {
+			return nil, path, fmt.Errorf("failed to read service account file %s: %w", path, err)
+		}
+		return content, fmt.Sprintf("file %s", path), nil
+	}
+}
+
+func parseServiceAccountCredentials(content []byte) (*cbiotcore.ServiceAccountCredentials, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, errors.New("service account is empty")
+	}
+
+	var creds cbiotcore.ServiceAccountCredentials
+	if err := json.Unmarshal(content, &creds); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, fmt.Errorf("service account is not valid JSON (offset %d): %w", syntaxErr.Offset, err)
+		}
+		return nil, fmt.Errorf("service account JSON has an unexpected structure: %w", err)
+	}
+
+	var missing []string
+	if creds.Project == "" {
+		missing = append(missing, "project")
+	}
+	if creds.SystemKey == "" {
+		missing = append(missing, "systemKey")
+	}
+	if creds.Token == "" {
+		missing = append(missing, "token")
+	}
+	if creds.Url == "" {
+		missing = append(missing, "url")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("service account is missing required field(s): %s", strings.Join(missing, ", "))
+	}
+
+	u, err := url.Parse(creds.Url)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("service account url %q is not an absolute URL", creds.Url)
+	}
+	creds.Url = strings.TrimSuffix(creds.Url, "/")
+
+	return &creds, nil
+}
+
+// newIoTCoreService creates a service from in-memory credentials. The go-iot
+// library only exposes an environment-driven constructor, so the credentials
+// are written to a private temporary file for the duration of the call and the
+// previous CLEARBLADE_CONFIGURATION value is restored before returning.
+func newIoTCoreService(creds *cbiotcore.ServiceAccountCredentials) (*cbiotcore.Service, error) {
+	content, err := json.Marshal(creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal service account credentials: %w", err)
+	}
+
+	serviceConstructionLock.Lock()
+	defer serviceConstructionLock.Unlock()
+
+	f, err := os.CreateTemp("", "cb-service-account-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary credentials file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write temporary credentials file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write temporary credentials file: %w", err)
+	}
+
+	previous, hadPrevious := os.LookupEnv("CLEARBLADE_CONFIGURATION")
+	if err := os.Setenv("CLEARBLADE_CONFIGURATION", f.Name()); err != nil {
+		return nil, fmt.Errorf("failed to set CLEARBLADE_CONFIGURATION env variable: %w", err)
+	}
+	defer func() {
+		if hadPrevious {
+			os.Setenv("CLEARBLADE_CONFIGURATION", previous)
+		} else {
+			os.Unsetenv("CLEARBLADE_CONFIGURATION")
+		}
+	}()
+
+	service, err := cbiotcore.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep our own copy so later mutations of creds cannot leak into the service.
+	credsCopy := *creds
+	service.ServiceAccountCredentials = &credsCopy
+	return service, nil
+}
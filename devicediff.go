@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// deviceDiff describes what updateDevice changed on an existing destination
+// device: the patched fields, in update mask form, and whether the latest
+// config was modified.
+type deviceDiff struct {
+	Fields []string
+	Config bool
+}
+
+func (d deviceDiff) Unchanged() bool {
+	return len(d.Fields) == 0 && !d.Config
+}
+
+func (d deviceDiff) String() string {
+	if d.Unchanged() {
+		return "no changes"
+	}
+	var parts []string
+	if len(d.Fields) > 0 {
+		parts = append(parts, "patched "+strings.Join(d.Fields, ","))
+	}
+	if d.Config {
+		parts = append(parts, "config updated")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// computeUpdateMask compares the transformed source device with the device
+// already in the destination and returns the update mask fields that differ.
+// Credentials are only compared when -updatePublicKeys is set.
+func computeUpdateMask(existing, cbDevice *cbiotcore.Device) []string {
+	var fields []string
+	if Args.updatePublicKeys && !equalCredentials(existing.Credentials, cbDevice.Credentials) {
+		fields = append(fields, "credentials")
+	}
+	if existing.Blocked != cbDevice.Blocked {
+		fields = append(fields, "blocked")
+	}
+	if !equalMetadata(existing.Metadata, cbDevice.Metadata) {
+		fields = append(fields, "metadata")
+	}
+	if normalizeLogLevel(existing.LogLevel) != normalizeLogLevel(cbDevice.LogLevel) {
+		fields = append(fields, "logLevel")
+	}
+	if gatewayAuthMethod(existing) != gatewayAuthMethod(cbDevice) {
+		fields = append(fields, "gatewayConfig.gatewayAuthMethod")
+	}
+	return fields
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// equalCredentials compares credentials as a set, ignoring surrounding
+// whitespace in keys and treating an unset expiration time and the epoch as
+// the same "never expires" value.
+func equalCredentials(a, b []*cbiotcore.DeviceCredential) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ka, kb := credentialKeys(a), credentialKeys(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func credentialKeys(creds []*cbiotcore.DeviceCredential) []string {
+	keys := make([]string, 0, len(creds))
+	for _, cred := range creds {
+		var format, key string
+		if cred.PublicKey != nil {
+			format, key = cred.PublicKey.Format, strings.TrimSpace(cred.PublicKey.Key)
+		}
+		expiration := ""
+		if t, err := time.Parse(time.RFC3339Nano, cred.ExpirationTime); err == nil && t.Unix() != 0 {
+			expiration = t.UTC().Format(time.RFC3339Nano)
+		}
+		keys = append(keys, format+"\x00"+key+"\x00"+expiration)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalizeLogLevel maps the unset log level to NONE, which is what
+// registries report for devices without one.
+func normalizeLogLevel(level string) string {
+	if level == "" || level == "LOG_LEVEL_UNSPECIFIED" {
+		return "NONE"
+	}
+	return level
+}
+
+func gatewayAuthMethod(device *cbiotcore.Device) string {
+	if device.GatewayConfig == nil {
+		return ""
+	}
+	return device.GatewayConfig.GatewayAuthMethod
+}
+
+func configBinaryData(device *cbiotcore.Device) string {
+	if device.Config == nil {
+		return ""
+	}
+	return device.Config.BinaryData
+}
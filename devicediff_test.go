@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func diffTestDevice() *cbiotcore.Device {
+	return &cbiotcore.Device{
+		Id:       "d",
+		LogLevel: "INFO",
+		Metadata: map[string]string{"fleet": "a"},
+		Credentials: []*cbiotcore.DeviceCredential{
+			{PublicKey: &cbiotcore.PublicKeyCredential{Format: "RSA_PEM", Key: "key-1"}},
+			{PublicKey: &cbiotcore.PublicKeyCredential{Format: "ES256_PEM", Key: "key-2"}, ExpirationTime: "2030-01-01T00:00:00Z"},
+		},
+		GatewayConfig: &cbiotcore.GatewayConfig{GatewayAuthMethod: "ASSOCIATION_ONLY"},
+	}
+}
+
+func TestComputeUpdateMask(t *testing.T) {
+	tests := []struct {
+		name             string
+		updatePublicKeys bool
+		change           func(d *cbiotcore.Device)
+		want             []string
+	}{
+		{"unchanged", true, func(d *cbiotcore.Device) {}, nil},
+		{"blocked", false, func(d *cbiotcore.Device) { d.Blocked = true }, []string{"blocked"}},
+		{"metadata value", false, func(d *cbiotcore.Device) { d.Metadata["fleet"] = "b" }, []string{"metadata"}},
+		{"metadata key", false, func(d *cbiotcore.Device) { d.Metadata = map[string]string{"region": "a"} }, []string{"metadata"}},
+		{"log level", false, func(d *cbiotcore.Device) { d.LogLevel = "DEBUG" }, []string{"logLevel"}},
+		{"gateway auth", false, func(d *cbiotcore.Device) { d.GatewayConfig = nil }, []string{"gatewayConfig.gatewayAuthMethod"}},
+		{"credentials ignored", false, func(d *cbiotcore.Device) { d.Credentials = nil }, nil},
+		{"credentials", true, func(d *cbiotcore.Device) { d.Credentials = d.Credentials[:1] }, []string{"credentials"}},
+		{"all in order", true, func(d *cbiotcore.Device) {
+			d.Credentials, d.Blocked, d.Metadata, d.LogLevel, d.GatewayConfig = nil, true, nil, "", nil
+		}, []string{"credentials", "blocked", "metadata", "logLevel", "gatewayConfig.gatewayAuthMethod"}},
+	}
+
+	saved := Args
+	t.Cleanup(func() { Args = saved })
+	for _, tt := range tests {
+		Args.updatePublicKeys = tt.updatePublicKeys
+		cbDevice := diffTestDevice()
+		tt.change(cbDevice)
+		if got := computeUpdateMask(diffTestDevice(), cbDevice); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: computeUpdateMask = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestComputeUpdateMaskLogLevel(t *testing.T) {
+	for _, pair := range [][2]string{{"", "NONE"}, {"LOG_LEVEL_UNSPECIFIED", ""}, {"NONE", "LOG_LEVEL_UNSPECIFIED"}} {
+		existing, cbDevice := diffTestDevice(), diffTestDevice()
+		existing.LogLevel, cbDevice.LogLevel = pair[0], pair[1]
+		if got := computeUpdateMask(existing, cbDevice); got != nil {
+			t.Errorf("log levels %q and %q: computeUpdateMask = %v, want none", pair[0], pair[1], got)
+		}
+	}
+}
+
+func TestEqualCredentials(t *testing.T) {
+	cred := func(format, key, expiration string) *cbiotcore.DeviceCredential {
+		return &cbiotcore.DeviceCredential{PublicKey: &cbiotcore.PublicKeyCredential{Format: format, Key: key}, ExpirationTime: expiration}
+	}
+
+	tests := []struct {
+		name string
+		a, b []*cbiotcore.DeviceCredential
+		want bool
+	}{
+		{"empty", nil, []*cbiotcore.DeviceCredential{}, true},
+		{"order", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", ""), cred("ES256_PEM", "2", "")},
+			[]*cbiotcore.DeviceCredential{cred("ES256_PEM", "2", ""), cred("RSA_PEM", "1", "")}, true},
+		{"whitespace", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1\n", "")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_PEM", " 1", "")}, true},
+		{"epoch", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "1970-01-01T00:00:00Z")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "")}, true},
+		{"time zone", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "2030-01-01T01:00:00+01:00")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "2030-01-01T00:00:00Z")}, true},
+		{"expiration", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "2030-01-01T00:00:00Z")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "")}, false},
+		{"format", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_X509_PEM", "1", "")}, false},
+		{"count", []*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", "")},
+			[]*cbiotcore.DeviceCredential{cred("RSA_PEM", "1", ""), cred("RSA_PEM", "1", "")}, false},
+	}
+	for _, tt := range tests {
+		if got := equalCredentials(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: equalCredentials = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceDiffString(t *testing.T) {
+	tests := []struct {
+		diff deviceDiff
+		want string
+	}{
+		{deviceDiff{}, "no changes"},
+		{deviceDiff{Fields: []string{"blocked", "metadata"}}, "patched blocked,metadata"},
+		{deviceDiff{Config: true}, "config updated"},
+		{deviceDiff{Fields: []string{"logLevel"}, Config: true}, "patched logLevel; config updated"},
+	}
+	for _, tt := range tests {
+		if got := tt.diff.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
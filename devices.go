@@ -39,7 +39,10 @@ func fetchDevicesFromCSV(service *cbiotcore.ProjectsLocationsRegistriesDevicesSe
 	if err != nil {
 		log.Fatal(err)
 	}
-	deviceIds := parseDeviceIds(csvData)
+	deviceIds, err := parseDeviceIds(csvData)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	remainingDeviceIds := checkpoint.GetUnfetchedDeviceIds(deviceIds)
 	if len(remainingDeviceIds) == 0 {
@@ -168,7 +171,7 @@ func fetchConfigVersionHistory(device *cbiotcore.Device, service *cbiotcore.Proj
 	// 	}
 	// }
 
-	return configs, nil
+	return trimConfigHistory(configs), nil
 }
 
 func fetchGatewayBindings(service *cbiotcore.Service, devices []*cbiotcore.Device) map[string][]*cbiotcore.Device {
@@ -190,11 +193,13 @@ func fetchGatewayBindings(service *cbiotcore.Service, devices []*cbiotcore.Devic
 	wp.Run()
 	for _, gateway := range gateways {
 		wp.AddTask(func() {
-			req := deviceService.List(getCBSourceRegistryPath()).GatewayListOptionsAssociationsGatewayId(gateway.Id).PageSize(Args.pageSize)
+			registryPath, sourceGatewayId := sourceLocation(gateway.Id)
+			req := deviceService.List(registryPath).GatewayListOptionsAssociationsGatewayId(sourceGatewayId).PageSize(Args.pageSize)
 			allBoundDevices, err := paginatedFetch(req, "")
 			if err != nil {
 				log.Fatalf("Error fetching gateways: %s\n", err)
 			}
+			allBoundDevices = mergedBoundDevices(gateway.Id, allBoundDevices)
 
 			bindingMutex.Lock()
 			defer bindingMutex.Unlock()
@@ -267,45 +272,7 @@ func migrateBoundDevicesToClearBlade(service *cbiotcore.Service, gatewayBindings
 	for _, gatewayID := range remainingGateways {
 		boundDevices := gatewayBindings[gatewayID]
 		wp.AddTask(func() {
-
-			// First unbind any existing devices from the target gateway
-			unbindFromGatewayIfAlreadyExistsInCBRegistry(gatewayID, parent, deviceService, registryService)
-
-			// Process each bound device
-			for _, device := range boundDevices {
-				// Check if device exists in target registry
-				_, err := deviceService.Get(getCBDevicePath(device.Id)).Do()
-				if err != nil {
-					if !strings.Contains(err.Error(), "Error 404") {
-						errorLogger.AddError("Get Bound Device", device.Id, err)
-						continue
-					}
-
-					// Create device if it doesn't exist
-					_, createErr := deviceService.Create(parent, transform(device)).Do()
-					if createErr != nil {
-						errorLogger.AddError("Create Bound Device", device.Id, createErr)
-						continue
-					}
-				}
-
-				// Bind the device to the gateway
-				bindDeviceResp, err := registryService.BindDeviceToGateway(parent, &cbiotcore.BindDeviceToGatewayRequest{
-					DeviceId:  device.Id,
-					GatewayId: gatewayID,
-				}).Do()
-
-				if err != nil {
-					errorLogger.AddError("Bind device to gateway", device.Id, err)
-					continue
-				}
-
-				if bindDeviceResp.ServerResponse.HTTPStatusCode != http.StatusOK {
-					errorLogger.AddError("Bind device to gateway non-200 status", device.Id, err)
-					continue
-				}
-			}
-
+			bindGatewayDevices(deviceService, registryService, parent, gatewayID, boundDevices)
 			checkpoint.AddProcessedGateway(gatewayID)
 			bar.Add(1)
 		})
@@ -316,6 +283,60 @@ func migrateBoundDevicesToClearBlade(service *cbiotcore.Service, gatewayBindings
 	printfColored(colorGreen, "\u2713 Done migrating bound devices for gateways")
 }
 
+// bindGatewayDevices replaces the bound devices of a destination gateway with
+// boundDevices, creating any that do not exist in the destination yet. It
+// returns the number of devices that could not be bound.
+func bindGatewayDevices(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, registryService *cbiotcore.ProjectsLocationsRegistriesService, parent, gatewayID string, boundDevices []*cbiotcore.Device) int {
+	// First unbind any existing devices from the target gateway
+	unbindFromGatewayIfAlreadyExistsInCBRegistry(destinationDeviceId(gatewayID), parent, deviceService, registryService)
+
+	failed := 0
+	// Process each bound device
+	for _, device := range boundDevices {
+		// Check if device exists in target registry
+		_, err := deviceService.Get(getCBDevicePath(device.Id)).Do()
+		if err != nil {
+			if !strings.Contains(err.Error(), "Error 404") {
+				errorLogger.AddError("Get Bound Device", device.Id, err)
+				failed++
+				continue
+			}
+
+			// Create device if it doesn't exist
+			cbDevice, err := transform(device)
+			if err != nil {
+				failed++
+				continue
+			}
+			_, createErr := deviceService.Create(parent, cbDevice).Do()
+			if createErr != nil {
+				errorLogger.AddError("Create Bound Device", device.Id, createErr)
+				failed++
+				continue
+			}
+		}
+
+		// Bind the device to the gateway
+		bindDeviceResp, err := registryService.BindDeviceToGateway(parent, &cbiotcore.BindDeviceToGatewayRequest{
+			DeviceId:  destinationDeviceId(device.Id),
+			GatewayId: destinationDeviceId(gatewayID),
+		}).Do()
+
+		if err != nil {
+			errorLogger.AddError("Bind device to gateway", device.Id, err)
+			failed++
+			continue
+		}
+
+		if bindDeviceResp.ServerResponse.HTTPStatusCode != http.StatusOK {
+			errorLogger.AddError("Bind device to gateway non-200 status", device.Id, err)
+			failed++
+			continue
+		}
+	}
+	return failed
+}
+
 func addDevicesToClearBlade(service *cbiotcore.Service, devices []*cbiotcore.Device) int {
 	checkpoint := GetCheckpoint()
 
@@ -342,34 +363,9 @@ func addDevicesToClearBlade(service *cbiotcore.Service, devices []*cbiotcore.Dev
 
 	for _, device := range remainingDevices {
 		wp.AddTask(func() {
-			resp, err := deviceService.Create(getCBRegistryPath(), transform(device)).Do()
-			if err == nil {
-				// Create Device Successful
-				successfulCreates.Increment()
-				checkpoint.AddMigratedDevice(device.Id)
-				bar.Add(1)
-				return
-			}
-
-			// Checking if device exists - status code 409
-			if !strings.Contains(err.Error(), "Error 409") {
-				errorLogger.AddError("Create Device", device.Id, err)
-				return
-			}
-
-			// Checking if network error
-			if resp != nil && resp.ServerResponse.HTTPStatusCode != http.StatusConflict {
-				errorLogger.AddError("Create Device", device.Id, err)
+			if _, ok := createDevice(deviceService, device); !ok {
 				return
 			}
-
-			// If Device exists, patch it
-			err = updateDevice(deviceService, device)
-			if err != nil {
-				errorLogger.AddError("Patch Device", device.Id, err)
-				return
-			}
-
 			successfulCreates.Increment()
 			checkpoint.AddMigratedDevice(device.Id)
 			bar.Add(1)
@@ -377,40 +373,84 @@ func addDevicesToClearBlade(service *cbiotcore.Service, devices []*cbiotcore.Dev
 	}
 
 	wp.Wait()
+	writeConflictReport()
 	checkpoint.SetPhase(PhaseConfigHistory)
 	return successfulCreates.Count()
 }
 
-func updateDevice(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, device *cbiotcore.Device) error {
-	patchCall := deviceService.Patch(getCBDevicePath(device.Id), transform(device))
+// createDevice creates device in the destination registry, or resolves the
+// conflict with -onConflict if it already exists. created reports whether the
+// device is new. Failures are logged to the error logger.
+func createDevice(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, device *cbiotcore.Device) (created, ok bool) {
+	cbDevice, err := transform(device)
+	if err != nil {
+		return false, false
+	}
+	resp, err := deviceService.Create(getCBRegistryPath(), cbDevice).Do()
+	if err == nil {
+		// Create Device Successful
+		return true, true
+	}
+
+	// Checking if device exists - status code 409
+	if !strings.Contains(err.Error(), "Error 409") {
+		errorLogger.AddError("Create Device", device.Id, err)
+		return false, false
+	}
 
-	if Args.updatePublicKeys {
-		patchCall.UpdateMask("credentials,blocked,metadata,logLevel,gatewayConfig.gatewayAuthMethod")
-	} else {
-		patchCall.UpdateMask("blocked,metadata,logLevel,gatewayConfig.gatewayAuthMethod")
+	// Checking if network error
+	if resp != nil && resp.ServerResponse.HTTPStatusCode != http.StatusConflict {
+		errorLogger.AddError("Create Device", device.Id, err)
+		return false, false
 	}
 
-	_, err := patchCall.Do()
+	// If Device exists, resolve the conflict with -onConflict
+	err = resolveDeviceConflict(deviceService, device, cbDevice)
 	if err != nil {
-		return err
+		errorLogger.AddError(conflictContext, device.Id, err)
+		return false, false
 	}
+	return false, true
+}
 
-	if !Args.skipConfig {
+// updateDevice patches an existing destination device with cbDevice, the
+// transformed copy of the source device. Only fields that differ from the
+// destination device are patched, and the latest config is only modified when
+// its data differs, so reruns do not bump config versions. existing is
+// fetched when nil.
+func updateDevice(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, device, cbDevice, existing *cbiotcore.Device) (deviceDiff, error) {
+	var diff deviceDiff
+	if existing == nil {
+		var err error
+		existing, err = deviceService.Get(getCBDevicePath(device.Id)).Do()
+		if err != nil {
+			return diff, err
+		}
+	}
+
+	diff.Fields = computeUpdateMask(existing, cbDevice)
+	if len(diff.Fields) > 0 {
+		patchCall := deviceService.Patch(getCBDevicePath(device.Id), cbDevice)
+		patchCall.UpdateMask(strings.Join(diff.Fields, ","))
+		if _, err := patchCall.Do(); err != nil {
+			return diff, err
+		}
+	}
+
+	if !Args.skipConfig && configBinaryData(device) != configBinaryData(existing) {
 		config := &cbiotcore.ModifyCloudToDeviceConfigRequest{
 			VersionToUpdate: 0,
-			BinaryData:      base64.StdEncoding.EncodeToString([]byte(device.Config.BinaryData)),
+			BinaryData:      base64.StdEncoding.EncodeToString([]byte(configBinaryData(device))),
 		}
 
 		updateConfigCall := deviceService.ModifyCloudToDeviceConfig(getCBDevicePath(device.Id), config)
-		_, err := updateConfigCall.Do()
-		if err != nil {
-			return err
+		if _, err := updateConfigCall.Do(); err != nil {
+			return diff, err
 		}
-
-		return nil
+		diff.Config = true
 	}
 
-	return nil
+	return diff, nil
 }
 
 func updateConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]interface{}) error {
@@ -439,11 +479,23 @@ func updateConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]in
 		return nil
 	}
 
+	deviceConfigs = dropMatchingConfigHistory(service, trimDeviceConfigs(deviceConfigs))
 	if len(deviceConfigs) == 0 {
 		checkpoint.SetPhase(PhaseGatewayBinding)
 		return nil
 	}
 
+	if err := uploadConfigHistory(service, deviceConfigs); err != nil {
+		return err
+	}
+
+	checkpoint.SetPhase(PhaseGatewayBinding)
+	return nil
+}
+
+// uploadConfigHistory posts config history, keyed by source device ID, to the
+// destination registry's devicesConfigHistoryUpdate code service.
+func uploadConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]interface{}) error {
 	// Post body format:
 	//
 	// {
@@ -455,8 +507,16 @@ func updateConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]in
 	// 	}
 	// }
 
-	creds, _ := cbiotcore.GetRegistryCredentials(Args.cbRegistryName, Args.cbRegistryRegion, service)
-	transformedDeviceConfigHistory := map[string]interface{}{"configs": deviceConfigs}
+	creds, err := cbiotcore.GetRegistryCredentials(destinationEndpoint.RegistryName, destinationEndpoint.Region, service)
+	if err != nil {
+		return err
+	}
+	// History is keyed by destination device ID.
+	destinationConfigs := make(map[string]interface{}, len(deviceConfigs))
+	for deviceId, history := range deviceConfigs {
+		destinationConfigs[destinationDeviceId(deviceId)] = history
+	}
+	transformedDeviceConfigHistory := map[string]interface{}{"configs": destinationConfigs}
 	postBody, _ := json.Marshal(transformedDeviceConfigHistory)
 	responseBody := bytes.NewBuffer(postBody)
 
@@ -491,7 +551,6 @@ func updateConfigHistory(service *cbiotcore.Service, deviceConfigs map[string]in
 		return errors.New(jsonStr)
 	}
 
-	checkpoint.SetPhase(PhaseGatewayBinding)
 	return nil
 }
 
@@ -517,7 +576,7 @@ func deleteAllFromCbRegistry(service *cbiotcore.Service) {
 			//Unbind devices from all gateways
 			unbindFromGatewayIfAlreadyExistsInCBRegistry(device.Id, parent, cbDeviceService, registryService)
 			//Delete all gateways
-			if _, err := cbDeviceService.Delete(getCBDevicePath(device.Id)).Do(); err != nil {
+			if _, err := cbDeviceService.Delete(destinationEndpoint.DevicePath(device.Id)).Do(); err != nil {
 				log.Fatalln("Unable to delete device from CB Registry: Reason: ", err.Error())
 			}
 			progress.Add(1)
@@ -542,7 +601,7 @@ func deleteAllFromCbRegistry(service *cbiotcore.Service) {
 		defer progress.Finish()
 		for _, device := range allDevices {
 			wp.AddTask(func() {
-				if _, err := cbDeviceService.Delete(getCBDevicePath(device.Id)).Do(); err != nil {
+				if _, err := cbDeviceService.Delete(destinationEndpoint.DevicePath(device.Id)).Do(); err != nil {
 					log.Fatalf("Unable to delete device from destination registry: %s\n", err)
 				}
 				progress.Add(1)
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	shardPlanFile   = "plan.json"
+	shardResultFile = "complete.json"
+	planLease       = "plan"
+)
+
+// ShardPlan is written once to the shared store by the worker that fetches
+// the source devices. Each shard's devices are kept in the shard's checkpoint.
+type ShardPlan struct {
+	Fingerprint string    `json:"fingerprint"`
+	Shards      int       `json:"shards"`
+	Devices     int       `json:"devices"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+// ShardResult is created in the shared store when a shard is migrated.
+type ShardResult struct {
+	Shard         string    `json:"shard"`
+	Worker        string    `json:"worker"`
+	Devices       int       `json:"devices"`
+	Migrated      int       `json:"migrated"`
+	FailedDevices int       `json:"failed_devices"`
+	CompletedAt   time.Time `json:"completed_at"`
+}
+
+func isDistributedMode() bool {
+	return Args.sharedDir != ""
+}
+
+func validateDistributedFlags() {
+	if !isDistributedMode() {
+		return
+	}
+	if Args.shardCount < 1 {
+		log.Fatalln("-shardCount must be at least 1")
+	}
+	if Args.leaseDuration < 10*time.Second {
+		log.Fatalln("-leaseDuration must be at least 10s")
+	}
+	if isMergeMode() || isSplitMode() || archiveMode != "" {
+		log.Fatalln("-sharedDir cannot be used with -mergeSourcesCsv, -splitDestinationsCsv or archives")
+	}
+	if Args.exportBatchSize != 0 || Args.exportConfigHistory {
+		log.Fatalln("-sharedDir cannot be used with -exportBatchSize or -exportConfigHistory")
+	}
+	if Args.cleanupCbRegistry {
+		log.Fatalln("-sharedDir cannot be used with -cleanupCbRegistry, since every worker would clean up the destination")
+	}
+	if Args.workerId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "worker"
+		}
+		Args.workerId = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+}
+
+func shardName(shard int) string {
+	return fmt.Sprintf("shard_%d", shard)
+}
+
+func shardStore(shared CheckpointStore, shard int) CheckpointStore {
+	return SubCheckpointStore(shared, "shards/"+shardName(shard))
+}
+
+// runDistributedMigration migrates the source registry together with other
+// workers that share -sharedDir. One worker fetches the devices and splits
+// them into shards. Then every worker claims shards through leases and
+// migrates them until all shards are complete. Shards of workers that stop
+// renewing their lease are taken over and resume from the shard checkpoint.
+func runDistributedMigration(sourceService *cbiotcore.Service) {
+	shared, err := openCheckpointStore(Args.sharedDir)
+	if err != nil {
+		log.Fatalf("Invalid -sharedDir: %s\n", err)
+	}
+	leases := NewLeaseManager(shared, Args.workerId, Args.leaseDuration)
+	printfColored(colorCyan, "================= Distributed migration as worker %s =================", Args.workerId)
+
+	plan := loadShardPlan(shared, leases, sourceService)
+	printfColored(colorGreen, "\u2713 Migrating %d devices in %d shards", plan.Devices, plan.Shards)
+
+	rootCheckpoint := GetCheckpoint()
+	rootWorkDir := Args.workDir
+	rootErrorLogger := errorLogger
+	defer func() {
+		Args.workDir = rootWorkDir
+		globalCheckpoint = rootCheckpoint
+		errorLogger = rootErrorLogger
+	}()
+
+	poll := Args.leaseDuration / 4
+	for {
+		remaining, claimed := 0, 0
+		for shard := 0; shard < plan.Shards; shard++ {
+			if _, err := readShardResult(shared, shard); err == nil {
+				continue
+			} else if !errors.Is(err, os.ErrNotExist) {
+				log.Fatalf("Unable to read result of %s: %s\n", shardName(shard), err)
+			}
+			remaining++
+
+			lease, err := leases.Acquire(shardName(shard))
+			if err != nil {
+				log.Fatalf("Unable to claim %s: %s\n", shardName(shard), err)
+			}
+			if lease == nil {
+				continue
+			}
+			claimed++
+			Args.workDir = filepath.Join(rootWorkDir, "shards", shardName(shard))
+			migrateShard(shared, leases, lease, shard, sourceService)
+		}
+		if remaining == 0 {
+			break
+		}
+		if claimed == 0 {
+			printfColored(colorCyan, "Waiting for %d shards leased by other workers", remaining)
+			time.Sleep(poll)
+		}
+	}
+
+	Args.workDir = rootWorkDir
+	summary := make([]*ShardResult, 0, plan.Shards)
+	for shard := 0; shard < plan.Shards; shard++ {
+		result, err := readShardResult(shared, shard)
+		if err != nil {
+			log.Fatalf("Unable to read result of %s: %s\n", shardName(shard), err)
+		}
+		summary = append(summary, result)
+	}
+	reportFile := filepath.Join(rootWorkDir, "shard_summary.csv")
+	if err := writeShardSummary(reportFile, summary); err != nil {
+		log.Printf("Unable to write shard summary: %s\n", err)
+	} else {
+		printfColored(colorGreen, "\u2713 Shard summary written to %s", reportFile)
+	}
+	devices, migrated := 0, 0
+	for _, result := range summary {
+		devices += result.Devices
+		migrated += result.Migrated
+		color := colorGreen
+		if result.Migrated != result.Devices || result.FailedDevices > 0 {
+			color = colorRed
+		}
+		printfColored(color, " %s: migrated %d/%d devices by worker %s", result.Shard, result.Migrated, result.Devices, result.Worker)
+	}
+	if migrated == devices {
+		printfColored(colorGreen, "\u2713 All shards complete. Migrated %d/%d devices", migrated, devices)
+	} else {
+		printfColored(colorRed, "\u2715 All shards complete. Migrated %d/%d devices", migrated, devices)
+	}
+
+	if err := rootCheckpoint.Complete(); err != nil {
+		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
+	}
+}
+
+// loadShardPlan returns the plan in the shared store, waiting for another
+// worker to write it or writing it itself if it holds the plan lease.
+func loadShardPlan(shared CheckpointStore, leases *LeaseManager, sourceService *cbiotcore.Service) *ShardPlan {
+	fingerprint := computeFingerprint()
+	waiting := false
+	for {
+		plan, err := readShardPlan(shared)
+		if err == nil {
+			if plan.Fingerprint != fingerprint {
+				log.Fatalf("Shared state in %s was created with a different device selection (registry, CSV or filters). Use the original flags or a different -sharedDir\n", Args.sharedDir)
+			}
+			return plan
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Unable to read shard plan: %s\n", err)
+		}
+
+		lease, err := leases.Acquire(planLease)
+		if err != nil {
+			log.Fatalf("Unable to claim the shard plan: %s\n", err)
+		}
+		if lease == nil {
+			if !waiting {
+				printfColored(colorCyan, "Waiting for another worker to fetch devices and plan shards")
+				waiting = true
+			}
+			time.Sleep(Args.leaseDuration / 4)
+			continue
+		}
+
+		// Another worker may have written the plan before releasing the lease.
+		if _, err := readShardPlan(shared); err == nil {
+			if err := leases.Release(lease); err != nil {
+				printfColored(colorYellow, "Warning: Could not release lease %s: %s", planLease, err)
+			}
+			continue
+		}
+
+		stop := leases.Hold(lease)
+		plan = createShardPlan(shared, sourceService, fingerprint)
+		stop()
+		if err := leases.Release(lease); err != nil {
+			printfColored(colorYellow, "Warning: Could not release lease %s: %s", planLease, err)
+		}
+		return plan
+	}
+}
+
+func readShardPlan(shared CheckpointStore) (*ShardPlan, error) {
+	data, err := shared.Read(shardPlanFile)
+	if err != nil {
+		return nil, err
+	}
+	var plan ShardPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse shard plan: %w", err)
+	}
+	return &plan, nil
+}
+
+// createShardPlan fetches and validates the selected devices and writes a
+// checkpoint for each shard, with its devices already fetched. Gateways are
+// kept in the same shard as their bound devices. The plan is written last, so
+// workers only start on a complete set of shards.
+func createShardPlan(shared CheckpointStore, sourceService *cbiotcore.Service, fingerprint string) *ShardPlan {
+	devices := filterDevices(fetchDevices(sourceService))
+	devices, skipped := validateDevices(devices)
+	checkCredentialHealth(devices)
+	gatewayBindings := fetchGatewayBindings(sourceService, devices)
+	skipped, gatewayBindings = validateGatewayBindings(gatewayBindings, skipped)
+	devices, _, gatewayBindings = excludeDevices(skipped, devices, nil, gatewayBindings)
+	// Catch ID mapping problems across all shards before any writes.
+	resolveDeviceIdMapping(devices, gatewayBindings)
+	errorLogger.WriteToDir(Args.workDir)
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Id < devices[j].Id })
+	var shards [][]*cbiotcore.Device
+	if len(devices) > 0 {
+		shardSize := (int64(len(devices)) + int64(Args.shardCount) - 1) / int64(Args.shardCount)
+		shards = gatewayBatches(devices, gatewayBindings, shardSize)
+	}
+
+	bar := getProgressBar(len(shards), "Writing shard checkpoints...")
+	for i, shardDevices := range shards {
+		// A worker that lost the plan lease may have written this shard.
+		store := shardStore(shared, i)
+		if err := store.Delete(checkpointFileName); err != nil {
+			log.Fatalf("Unable to remove earlier checkpoint of %s: %s\n", shardName(i), err)
+		}
+		checkpoint := NewCheckpointStateIn(store)
+		checkpoint.SetTotalDevices(len(shardDevices))
+		for _, device := range shardDevices {
+			checkpoint.AddFetchedDevice(device)
+		}
+		checkpoint.SetPhase(PhaseDeviceMigrate)
+		if err := checkpoint.Close(); err != nil {
+			log.Fatalf("Unable to save checkpoint of %s: %s\n", shardName(i), err)
+		}
+		bar.Add(1)
+	}
+	bar.Finish()
+
+	plan := &ShardPlan{
+		Fingerprint: fingerprint,
+		Shards:      len(shards),
+		Devices:     len(devices),
+		CreatedAt:   time.Now(),
+		CreatedBy:   Args.workerId,
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal shard plan: %s\n", err)
+	}
+	if err := shared.Create(shardPlanFile, data); err != nil {
+		log.Fatalf("Unable to write shard plan: %s\n", err)
+	}
+	return plan
+}
+
+// migrateShard migrates one shard while holding its lease, resuming from the
+// shard checkpoint if another worker started it.
+func migrateShard(shared CheckpointStore, leases *LeaseManager, lease *Lease, shard int, sourceService *cbiotcore.Service) {
+	name := shardName(shard)
+	stop := leases.Hold(lease)
+	printfColored(colorCyan, "================= Shard %s (lease generation %d) =================", name, lease.Generation)
+
+	checkpoint, err := LoadCheckpointFrom(shardStore(shared, shard))
+	if err != nil {
+		log.Fatalf("Unable to load checkpoint of %s: %s\n", name, err)
+	}
+	if checkpoint == nil {
+		log.Fatalf("Checkpoint of %s is missing from %s\n", name, Args.sharedDir)
+	}
+	globalCheckpoint = checkpoint
+	errorLogger = NewErrorLogger()
+
+	devices := checkpoint.GetFetchedDevices()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Id < devices[j].Id })
+	deviceConfigs := fetchConfigHistory(sourceService, devices)
+	gatewayBindings := fetchGatewayBindings(sourceService, devices)
+	// Shard devices were validated with the plan, their bound devices are
+	// fetched again here.
+	skipped, gatewayBindings := validateGatewayBindings(gatewayBindings, nil)
+	devices, deviceConfigs, gatewayBindings = excludeDevices(skipped, devices, deviceConfigs, gatewayBindings)
+	resolveDeviceIdMapping(devices, gatewayBindings)
+	migrated := migrateToDestination(devices, deviceConfigs, gatewayBindings)
+	errorLogger.WriteToDir(Args.workDir)
+
+	result := &ShardResult{
+		Shard:         name,
+		Worker:        Args.workerId,
+		Devices:       len(devices),
+		Migrated:      migrated,
+		FailedDevices: len(errorLogger.DeviceIds()),
+		CompletedAt:   time.Now(),
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal result of %s: %s\n", name, err)
+	}
+	if err := shardStore(shared, shard).Create(shardResultFile, data); err != nil && !errors.Is(err, ErrObjectExists) {
+		log.Fatalf("Unable to write result of %s: %s\n", name, err)
+	}
+	if err := checkpoint.Complete(); err != nil {
+		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup for %s: %s", name, err)
+	}
+	if err := checkpoint.Close(); err != nil {
+		printfColored(colorYellow, "Warning: Could not close checkpoint of %s: %s", name, err)
+	}
+
+	stop()
+	if err := leases.Release(lease); err != nil {
+		printfColored(colorYellow, "Warning: Could not release lease %s: %s", name, err)
+	}
+}
+
+func readShardResult(shared CheckpointStore, shard int) (*ShardResult, error) {
+	data, err := shardStore(shared, shard).Read(shardResultFile)
+	if err != nil {
+		return nil, err
+	}
+	var result ShardResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse shard result: %w", err)
+	}
+	return &result, nil
+}
+
+func writeShardSummary(path string, summary []*ShardResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"shard", "worker", "devices", "migrated", "failedDevices", "completedAt"}); err != nil {
+		return err
+	}
+	for _, r := range summary {
+		if err := w.Write([]string{r.Shard, r.Worker, strconv.Itoa(r.Devices), strconv.Itoa(r.Migrated), strconv.Itoa(r.FailedDevices), r.CompletedAt.Format(time.RFC3339)}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,947 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// This file implements a small expression language used by migration rules.
+// Expressions are side-effect free and can only read the device they are
+// evaluated against, which makes them safe to load from a config file.
+//
+//	metadata.fleet in ['A', 'B'] and all(credentials, it.expirationTime == "" or it.expirationTime >= time("2027-01-01T00:00:00Z"))
+//
+// Supported syntax:
+//
+//	literals      "str", 'str', 12, 1.5, true, false, null, [a, b]
+//	fields        id, metadata.key, metadata["key-with-dashes"], config.version, credentials
+//	comparison    == != < <= > >=
+//	membership    x in list, key in map, sub in string, not in
+//	strings       matches (regexp), contains, startsWith, endsWith
+//	boolean       and or not (also && || !)
+//	functions     len(x) lower(s) upper(s) has(map, key) time(s) now()
+//	quantifiers   any(list, expr) all(list, expr), with the element bound to "it"
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(src) {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += size
+		case c == '"' || c == '\'':
+			start := i
+			quote := src[i]
+			i++
+			var sb strings.Builder
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					switch src[i+1] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i+1])
+					}
+					i += 2
+					continue
+				}
+				if src[i] == quote {
+					i++
+					break
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, exprToken{tokString, sb.String(), start})
+		case isASCIIDigit(c) || (c == '-' && i+1 < len(src) && isASCIIDigit(rune(src[i+1]))):
+			start := i
+			i++
+			for i < len(src) && (isASCIIDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{tokNumber, src[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) {
+				r, n := utf8.DecodeRuneInString(src[i:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				i += n
+			}
+			tokens = append(tokens, exprToken{tokIdent, src[start:i], start})
+		default:
+			start := i
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			i += len(op)
+			tokens = append(tokens, exprToken{tokOp, op, start})
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "", len(src)}), nil
+}
+
+// isASCIIDigit reports whether c is 0-9. Other Unicode digits are not valid
+// in number literals, since strconv cannot parse them.
+func isASCIIDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+// Expr is a compiled expression.
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+func CompileExpr(src string) (*Expr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+	return &Expr{source: src, root: root}, nil
+}
+
+// Eval evaluates the expression against a device.
+func (e *Expr) Eval(device *cbiotcore.Device) (interface{}, error) {
+	return e.root.eval(&exprEnv{vars: deviceExprFields(device)})
+}
+
+// EvalBool evaluates the expression and requires a boolean result.
+func (e *Expr) EvalBool(device *cbiotcore.Device) (bool, error) {
+	v, err := e.Eval(device)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q evaluated to %s, expected a boolean", e.source, exprTypeName(v))
+	}
+	return b, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) peekAt(offset int) exprToken {
+	if p.pos+offset >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isKeyword(t exprToken, words ...string) bool {
+	if t.kind != tokIdent {
+		return false
+	}
+	for _, w := range words {
+		if t.text == w {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) isOp(t exprToken, ops ...string) bool {
+	if t.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expectOp(op string) error {
+	t := p.next()
+	if !p.isOp(t, op) {
+		return fmt.Errorf("expected %q at position %d, found %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(p.peek(), "or") || p.isOp(p.peek(), "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(p.peek(), "and") || p.isOp(p.peek(), "&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isKeyword(p.peek(), "not") || p.isOp(p.peek(), "!") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonKeywords = []string{"in", "matches", "contains", "startsWith", "endsWith"}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	var op string
+	switch {
+	case p.isOp(t, "==", "!=", "<", "<=", ">", ">="):
+		op = t.text
+		p.next()
+	case p.isKeyword(t, comparisonKeywords...):
+		op = t.text
+		p.next()
+	case p.isKeyword(t, "not") && p.isKeyword(p.peekAt(1), "in"):
+		op = "not in"
+		p.next()
+		p.next()
+	default:
+		return left, nil
+	}
+
+	right, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	node := &compareNode{op: op, left: left, right: right}
+	if op == "matches" {
+		// Compile constant patterns up front so errors surface at load time.
+		if lit, ok := right.(*literalNode); ok {
+			pattern, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("matches requires a string pattern")
+			}
+			if _, err := compileExprRegexp(pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp(p.peek(), "."):
+			p.next()
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expected field name at position %d", t.pos)
+			}
+			x = &indexNode{target: x, index: &literalNode{value: t.text}}
+		case p.isOp(p.peek(), "["):
+			p.next()
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			x = &indexNode{target: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literalNode{value: t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return &literalNode{value: f}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "nil":
+			return &literalNode{value: nil}, nil
+		}
+		if p.isOp(p.peek(), "(") {
+			return p.parseCall(t)
+		}
+		return &identNode{name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expectOp(")")
+		case "[":
+			list := &listNode{}
+			for !p.isOp(p.peek(), "]") {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if !p.isOp(p.peek(), ",") {
+					break
+				}
+				p.next()
+			}
+			return list, p.expectOp("]")
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	p.next() // (
+	var args []exprNode
+	for !p.isOp(p.peek(), ")") {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isOp(p.peek(), ",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+
+	switch name.text {
+	case "any", "all":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s expects 2 arguments at position %d", name.text, name.pos)
+		}
+		return &quantifierNode{all: name.text == "all", list: args[0], predicate: args[1]}, nil
+	}
+
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	if fn.arity >= 0 && len(args) != fn.arity {
+		return nil, fmt.Errorf("%s expects %d argument(s) at position %d", name.text, fn.arity, name.pos)
+	}
+	return &callNode{name: name.text, fn: fn.call, args: args}, nil
+}
+
+type exprEnv struct {
+	vars   map[string]interface{}
+	parent *exprEnv
+}
+
+func (env *exprEnv) lookup(name string) (interface{}, bool) {
+	for e := env; e != nil; e = e.parent {
+		if v, ok := e.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type literalNode struct{ value interface{} }
+
+func (n *literalNode) eval(*exprEnv) (interface{}, error) { return n.value, nil }
+
+type identNode struct{ name string }
+
+func (n *identNode) eval(env *exprEnv) (interface{}, error) {
+	v, ok := env.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", n.name)
+	}
+	return v, nil
+}
+
+type indexNode struct{ target, index exprNode }
+
+// eval returns null for missing map keys and out of range list indexes so
+// that rules can test optional metadata without erroring.
+func (n *indexNode) eval(env *exprEnv) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map index must be a string, got %s", exprTypeName(index))
+		}
+		return t[key], nil
+	case []interface{}:
+		f, ok := index.(float64)
+		if !ok {
+			return nil, fmt.Errorf("list index must be a number, got %s", exprTypeName(index))
+		}
+		i := int(f)
+		if i < 0 || i >= len(t) {
+			return nil, nil
+		}
+		return t[i], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", exprTypeName(target))
+}
+
+type listNode struct{ items []exprNode }
+
+func (n *listNode) eval(env *exprEnv) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type notNode struct{ x exprNode }
+
+func (n *notNode) eval(env *exprEnv) (interface{}, error) {
+	v, err := evalBool(n.x, env, "not")
+	if err != nil {
+		return nil, err
+	}
+	return !v, nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n *logicalNode) eval(env *exprEnv) (interface{}, error) {
+	op := "and"
+	if n.or {
+		op = "or"
+	}
+	left, err := evalBool(n.left, env, op)
+	if err != nil {
+		return nil, err
+	}
+	if left == n.or {
+		return left, nil
+	}
+	return evalBool(n.right, env, op)
+}
+
+func evalBool(node exprNode, env *exprEnv, op string) (bool, error) {
+	v, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s requires boolean operands, got %s", op, exprTypeName(v))
+	}
+	return b, nil
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *compareNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		cmp, ok := exprCompare(left, right)
+		if !ok {
+			// Ordering against null or mismatched types never matches.
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "in", "not in":
+		found, err := exprContains(right, left)
+		if err != nil {
+			return nil, err
+		}
+		return found == (n.op == "in"), nil
+	}
+
+	// The remaining operators work on strings; null never matches.
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if left == nil || right == nil {
+		return false, nil
+	}
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s requires string operands, got %s and %s", n.op, exprTypeName(left), exprTypeName(right))
+	}
+	switch n.op {
+	case "matches":
+		re, err := compileExprRegexp(rs)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(ls), nil
+	case "contains":
+		return strings.Contains(ls, rs), nil
+	case "startsWith":
+		return strings.HasPrefix(ls, rs), nil
+	case "endsWith":
+		return strings.HasSuffix(ls, rs), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type callNode struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []exprNode
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return v, nil
+}
+
+type quantifierNode struct {
+	all             bool
+	list, predicate exprNode
+}
+
+func (n *quantifierNode) eval(env *exprEnv) (interface{}, error) {
+	v, err := n.list.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	switch t := v.(type) {
+	case nil:
+	case []interface{}:
+		items = t
+	default:
+		return nil, fmt.Errorf("any/all require a list, got %s", exprTypeName(v))
+	}
+
+	for _, item := range items {
+		match, err := evalBool(n.predicate, &exprEnv{vars: map[string]interface{}{"it": item}, parent: env}, "any/all")
+		if err != nil {
+			return nil, err
+		}
+		if match != n.all {
+			return match, nil
+		}
+	}
+	return n.all, nil
+}
+
+type exprFunction struct {
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+var exprFunctions = map[string]exprFunction{
+	"len": {1, func(args []interface{}) (interface{}, error) {
+		switch t := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(len(t)), nil
+		case []interface{}:
+			return float64(len(t)), nil
+		case map[string]interface{}:
+			return float64(len(t)), nil
+		}
+		return nil, fmt.Errorf("unsupported type %s", exprTypeName(args[0]))
+	}},
+	"lower": {1, func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %s", exprTypeName(args[0]))
+		}
+		return strings.ToLower(s), nil
+	}},
+	"upper": {1, func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %s", exprTypeName(args[0]))
+		}
+		return strings.ToUpper(s), nil
+	}},
+	"has": {2, func(args []interface{}) (interface{}, error) {
+		m, ok := args[0].(map[string]interface{})
+		if !ok {
+			return false, nil
+		}
+		key, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("key must be a string, got %s", exprTypeName(args[1]))
+		}
+		_, found := m[key]
+		return found, nil
+	}},
+	"time": {1, func(args []interface{}) (interface{}, error) {
+		switch t := args[0].(type) {
+		case nil:
+			return nil, nil
+		case time.Time:
+			return t, nil
+		case string:
+			if t == "" {
+				return nil, nil
+			}
+			return time.Parse(time.RFC3339Nano, t)
+		}
+		return nil, fmt.Errorf("expected RFC3339 string, got %s", exprTypeName(args[0]))
+	}},
+	"now": {0, func([]interface{}) (interface{}, error) {
+		return time.Now(), nil
+	}},
+}
+
+var (
+	exprRegexpCache     = make(map[string]*regexp.Regexp)
+	exprRegexpCacheLock sync.Mutex
+)
+
+func compileExprRegexp(pattern string) (*regexp.Regexp, error) {
+	exprRegexpCacheLock.Lock()
+	defer exprRegexpCacheLock.Unlock()
+	if re, ok := exprRegexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	exprRegexpCache[pattern] = re
+	return re, nil
+}
+
+func exprTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case time.Time:
+		return "time"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// exprTime converts strings to times when compared against a time value, so
+// that device timestamps can be compared with time("...") directly.
+func exprTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		return parsed, err == nil
+	}
+	return time.Time{}, false
+}
+
+func exprCompare(a, b interface{}) (int, bool) {
+	_, aTime := a.(time.Time)
+	_, bTime := b.(time.Time)
+	if aTime || bTime {
+		at, aok := exprTime(a)
+		bt, bok := exprTime(b)
+		if !aok || !bok {
+			return 0, false
+		}
+		return at.Compare(bt), true
+	}
+
+	switch at := a.(type) {
+	case float64:
+		if bt, ok := b.(float64); ok {
+			switch {
+			case at < bt:
+				return -1, true
+			case at > bt:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if bt, ok := b.(string); ok {
+			return strings.Compare(at, bt), true
+		}
+	}
+	return 0, false
+}
+
+func exprEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if cmp, ok := exprCompare(a, b); ok {
+		return cmp == 0
+	}
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		return ok && ab == bb
+	}
+	return false
+}
+
+func exprContains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case nil:
+		return false, nil
+	case []interface{}:
+		for _, v := range c {
+			if exprEqual(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c[key]
+		return found, nil
+	case string:
+		s, ok := item.(string)
+		return ok && strings.Contains(c, s), nil
+	}
+	return false, fmt.Errorf("in requires a list, map or string, got %s", exprTypeName(container))
+}
+
+// deviceExprFields exposes a device to expressions. Timestamps are kept as
+// RFC3339 strings; credential expiration times of the Unix epoch, which IoT
+// Core uses for "never expires", are normalized to an empty string.
+func deviceExprFields(device *cbiotcore.Device) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(device.Metadata))
+	for k, v := range device.Metadata {
+		metadata[k] = v
+	}
+
+	credentials := make([]interface{}, 0, len(device.Credentials))
+	for _, cred := range device.Credentials {
+		c := map[string]interface{}{"expirationTime": ""}
+		if expiry, err := time.Parse(time.RFC3339Nano, cred.ExpirationTime); err == nil && expiry.Unix() > 0 {
+			c["expirationTime"] = cred.ExpirationTime
+		}
+		if cred.PublicKey != nil {
+			c["format"] = cred.PublicKey.Format
+		}
+		credentials = append(credentials, c)
+	}
+
+	var config interface{}
+	if device.Config != nil {
+		config = map[string]interface{}{
+			"version":         float64(device.Config.Version),
+			"cloudUpdateTime": device.Config.CloudUpdateTime,
+			"deviceAckTime":   device.Config.DeviceAckTime,
+		}
+	}
+
+	return map[string]interface{}{
+		"id":                 device.Id,
+		"name":               device.Name,
+		"numId":              float64(device.NumId),
+		"blocked":            device.Blocked,
+		"logLevel":           device.LogLevel,
+		"gatewayType":        deviceGatewayType(device),
+		"metadata":           metadata,
+		"credentials":        credentials,
+		"config":             config,
+		"lastEventTime":      device.LastEventTime,
+		"lastHeartbeatTime":  device.LastHeartbeatTime,
+		"lastStateTime":      device.LastStateTime,
+		"lastConfigAckTime":  device.LastConfigAckTime,
+		"lastConfigSendTime": device.LastConfigSendTime,
+		"lastErrorTime":      device.LastErrorTime,
+	}
+}
+
+// exprValueString renders an expression result for use as a metadata value.
+func exprValueString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339)
+	case []interface{}:
+		parts := make([]string, 0, len(t))
+		for _, item := range t {
+			parts = append(parts, exprValueString(item))
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	return fmt.Sprint(v)
+}
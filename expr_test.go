@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func exprTestDevice() *cbiotcore.Device {
+	return &cbiotcore.Device{
+		Id:       "sensor-01",
+		NumId:    42,
+		LogLevel: "INFO",
+		Metadata: map[string]string{
+			"fleet":     "a",
+			"city":      "München",
+			"with-dash": "yes",
+		},
+		Credentials: []*cbiotcore.DeviceCredential{
+			{ExpirationTime: "1970-01-01T00:00:00Z", PublicKey: &cbiotcore.PublicKeyCredential{Format: "RSA_PEM"}},
+			{ExpirationTime: "2030-01-01T00:00:00Z", PublicKey: &cbiotcore.PublicKeyCredential{Format: "ES256_PEM"}},
+		},
+		Config:        &cbiotcore.DeviceConfig{Version: 7},
+		GatewayConfig: &cbiotcore.GatewayConfig{GatewayType: "NON_GATEWAY"},
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		// literals and fields
+		{`id`, "sensor-01"},
+		{`numId`, float64(42)},
+		{`-1.5`, -1.5},
+		{`'it\'s'`, "it's"},
+		{`"tab\there"`, "tab\there"},
+		{`null`, nil},
+		{`metadata.fleet`, "a"},
+		{`metadata["with-dash"]`, "yes"},
+		{`metadata.missing`, nil},
+		{`config.version`, float64(7)},
+		{`credentials[1].format`, "ES256_PEM"},
+		{`[1, 'a'][1]`, "a"},
+
+		// precedence: not > and > or, comparisons bind tighter than all
+		{`true or false and false`, true},
+		{`(true or false) and false`, false},
+		{`not false and false`, false},
+		{`not (false and false)`, true},
+		{`!true || true`, true},
+		{`(1 < 2) == true`, true},
+		{`false and unknownField == 1`, false},
+		{`true or unknownField == 1`, true},
+
+		// comparison
+		{`numId >= 42 && numId < 43`, true},
+		{`'b' > 'a'`, true},
+		{`time("2024-01-01T00:00:00Z") < time("2024-06-01T00:00:00Z")`, true},
+		{`metadata.missing == null`, true},
+		// ordering against null or mismatched types never matches
+		{`id < 1`, false},
+		{`metadata.missing >= ''`, false},
+
+		// membership and strings
+		{`metadata.fleet in ['a', 'b']`, true},
+		{`metadata.fleet not in ['a', 'b']`, false},
+		{`'fleet' in metadata`, true},
+		{`'sor' in id`, true},
+		{`id matches '^sensor-[0-9]+$'`, true},
+		{`id contains '-0'`, true},
+		{`id startsWith 'sens' and id endsWith '01'`, true},
+		{`metadata.city == 'München'`, true},
+
+		// functions
+		{`len(id)`, float64(9)},
+		{`len(metadata)`, float64(3)},
+		{`len(null)`, float64(0)},
+		{`upper(metadata.fleet)`, "A"},
+		{`lower('ABC')`, "abc"},
+		{`has(metadata, 'fleet')`, true},
+		{`has(config, 'missing')`, false},
+		{`time('')`, nil},
+
+		// quantifiers; the epoch expiration time is normalized to ""
+		{`any(credentials, it.format == 'ES256_PEM')`, true},
+		{`all(credentials, it.expirationTime == '' or it.expirationTime >= '2027-01-01')`, true},
+		{`all(credentials, it.expirationTime != '')`, false},
+		{`any([], true)`, false},
+	}
+
+	device := exprTestDevice()
+	for _, tt := range tests {
+		expr, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Errorf("CompileExpr(%s): %v", tt.expr, err)
+			continue
+		}
+		got, err := expr.Eval(device)
+		if err != nil {
+			t.Errorf("Eval(%s): %v", tt.expr, err)
+			continue
+		}
+		if !exprEqual(got, tt.want) {
+			t.Errorf("Eval(%s) = %#v, want %#v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, "unexpected end of expression"},
+		{`id ==`, "unexpected end of expression"},
+		{`(id == 'a'`, `expected ")"`},
+		{`'open`, "unterminated string at position 0"},
+		{`id @ 'a'`, `unexpected character '@' at position 3`},
+		{`id == 'a' 'b'`, `unexpected "b" at position 10`},
+		{`1 < 2 == true`, `unexpected "==" at position 6`},
+		{`1.2.3`, `invalid number "1.2.3"`},
+		{`metadata.`, "expected field name"},
+		{`[1, 2`, `expected "]"`},
+		{`unknown(id)`, `unknown function "unknown"`},
+		{`len(id, id)`, "len expects 1 argument(s)"},
+		{`any(credentials)`, "any expects 2 arguments"},
+		{`id matches '('`, "invalid pattern"},
+		{`id matches 1`, "matches requires a string pattern"},
+		// a multi-byte character must be reported whole, not byte by byte
+		{`id == 'a' ∧ true`, `unexpected character '∧' at position 10`},
+	}
+
+	for _, tt := range tests {
+		_, err := CompileExpr(tt.expr)
+		if err == nil {
+			t.Errorf("CompileExpr(%s) succeeded, want error containing %q", tt.expr, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("CompileExpr(%s) = %q, want error containing %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{`unknownField`, `unknown field "unknownField"`},
+		{`größe == 1`, `unknown field "größe"`},
+		{`id and true`, "and requires boolean operands, got string"},
+		{`not id`, "requires boolean"},
+		{`id in 1`, "in requires a list, map or string, got number"},
+		{`numId contains 'a'`, "contains requires string operands"},
+		{`metadata[1]`, "map index must be a string"},
+		{`credentials['a']`, "list index must be a number"},
+		{`id[0]`, "cannot index string"},
+		{`upper(numId)`, "upper: expected string, got number"},
+		{`time('yesterday')`, "time:"},
+		{`any(id, true)`, "any/all require a list, got string"},
+	}
+
+	device := exprTestDevice()
+	for _, tt := range tests {
+		expr, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Errorf("CompileExpr(%s): %v", tt.expr, err)
+			continue
+		}
+		_, err = expr.Eval(device)
+		if err == nil {
+			t.Errorf("Eval(%s) succeeded, want error containing %q", tt.expr, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Eval(%s) = %q, want error containing %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestExprEvalBool(t *testing.T) {
+	expr, err := CompileExpr(`metadata.fleet`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.EvalBool(exprTestDevice()); err == nil || !strings.Contains(err.Error(), "expected a boolean") {
+		t.Errorf("EvalBool of a string = %v, want an error", err)
+	}
+}
+
+func TestExprValueString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, ""},
+		{"a", "a"},
+		{float64(3), "3"},
+		{1.25, "1.25"},
+		{true, "true"},
+		{[]interface{}{"a", float64(1)}, "a,1"},
+	}
+	for _, tt := range tests {
+		if got := exprValueString(tt.value); got != tt.want {
+			t.Errorf("exprValueString(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// stringListFlag is a flag.Value that collects every occurrence of a
+// repeatable flag.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+type metadataPredicate struct {
+	Key string
+	// Value is nil for key-exists predicates.
+	Value *string
+}
+
+type timeWindow struct {
+	After  time.Time
+	Before time.Time
+}
+
+func (w timeWindow) isSet() bool {
+	return !w.After.IsZero() || !w.Before.IsZero()
+}
+
+// matches reports whether timestamp falls inside the window. Devices that
+// never reported a timestamp never match a window that is set.
+func (w timeWindow) matches(timestamp string) bool {
+	if !w.isSet() {
+		return true
+	}
+	if timestamp == "" {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return false
+	}
+	if !w.After.IsZero() && t.Before(w.After) {
+		return false
+	}
+	if !w.Before.IsZero() && !t.Before(w.Before) {
+		return false
+	}
+	return true
+}
+
+// DeviceFilter selects devices from the fetched list. All configured
+// predicates must match for a device to be selected.
+type DeviceFilter struct {
+	idRegex       *regexp.Regexp
+	idGlob        string
+	metadata      []metadataPredicate
+	gatewayType   string
+	blocked       *bool
+	lastEvent     timeWindow
+	lastHeartbeat timeWindow
+}
+
+func NewDeviceFilterFromArgs() (*DeviceFilter, error) {
+	f := &DeviceFilter{idGlob: Args.filterIdGlob}
+
+	if Args.filterIdRegex != "" {
+		re, err := regexp.Compile(Args.filterIdRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -filterIdRegex: %w", err)
+		}
+		f.idRegex = re
+	}
+	if f.idGlob != "" {
+		if _, err := path.Match(f.idGlob, ""); err != nil {
+			return nil, fmt.Errorf("invalid -filterIdGlob: %w", err)
+		}
+	}
+
+	for _, m := range Args.filterMetadata {
+		key, value, hasValue := strings.Cut(m, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid -filterMetadata %q: expected key or key=value", m)
+		}
+		predicate := metadataPredicate{Key: key}
+		if hasValue {
+			predicate.Value = &value
+		}
+		f.metadata = append(f.metadata, predicate)
+	}
+
+	switch strings.ToUpper(Args.filterGatewayType) {
+	case "":
+	case "GATEWAY", "NON_GATEWAY":
+		f.gatewayType = strings.ToUpper(Args.filterGatewayType)
+	default:
+		return nil, fmt.Errorf("invalid -filterGatewayType %q: expected GATEWAY or NON_GATEWAY", Args.filterGatewayType)
+	}
+
+	switch strings.ToLower(Args.filterBlocked) {
+	case "":
+	case "true":
+		blocked := true
+		f.blocked = &blocked
+	case "false":
+		blocked := false
+		f.blocked = &blocked
+	default:
+		return nil, fmt.Errorf("invalid -filterBlocked %q: expected true or false", Args.filterBlocked)
+	}
+
+	var err error
+	if f.lastEvent, err = parseTimeWindow("filterLastEvent", Args.filterLastEventAfter, Args.filterLastEventBefore); err != nil {
+		return nil, err
+	}
+	if f.lastHeartbeat, err = parseTimeWindow("filterLastHeartbeat", Args.filterLastHeartbeatAfter, Args.filterLastHeartbeatBefore); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func parseTimeWindow(flagPrefix, after, before string) (timeWindow, error) {
+	var w timeWindow
+	var err error
+	if after != "" {
+		if w.After, err = time.Parse(time.RFC3339, after); err != nil {
+			return w, fmt.Errorf("invalid -%sAfter: %w", flagPrefix, err)
+		}
+	}
+	if before != "" {
+		if w.Before, err = time.Parse(time.RFC3339, before); err != nil {
+			return w, fmt.Errorf("invalid -%sBefore: %w", flagPrefix, err)
+		}
+	}
+	return w, nil
+}
+
+func (f *DeviceFilter) IsEmpty() bool {
+	return f.idRegex == nil && f.idGlob == "" && len(f.metadata) == 0 && f.gatewayType == "" &&
+		f.blocked == nil && !f.lastEvent.isSet() && !f.lastHeartbeat.isSet()
+}
+
+func (f *DeviceFilter) Matches(device *cbiotcore.Device) bool {
+	if f.idRegex != nil && !f.idRegex.MatchString(device.Id) {
+		return false
+	}
+	if f.idGlob != "" {
+		if ok, _ := path.Match(f.idGlob, device.Id); !ok {
+			return false
+		}
+	}
+	for _, predicate := range f.metadata {
+		value, ok := device.Metadata[predicate.Key]
+		if !ok || (predicate.Value != nil && value != *predicate.Value) {
+			return false
+		}
+	}
+	if f.gatewayType != "" && deviceGatewayType(device) != f.gatewayType {
+		return false
+	}
+	if f.blocked != nil && device.Blocked != *f.blocked {
+		return false
+	}
+	return f.lastEvent.matches(device.LastEventTime) && f.lastHeartbeat.matches(device.LastHeartbeatTime)
+}
+
+// deviceGatewayType normalizes a device's gateway type, treating devices
+// without a gateway config as NON_GATEWAY.
+func deviceGatewayType(device *cbiotcore.Device) string {
+	if device.GatewayConfig == nil || device.GatewayConfig.GatewayType == "" {
+		return "NON_GATEWAY"
+	}
+	return device.GatewayConfig.GatewayType
+}
+
+// filterDevices applies the selection filters to the fetched devices.
+func filterDevices(devices []*cbiotcore.Device) []*cbiotcore.Device {
+	filter, err := NewDeviceFilterFromArgs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if filter.IsEmpty() && migrationRules == nil {
+		return devices
+	}
+
+	selected := make([]*cbiotcore.Device, 0, len(devices))
+	for _, device := range devices {
+		if !filter.Matches(device) {
+			continue
+		}
+		ok, err := migrationRules.Selects(device)
+		if err != nil {
+			errorLogger.AddError(rulesContext, device.Id, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// Devices whose rewrite rules fail are left out before any writes.
+		if migrationRules.Prepare(device) != nil {
+			continue
+		}
+		selected = append(selected, device)
+	}
+	printfColored(colorGreen, "\u2713 Selected %d/%d devices matching filters", len(selected), len(devices))
+	return selected
+}
+
+// selectionFingerprintFields lists the arguments that determine which devices
+// are migrated. They are recorded in the checkpoint fingerprint so a resumed
+// run cannot silently continue with a different selection.
+func selectionFingerprintFields() map[string]interface{} {
+	return map[string]interface{}{
+		"sourceRegistry":            Args.cbSourceRegistryName,
+		"sourceRegion":              Args.cbSourceRegion,
+		"devicesCsv":                Args.devicesCsvFile,
+		"filterIdRegex":             Args.filterIdRegex,
+		"filterIdGlob":              Args.filterIdGlob,
+		"filterMetadata":            []string(Args.filterMetadata),
+		"filterGatewayType":         strings.ToUpper(Args.filterGatewayType),
+		"filterBlocked":             strings.ToLower(Args.filterBlocked),
+		"filterLastEventAfter":      Args.filterLastEventAfter,
+		"filterLastEventBefore":     Args.filterLastEventBefore,
+		"filterLastHeartbeatAfter":  Args.filterLastHeartbeatAfter,
+		"filterLastHeartbeatBefore": Args.filterLastHeartbeatBefore,
+		"rulesFilter":               rulesFilterSource(),
+		"idMappingCsv":              Args.idMappingCsv,
+		"idRenameTemplate":          Args.idRenameTemplate,
+		"mergeSourcesCsv":           Args.mergeSourcesCsv,
+		"collisionPolicy":           Args.collisionPolicy,
+		"splitDestinationsCsv":      Args.splitDestinationsCsv,
+		"routeBy":                   Args.routeBy,
+		"routingCsv":                Args.routingCsv,
+		"defaultDestination":        Args.defaultDestination,
+		"importArchive":             archiveImportFile(),
+	}
+}
+
+func rulesFilterSource() string {
+	if migrationRules == nil || migrationRules.Filter == nil {
+		return ""
+	}
+	return migrationRules.Filter.String()
+}
@@ -6,6 +6,7 @@ require (
 	github.com/clearblade/go-iot v1.0.12
 	github.com/k0kubun/go-ansi v0.0.0-20180517002512-3bf9e2903213
 	github.com/schollz/progressbar/v3 v3.18.0
+	google.golang.org/api v0.107.0
 )
 
 require (
@@ -21,7 +22,6 @@ require (
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/term v0.28.0 // indirect
 	golang.org/x/text v0.6.0 // indirect
-	google.golang.org/api v0.107.0 // indirect
 	google.golang.org/genproto v0.0.0-20230202175211-008b39050e57 // indirect
 	google.golang.org/grpc v1.52.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
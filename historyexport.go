@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigHistoryFile is the JSON document written for each device by
+// -exportConfigHistory. Config data is stored next to it in
+// <deviceId>/<version>.bin so that binary payloads stay byte-for-byte intact.
+type ConfigHistoryFile struct {
+	DeviceId string                 `json:"deviceId"`
+	Versions []ConfigHistoryVersion `json:"versions"`
+}
+
+type ConfigHistoryVersion struct {
+	Version         int64  `json:"version"`
+	CloudUpdateTime string `json:"cloudUpdateTime,omitempty"`
+	DeviceAckTime   string `json:"deviceAckTime,omitempty"`
+	BinaryDataFile  string `json:"binaryDataFile,omitempty"`
+	Sha256          string `json:"sha256,omitempty"`
+}
+
+func configHistoryDir() string {
+	if Args.configHistoryDir != "" {
+		return Args.configHistoryDir
+	}
+	return filepath.Join(Args.workDir, "config-history")
+}
+
+// exportConfigHistory writes the config history fetched from the source to
+// one JSON file per device in the config history directory.
+func exportConfigHistory(deviceConfigs map[string]interface{}) {
+	dir := configHistoryDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Unable to create config history directory: %s\n", err)
+	}
+
+	deviceIds := make([]string, 0, len(deviceConfigs))
+	for deviceId := range deviceConfigs {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	sort.Strings(deviceIds)
+
+	bar := getProgressBar(len(deviceIds), "Exporting config history...")
+	versions := 0
+	for _, deviceId := range deviceIds {
+		history, _ := deviceConfigs[deviceId].(map[string]interface{})
+		n, err := writeConfigHistoryFile(dir, deviceId, history)
+		if err != nil {
+			log.Fatalf("Unable to export config history of device %s: %s\n", deviceId, err)
+		}
+		versions += n
+		bar.Add(1)
+	}
+	bar.Finish()
+	writeConfigHistoryManifest(dir, deviceConfigs)
+
+	printfColored(colorGreen, " \u2713 Exported %d config versions of %d devices to %s", versions, len(deviceIds), dir)
+}
+
+func writeConfigHistoryFile(dir, deviceId string, history map[string]interface{}) (int, error) {
+	file := ConfigHistoryFile{DeviceId: deviceId, Versions: []ConfigHistoryVersion{}}
+	for key, config := range history {
+		version, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid config version %q", key)
+		}
+		configMap, _ := config.(map[string]interface{})
+		entry := ConfigHistoryVersion{Version: version}
+		entry.CloudUpdateTime, _ = configMap["cloudUpdateTime"].(string)
+		entry.DeviceAckTime, _ = configMap["deviceAckTime"].(string)
+
+		if encoded, _ := configMap["binaryData"].(string); encoded != "" {
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return 0, fmt.Errorf("config version %d: %w", version, err)
+			}
+			entry.BinaryDataFile = filepath.ToSlash(filepath.Join(deviceId, key+".bin"))
+			if err := os.MkdirAll(filepath.Join(dir, deviceId), 0755); err != nil {
+				return 0, err
+			}
+			if err := os.WriteFile(filepath.Join(dir, entry.BinaryDataFile), data, 0644); err != nil {
+				return 0, err
+			}
+			sum := sha256.Sum256(data)
+			entry.Sha256 = hex.EncodeToString(sum[:])
+		}
+		file.Versions = append(file.Versions, entry)
+	}
+	sort.Slice(file.Versions, func(i, j int) bool { return file.Versions[i].Version < file.Versions[j].Version })
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(file.Versions), os.WriteFile(filepath.Join(dir, deviceId+".json"), content, 0644)
+}
+
+// readConfigHistoryDir reads every <deviceId>.json in dir back into the
+// deviceConfigs format used by fetchConfigHistory and updateConfigHistory.
+func readConfigHistoryDir(dir string) (map[string]interface{}, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceConfigs := make(map[string]interface{})
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		file, history, err := readConfigHistoryFile(dir, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if _, ok := deviceConfigs[file.DeviceId]; ok {
+			return nil, fmt.Errorf("%s: duplicate config history for device %s", entry.Name(), file.DeviceId)
+		}
+		if len(history) > 0 {
+			deviceConfigs[file.DeviceId] = history
+		}
+	}
+	return deviceConfigs, nil
+}
+
+func readConfigHistoryFile(dir, name string) (*ConfigHistoryFile, map[string]interface{}, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	var file ConfigHistoryFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, nil, err
+	}
+	if !isValidDeviceId(file.DeviceId) {
+		return nil, nil, fmt.Errorf("invalid device ID %q", file.DeviceId)
+	}
+
+	history := make(map[string]interface{}, len(file.Versions))
+	for _, version := range file.Versions {
+		configMap := make(map[string]interface{})
+		if version.CloudUpdateTime != "" {
+			configMap["cloudUpdateTime"] = version.CloudUpdateTime
+		}
+		if version.DeviceAckTime != "" {
+			configMap["deviceAckTime"] = version.DeviceAckTime
+		}
+		if version.BinaryDataFile != "" {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(version.BinaryDataFile)))
+			if err != nil {
+				return nil, nil, err
+			}
+			if version.Sha256 != "" {
+				sum := sha256.Sum256(data)
+				if hex.EncodeToString(sum[:]) != version.Sha256 {
+					return nil, nil, fmt.Errorf("checksum mismatch for config version %d", version.Version)
+				}
+			}
+			configMap["binaryData"] = base64.StdEncoding.EncodeToString(data)
+		}
+		history[strconv.FormatInt(version.Version, 10)] = configMap
+	}
+	return &file, history, nil
+}
+
+// runConfigHistoryImport uploads config history previously written by
+// -exportConfigHistory to the destination registry. It needs no access to
+// the source registry.
+func runConfigHistoryImport() {
+	if Args.idRenameTemplate != "" {
+		log.Fatalln("-idRenameTemplate needs source device data and cannot be used to import config history. Use -idMappingCsv instead")
+	}
+	validateConfigHistoryFlags()
+	validateCBFlags(Args.cbRegistryRegion)
+	loadDeviceIdMapper()
+	loadCheckpointStore()
+
+	dir := configHistoryDir()
+	deviceConfigs, err := readConfigHistoryDir(dir)
+	if err != nil {
+		log.Fatalf("Unable to read config history from %s: %s\n", dir, err)
+	}
+	printfColored(colorGreen, "\u2713 Read config history of %d devices from %s", len(deviceConfigs), dir)
+
+	destinationEndpoint, err = NewClearBladeEndpoint(Args.cbServiceAccount, Args.cbRegistryName, Args.cbRegistryRegion)
+	if err != nil {
+		log.Fatalf("Unable to load destination service account: %s\n", err)
+	}
+	service, err := destinationEndpoint.NewService()
+	if err != nil {
+		log.Fatalf("Unable to connect to destination registry: %s\n", err)
+	}
+	if err := verifyRegistryDetails(service, Args.cbRegistryName, Args.cbRegistryRegion); err != nil {
+		log.Fatalf("Error verifying destination registry details: %s\n", err)
+	}
+
+	// The import keeps its own checkpoint so that it never resumes, or
+	// completes, a migration checkpoint in the same work directory.
+	store := workDirCheckpointStore(filepath.Join(Args.workDir, "config-history-import"))
+	if err := store.Delete(checkpointFileName); err != nil {
+		log.Fatalf("Unable to remove earlier import checkpoint: %s\n", err)
+	}
+	globalCheckpoint = NewCheckpointStateIn(store)
+	globalCheckpoint.SetPhase(PhaseConfigHistory)
+
+	if err := updateConfigHistory(service, deviceConfigs); err != nil {
+		log.Fatalf("Unable to import config history: %s\n", err)
+	}
+	if err := globalCheckpoint.Complete(); err != nil {
+		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
+	}
+	printfColored(colorGreen, "\u2713 Config history import complete")
+}
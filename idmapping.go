@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// deviceIdMapper renames devices between the source and destination
+// registries. It is nil when no mapping is configured, in which case
+// destination IDs equal source IDs.
+var deviceIdMapper *DeviceIdMapper
+
+// DeviceIdMapper resolves destination device IDs from either a mapping CSV
+// (columns sourceId,destId) or a rename template. Templates substitute
+// expressions in braces, evaluated against the source device:
+//
+//	fleet-{lower(metadata.fleet)}-{id}
+type DeviceIdMapper struct {
+	csvMapping map[string]string
+	template   []templatePart
+
+	// resolved holds the destination ID of every device seen by
+	// resolveDeviceIdMapping. It is only written before the destination
+	// phases start.
+	resolved map[string]string
+}
+
+type templatePart struct {
+	literal string
+	expr    *Expr
+}
+
+func NewDeviceIdMapperFromArgs() (*DeviceIdMapper, error) {
+	if Args.idMappingCsv == "" && Args.idRenameTemplate == "" {
+		return nil, nil
+	}
+	if Args.idMappingCsv != "" && Args.idRenameTemplate != "" {
+		return nil, errors.New("-idMappingCsv and -idRenameTemplate cannot be used together")
+	}
+
+	m := &DeviceIdMapper{resolved: make(map[string]string)}
+	if Args.idMappingCsv != "" {
+		mapping, err := readIdMappingCsv(Args.idMappingCsv)
+		if err != nil {
+			return nil, err
+		}
+		m.csvMapping = mapping
+		return m, nil
+	}
+
+	template, err := parseRenameTemplate(Args.idRenameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -idRenameTemplate: %w", err)
+	}
+	m.template = template
+	return m, nil
+}
+
+func loadDeviceIdMapper() {
+	mapper, err := NewDeviceIdMapperFromArgs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	deviceIdMapper = mapper
+}
+
+func readIdMappingCsv(path string) (map[string]string, error) {
+	rows, err := readCsvFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("ID mapping CSV %s is empty", path)
+	}
+
+	sourceIdx, destIdx := -1, -1
+	for i, name := range rows[0] {
+		switch name {
+		case "sourceId":
+			sourceIdx = i
+		case "destId":
+			destIdx = i
+		}
+	}
+	if sourceIdx == -1 || destIdx == -1 {
+		return nil, fmt.Errorf("ID mapping CSV %s must have sourceId and destId columns", path)
+	}
+
+	mapping := make(map[string]string, len(rows)-1)
+	for line, row := range rows[1:] {
+		if len(row) <= sourceIdx || len(row) <= destIdx {
+			return nil, fmt.Errorf("ID mapping CSV line %d: missing columns", line+2)
+		}
+		sourceId, destId := row[sourceIdx], row[destIdx]
+		if sourceId == "" || destId == "" {
+			return nil, fmt.Errorf("ID mapping CSV line %d: empty sourceId or destId", line+2)
+		}
+		if existing, ok := mapping[sourceId]; ok && existing != destId {
+			return nil, fmt.Errorf("ID mapping CSV line %d: %s is mapped to both %s and %s", line+2, sourceId, existing, destId)
+		}
+		mapping[sourceId] = destId
+	}
+	return mapping, nil
+}
+
+func parseRenameTemplate(template string) ([]templatePart, error) {
+	var parts []templatePart
+	for template != "" {
+		open := strings.IndexByte(template, '{')
+		if open == -1 {
+			parts = append(parts, templatePart{literal: template})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{literal: template[:open]})
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed { in %q", template)
+		}
+		expr, err := CompileExpr(template[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, templatePart{expr: expr})
+		template = template[open+end+1:]
+	}
+	return parts, nil
+}
+
+// compute returns the destination ID for a device without recording it.
+func (m *DeviceIdMapper) compute(device *cbiotcore.Device) (string, error) {
+	if m.csvMapping != nil {
+		destId, ok := m.csvMapping[device.Id]
+		if !ok {
+			return "", errors.New("no mapping in ID mapping CSV")
+		}
+		return destId, nil
+	}
+
+	var sb strings.Builder
+	for _, part := range m.template {
+		if part.expr == nil {
+			sb.WriteString(part.literal)
+			continue
+		}
+		v, err := part.expr.Eval(device)
+		if err != nil {
+			return "", fmt.Errorf("template expression {%s}: %w", part.expr, err)
+		}
+		if v == nil {
+			return "", fmt.Errorf("template expression {%s} evaluated to null", part.expr)
+		}
+		sb.WriteString(exprValueString(v))
+	}
+	return sb.String(), nil
+}
+
+// destinationDeviceId returns the destination ID of a source device ID.
+func destinationDeviceId(sourceId string) string {
+	if deviceIdMapper == nil {
+		return sourceId
+	}
+	if destId, ok := deviceIdMapper.resolved[sourceId]; ok {
+		return destId
+	}
+	if destId, ok := deviceIdMapper.csvMapping[sourceId]; ok {
+		return destId
+	}
+	return sourceId
+}
+
+// resolveDeviceIdMapping computes the destination ID of every device that
+// will be written, including devices only reachable as gateway bindings, and
+// aborts before any writes if a mapping is missing, invalid or conflicting.
+func resolveDeviceIdMapping(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) {
+	if deviceIdMapper == nil {
+		return
+	}
+
+	printfColored(colorGreen, "\u2713 Resolving destination device IDs")
+
+	all := make(map[string]*cbiotcore.Device, len(devices))
+	for _, device := range devices {
+		all[device.Id] = device
+	}
+	for _, bound := range gatewayBindings {
+		for _, device := range bound {
+			if _, ok := all[device.Id]; !ok {
+				all[device.Id] = device
+			}
+		}
+	}
+
+	sourceIds := make([]string, 0, len(all))
+	for id := range all {
+		sourceIds = append(sourceIds, id)
+	}
+	sort.Strings(sourceIds)
+
+	var problems []string
+	owners := make(map[string]string, len(all))
+	for _, sourceId := range sourceIds {
+		destId, err := deviceIdMapper.compute(all[sourceId])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", sourceId, err))
+			continue
+		}
+		if !isValidDeviceId(destId) {
+			problems = append(problems, fmt.Sprintf("%s: destination ID %q is not a valid device ID", sourceId, destId))
+			continue
+		}
+		if owner, ok := owners[destId]; ok {
+			problems = append(problems, fmt.Sprintf("%s: destination ID %q is also used by %s", sourceId, destId, owner))
+			continue
+		}
+		owners[destId] = sourceId
+		deviceIdMapper.resolved[sourceId] = destId
+	}
+
+	if len(problems) > 0 {
+		const maxShown = 20
+		printfColored(colorRed, " \u2715 %d device ID mapping problems:", len(problems))
+		for i, p := range problems {
+			if i == maxShown {
+				printfColored(colorRed, "   ... and %d more", len(problems)-maxShown)
+				break
+			}
+			printfColored(colorRed, "   %s", p)
+		}
+		log.Fatalln("Aborting before any writes: fix the device ID mapping and rerun")
+	}
+
+	renamed := 0
+	for sourceId, destId := range deviceIdMapper.resolved {
+		if sourceId != destId {
+			renamed++
+		}
+	}
+	printfColored(colorGreen, " \u2713 %d of %d devices will be renamed on the destination", renamed, len(all))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errLeaseLost = errors.New("lease lost")
+
+// Lease gives one worker exclusive use of a named piece of shared work, such
+// as a shard, until it expires. Every claim writes a new generation, created
+// only if it does not exist yet, so of several workers taking over an expired
+// lease exactly one succeeds. The highest generation is the current lease.
+type Lease struct {
+	Name       string    `json:"name"`
+	Generation int       `json:"generation"`
+	Worker     string    `json:"worker"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	Expires    time.Time `json:"expires"`
+	Released   bool      `json:"released"`
+}
+
+func (l *Lease) held(now time.Time) bool {
+	return !l.Released && now.Before(l.Expires)
+}
+
+type LeaseManager struct {
+	store    CheckpointStore
+	worker   string
+	duration time.Duration
+}
+
+func NewLeaseManager(store CheckpointStore, worker string, duration time.Duration) *LeaseManager {
+	return &LeaseManager{store: store, worker: worker, duration: duration}
+}
+
+func leasePrefix(name string) string {
+	return "leases/" + name
+}
+
+func leaseObject(name string, generation int) string {
+	return fmt.Sprintf("%s/%08d.json", leasePrefix(name), generation)
+}
+
+// current returns the highest generation of the lease, or nil if it was never
+// claimed.
+func (m *LeaseManager) current(name string) (*Lease, error) {
+	objects, err := m.store.List(leasePrefix(name))
+	if err != nil {
+		return nil, err
+	}
+	for i := len(objects) - 1; i >= 0; i-- {
+		if _, err := strconv.Atoi(strings.TrimSuffix(objects[i], ".json")); err != nil {
+			continue
+		}
+		data, err := m.store.Read(leasePrefix(name) + "/" + objects[i])
+		if err != nil {
+			return nil, err
+		}
+		var lease Lease
+		if err := json.Unmarshal(data, &lease); err != nil {
+			return nil, fmt.Errorf("failed to parse lease %s: %w", objects[i], err)
+		}
+		return &lease, nil
+	}
+	return nil, nil
+}
+
+// Acquire claims the lease if it is free, released or expired. It returns
+// nil if another worker holds it or claimed it first.
+func (m *LeaseManager) Acquire(name string) (*Lease, error) {
+	now := time.Now()
+	current, err := m.current(name)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.held(now) && current.Worker != m.worker {
+		return nil, nil
+	}
+
+	lease := &Lease{
+		Name:       name,
+		Generation: 1,
+		Worker:     m.worker,
+		AcquiredAt: now,
+		Expires:    now.Add(m.duration),
+	}
+	if current != nil {
+		lease.Generation = current.Generation + 1
+	}
+	data, err := json.MarshalIndent(lease, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = m.store.Create(leaseObject(name, lease.Generation), data)
+	if errors.Is(err, ErrObjectExists) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && !current.Released && current.Worker != m.worker {
+		printfColored(colorYellow, "Taking over %s from worker %s, whose lease expired at %s", name, current.Worker, current.Expires.Format(time.RFC3339))
+	}
+	// Only the previous generation is kept, to show who held the lease before.
+	// Older ones were removed by earlier claims.
+	if lease.Generation > 2 {
+		if err := m.store.Delete(leaseObject(name, lease.Generation-2)); err != nil {
+			printfColored(colorYellow, "Warning: Could not remove old lease of %s: %s", name, err)
+		}
+	}
+	return lease, nil
+}
+
+// Renew extends the lease. It fails with errLeaseLost if another worker took
+// it over after it expired.
+func (m *LeaseManager) Renew(lease *Lease) error {
+	return m.write(lease, func(lease *Lease) {
+		lease.Expires = time.Now().Add(m.duration)
+	})
+}
+
+// Release gives up the lease so that another worker can claim it at once.
+func (m *LeaseManager) Release(lease *Lease) error {
+	return m.write(lease, func(lease *Lease) {
+		lease.Released = true
+	})
+}
+
+func (m *LeaseManager) write(lease *Lease, update func(lease *Lease)) error {
+	current, err := m.current(lease.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Generation != lease.Generation {
+		holder := "another worker"
+		if current != nil {
+			holder = "worker " + current.Worker
+		}
+		return fmt.Errorf("%w: %s is now held by %s", errLeaseLost, lease.Name, holder)
+	}
+	update(lease)
+	data, err := json.MarshalIndent(lease, "", "  ")
+	if err != nil {
+		return err
+	}
+	return m.store.Write(leaseObject(lease.Name, lease.Generation), data)
+}
+
+// Hold renews the lease in the background until the returned function is
+// called. If the lease is lost the process exits, so that two workers never
+// keep writing the same shard.
+func (m *LeaseManager) Hold(lease *Lease) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(m.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := m.Renew(lease)
+				if errors.Is(err, errLeaseLost) {
+					log.Fatalf("Stopping: %s\n", err)
+				}
+				if err != nil {
+					printfColored(colorYellow, "Warning: Could not renew lease %s: %s", lease.Name, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaseAcquire(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+	a := NewLeaseManager(store, "a", time.Minute)
+	b := NewLeaseManager(store, "b", time.Minute)
+
+	lease, err := a.Acquire("shard-0")
+	if err != nil || lease == nil || lease.Generation != 1 || lease.Worker != "a" {
+		t.Fatalf("Acquire = %+v, %v, want generation 1 for a", lease, err)
+	}
+	if other, err := b.Acquire("shard-0"); err != nil || other != nil {
+		t.Fatalf("Acquire of a held lease = %+v, %v, want nil", other, err)
+	}
+	if err := a.Renew(lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// A released lease can be claimed at once.
+	if err := a.Release(lease); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := b.Acquire("shard-0")
+	if err != nil || taken == nil || taken.Generation != 2 || taken.Worker != "b" {
+		t.Fatalf("Acquire after release = %+v, %v, want generation 2 for b", taken, err)
+	}
+	if err := a.Renew(lease); !errors.Is(err, errLeaseLost) {
+		t.Errorf("Renew of a released lease = %v, want errLeaseLost", err)
+	}
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+	// a's leases expire as soon as they are written.
+	a := NewLeaseManager(store, "a", -time.Second)
+	b := NewLeaseManager(store, "b", time.Minute)
+
+	expired, err := a.Acquire("shard-0")
+	if err != nil || expired == nil {
+		t.Fatalf("Acquire = %+v, %v", expired, err)
+	}
+	lease, err := b.Acquire("shard-0")
+	if err != nil || lease == nil || lease.Generation != 2 {
+		t.Fatalf("takeover = %+v, %v, want generation 2", lease, err)
+	}
+	if err := a.Renew(expired); !errors.Is(err, errLeaseLost) {
+		t.Errorf("Renew by the old holder = %v, want errLeaseLost", err)
+	}
+	if err := a.Release(expired); !errors.Is(err, errLeaseLost) {
+		t.Errorf("Release by the old holder = %v, want errLeaseLost", err)
+	}
+	if err := b.Renew(lease); err != nil {
+		t.Errorf("Renew by the new holder = %v", err)
+	}
+}
+
+func TestLeaseAcquireOwnLease(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+	a := NewLeaseManager(store, "a", time.Minute)
+
+	// A restarted worker reclaims its own lease without waiting for it to
+	// expire.
+	for generation := 1; generation <= 4; generation++ {
+		lease, err := a.Acquire("shard-0")
+		if err != nil || lease == nil || lease.Generation != generation {
+			t.Fatalf("Acquire = %+v, %v, want generation %d", lease, err, generation)
+		}
+	}
+
+	// Only the current and the previous generation are kept.
+	objects, err := store.List(leasePrefix("shard-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"00000003.json", "00000004.json"}; !reflect.DeepEqual(objects, want) {
+		t.Errorf("lease objects = %v, want %v", objects, want)
+	}
+}
+
+func TestLeaseAcquireRace(t *testing.T) {
+	store := NewDirCheckpointStore(t.TempDir())
+
+	var wg sync.WaitGroup
+	leases := make([]*Lease, 8)
+	for i := range leases {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lease, err := NewLeaseManager(store, string(rune('a'+i)), time.Minute).Acquire("shard-0")
+			if err != nil {
+				t.Error(err)
+			}
+			leases[i] = lease
+		}(i)
+	}
+	wg.Wait()
+
+	winners := 0
+	for _, lease := range leases {
+		if lease != nil {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d workers acquired the lease, want 1", winners)
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 
 	cbiotcore "github.com/clearblade/go-iot"
 )
@@ -39,19 +40,95 @@ type DeviceMigratorArgs struct {
 	silentMode        bool
 	cleanupCbRegistry bool
 	exportBatchSize   int64
+	exportDir         string
+	exportShardBy     string
+	exportShards      int
+	exportFormat      string
+	exportColumns     string
+	exportGzip        bool
 	workDir           string
+	failedDevicesDir  string
 	workerPoolSize    int
 	pageSize          int64
+	validationPolicy  string
+
+	certExpiryWarningDays  int
+	dropExpiredCredentials bool
+	registryCACheck        string
+
+	// Device selection filters
+	filterIdRegex             string
+	filterIdGlob              string
+	filterMetadata            stringListFlag
+	filterGatewayType         string
+	filterBlocked             string
+	filterLastEventAfter      string
+	filterLastEventBefore     string
+	filterLastHeartbeatAfter  string
+	filterLastHeartbeatBefore string
+	rulesFile                 string
+
+	// Device ID remapping
+	idMappingCsv     string
+	idRenameTemplate string
+
+	// Handling of devices that already exist in the destination
+	onConflict             string
+	metadataConflictWinner string
+	preserveConfigVersions bool
+
+	// Config history limits
+	configHistoryMaxVersions  int
+	configHistorySince        string
+	skipMatchingConfigHistory bool
+
+	// Config history export and import
+	exportConfigHistory bool
+	configHistoryDir    string
+
+	// Offline registry archive
+	archiveFile string
+
+	// Signed manifests
+	manifestKey       string
+	manifestPublicKey string
+
+	// Multi-source merge
+	mergeSourcesCsv string
+	collisionPolicy string
+
+	// Split to multiple destinations
+	splitDestinationsCsv string
+	routeBy              string
+	routingCsv           string
+	defaultDestination   string
+
+	// Checkpoint store
+	checkpointStore string
+	s3Endpoint      string
+	s3Region        string
+
+	// Distributed migration
+	sharedDir     string
+	shardCount    int
+	workerId      string
+	leaseDuration time.Duration
+
+	// Streaming migration
+	streaming bool
+
+	// Device-centric migration
+	perDeviceTransaction bool
 }
 
-func initMigrationFlags() {
+func initMigrationFlags(args []string) {
 	// Destination
-	flag.StringVar(&Args.cbServiceAccount, "cbServiceAccount", "", "Path to a ClearBlade service account file for the destination registry. See https://clearblade.atlassian.net/wiki/spaces/IC/pages/2240675843/Add+service+accounts+to+a+project (Required)")
+	flag.StringVar(&Args.cbServiceAccount, "cbServiceAccount", "", "ClearBlade service account for the destination registry: a file path, env:VAR_NAME or - for stdin. See https://clearblade.atlassian.net/wiki/spaces/IC/pages/2240675843/Add+service+accounts+to+a+project (Required)")
 	flag.StringVar(&Args.cbRegistryName, "cbRegistryName", "", "ClearBlade Destination Registry Name (Required)")
 	flag.StringVar(&Args.cbRegistryRegion, "cbRegistryRegion", "", "ClearBlade Destination Registry Region (Required)")
 
 	// Source
-	flag.StringVar(&Args.cbSourceServiceAccount, "cbSourceServiceAccount", "", "Path to a ClearBlade service account file for the source registry. See https://clearblade.atlassian.net/wiki/spaces/IC/pages/2240675843/Add+service+accounts+to+a+project (Required)")
+	flag.StringVar(&Args.cbSourceServiceAccount, "cbSourceServiceAccount", "", "ClearBlade service account for the source registry: a file path, env:VAR_NAME or - for stdin. See https://clearblade.atlassian.net/wiki/spaces/IC/pages/2240675843/Add+service+accounts+to+a+project (Required)")
 	flag.StringVar(&Args.cbSourceRegistryName, "cbSourceRegistryName", "", "ClearBlade Source Registry Name (Required)")
 	flag.StringVar(&Args.cbSourceRegion, "cbSourceRegion", "", "ClearBlade Source Registry Region (Required)")
 
@@ -62,12 +139,74 @@ func initMigrationFlags() {
 	flag.BoolVar(&Args.skipConfig, "skipConfig", false, "Skips migrating latest config. Default is false")
 	flag.BoolVar(&Args.silentMode, "silentMode", false, "Run this tool in silent (non-interactive) mode. Default is false")
 	flag.BoolVar(&Args.cleanupCbRegistry, "cleanupCbRegistry", false, "Deletes all contents from the destination CB registry prior to migration")
-	flag.Int64Var(&Args.exportBatchSize, "exportBatchSize", 0, "Exports devices to the supplied number of CSVs")
+	flag.Int64Var(&Args.exportBatchSize, "exportBatchSize", 0, "Instead of migrating devices, export them to batch files of this many devices")
+	flag.StringVar(&Args.exportDir, "exportDir", "", "Directory batch files are written to. Default is <workDir>/batches")
+	flag.StringVar(&Args.exportShardBy, "exportShardBy", ShardBySequential, "How devices are split into batches: sequential, hash or gateway. Default is sequential")
+	flag.IntVar(&Args.exportShards, "exportShards", 0, "Number of batches with -exportShardBy hash. Default is derived from -exportBatchSize")
+	flag.StringVar(&Args.exportFormat, "exportFormat", ExportFormatCsv, "Batch file format: csv or jsonl. Default is csv")
+	flag.StringVar(&Args.exportColumns, "exportColumns", "", "Comma separated CSV columns to export after deviceId: numId, blocked, gatewayType, logLevel, lastEventTime, lastHeartbeatTime, configVersion or metadata.<key>")
+	flag.BoolVar(&Args.exportGzip, "exportGzip", false, "Gzip batch files. Default is false")
 	flag.StringVar(&Args.workDir, "workDir", "./migration_data", "Directory to store migration data")
+	flag.StringVar(&Args.failedDevicesDir, "failedDevicesDir", "", "Directory the failed devices CSV is written to. Default is the current directory")
 	flag.IntVar(&Args.workerPoolSize, "workerPoolSize", 100, "Number of workers used to perform migration")
 	flag.Int64Var(&Args.pageSize, "pageSize", 1000, "Page size for API calls when fetching devices/gateways")
-
-	flag.Parse()
+	flag.IntVar(&Args.certExpiryWarningDays, "certExpiryWarningDays", 30, "Flag X.509 device certificates that expire within this many days. Default is 30")
+	flag.BoolVar(&Args.dropExpiredCredentials, "dropExpiredCredentials", false, "Do not migrate device credentials whose expirationTime has passed. Default is false")
+	flag.StringVar(&Args.registryCACheck, "registryCACheck", CACheckOff, "Verify X.509 device certificates against the destination registry's CA certificates: off, log or skip. Default is off")
+	// Device selection filters
+	flag.StringVar(&Args.filterIdRegex, "filterIdRegex", "", "Only migrate devices whose ID matches this regular expression")
+	flag.StringVar(&Args.filterIdGlob, "filterIdGlob", "", "Only migrate devices whose ID matches this glob pattern (e.g. sensor-*)")
+	flag.Var(&Args.filterMetadata, "filterMetadata", "Only migrate devices with this metadata key (key) or key/value pair (key=value). Can be repeated")
+	flag.StringVar(&Args.filterGatewayType, "filterGatewayType", "", "Only migrate devices of this gateway type: GATEWAY or NON_GATEWAY")
+	flag.StringVar(&Args.filterBlocked, "filterBlocked", "", "Only migrate devices with this blocked status: true or false")
+	flag.StringVar(&Args.filterLastEventAfter, "filterLastEventAfter", "", "Only migrate devices whose last event is at or after this RFC3339 time")
+	flag.StringVar(&Args.filterLastEventBefore, "filterLastEventBefore", "", "Only migrate devices whose last event is before this RFC3339 time")
+	flag.StringVar(&Args.filterLastHeartbeatAfter, "filterLastHeartbeatAfter", "", "Only migrate devices whose last heartbeat is at or after this RFC3339 time")
+	flag.StringVar(&Args.filterLastHeartbeatBefore, "filterLastHeartbeatBefore", "", "Only migrate devices whose last heartbeat is before this RFC3339 time")
+
+	flag.StringVar(&Args.rulesFile, "rulesFile", "", "JSON file with device selection and rewrite rules expressed in the rules expression language")
+
+	flag.StringVar(&Args.idMappingCsv, "idMappingCsv", "", "CSV file with sourceId and destId columns used to rename devices on the destination")
+	flag.StringVar(&Args.idRenameTemplate, "idRenameTemplate", "", "Template for destination device IDs, with rule expressions in braces. Example: fleet-{lower(metadata.fleet)}-{id}")
+
+	flag.StringVar(&Args.onConflict, "onConflict", ConflictOverwrite, "What to do with devices that already exist in the destination registry: overwrite, skip, merge-metadata, fail or newer-wins. Default is overwrite")
+	flag.StringVar(&Args.metadataConflictWinner, "metadataConflictWinner", MetadataWinnerSource, "Which value wins for metadata keys present on both sides with -onConflict merge-metadata: source or destination. Default is source")
+
+	flag.IntVar(&Args.configHistoryMaxVersions, "configHistoryMaxVersions", 0, "Keep at most this many of the newest config history versions per device. Default is 0 (all versions)")
+	flag.StringVar(&Args.configHistorySince, "configHistorySince", "", "Only keep config history versions updated at or after this RFC3339 time")
+	flag.BoolVar(&Args.skipMatchingConfigHistory, "skipMatchingConfigHistory", false, "Do not upload config history for devices whose destination history already matches. Default is false")
+	flag.BoolVar(&Args.exportConfigHistory, "exportConfigHistory", false, "Instead of migrating devices, export their config history to one JSON file per device. Default is false")
+	flag.StringVar(&Args.configHistoryDir, "configHistoryDir", "", "Directory config history is exported to and imported from. Default is <workDir>/config-history")
+	flag.StringVar(&Args.archiveFile, "archiveFile", "", "Archive written by export-archive and read by import-archive. Default is <workDir>/registry_archive.tar.gz")
+	flag.StringVar(&Args.manifestKey, "manifestKey", "", "PEM encoded Ed25519 private key used to sign a manifest of every export and completed migration")
+	flag.StringVar(&Args.manifestPublicKey, "manifestPublicKey", "", "PEM encoded Ed25519 public key used by manifest verify to check the manifest signature")
+	flag.BoolVar(&Args.preserveConfigVersions, "preserveConfigVersions", false, "Make the latest config version of each destination device match its source config version. Default is false")
+
+	flag.StringVar(&Args.mergeSourcesCsv, "mergeSourcesCsv", "", "CSV file listing several source registries to merge into the destination. Columns: tag, registryName, region and optionally serviceAccount")
+	flag.StringVar(&Args.collisionPolicy, "collisionPolicy", CollisionPolicyFail, "How to resolve device IDs found in more than one merge source: fail, prefix, keep-first or keep-newest. Default is fail")
+
+	flag.StringVar(&Args.splitDestinationsCsv, "splitDestinationsCsv", "", "CSV file listing destination registries to split the source into. Columns: name, registryName, region and optionally serviceAccount")
+	flag.StringVar(&Args.routeBy, "routeBy", "", "How devices are routed to split destinations: metadata:<key>, idPrefix:<separator> or csv")
+	flag.StringVar(&Args.routingCsv, "routingCsv", "", "CSV file with deviceId and destination columns, used with -routeBy csv")
+	flag.StringVar(&Args.defaultDestination, "defaultDestination", "", "Split destination for devices that match no route. By default they are not migrated")
+
+	flag.StringVar(&Args.checkpointStore, "checkpointStore", "", "Where checkpoints are saved and resumed from: a directory or an s3://bucket/prefix URL. Default is the work directory")
+	flag.StringVar(&Args.s3Endpoint, "s3Endpoint", "", "Endpoint of the S3-compatible service for s3:// locations, such as http://localhost:9000 for MinIO. Default is AWS S3 in -s3Region")
+	flag.StringVar(&Args.s3Region, "s3Region", "us-east-1", "Region used to sign requests for s3:// locations. Default is us-east-1")
+
+	flag.StringVar(&Args.sharedDir, "sharedDir", "", "Directory or s3://bucket/prefix URL shared by several workers that migrate one source registry together. Enables distributed migration")
+	flag.IntVar(&Args.shardCount, "shardCount", 16, "Number of shards the devices are split into with -sharedDir. Default is 16")
+	flag.StringVar(&Args.workerId, "workerId", "", "Name of this worker in lease files with -sharedDir. Default is <hostname>-<pid>")
+	flag.DurationVar(&Args.leaseDuration, "leaseDuration", 2*time.Minute, "How long a shard lease lasts without renewal before other workers take over the shard. Default is 2m")
+
+	flag.BoolVar(&Args.streaming, "streaming", false, "Migrate devices page by page as they are listed instead of loading the whole source registry into memory first. Default is false")
+	flag.BoolVar(&Args.perDeviceTransaction, "perDeviceTransaction", false, "Migrate each device, or each gateway with its bound devices, through all phases as one unit that is rolled back on failure. Default is false")
+
+	flag.StringVar(&Args.validationPolicy, "validationPolicy", ValidationPolicySkip, "How to handle devices that violate IoT Core limits: skip, truncate, abort or off. Default is skip")
+
+	if err := flag.CommandLine.Parse(args); err != nil {
+		log.Fatalln(err)
+	}
 }
 
 func validateSourceCBFlags() {
@@ -82,9 +221,9 @@ func validateSourceCBFlags() {
 		Args.cbSourceServiceAccount = value
 	}
 
-	// validate that path to service account file exists
-	if _, err := os.Stat(Args.cbSourceServiceAccount); errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("Could not locate service account file %s. Please make sure the path is correct", Args.cbSourceServiceAccount)
+	// validate that the service account can be read and is well formed
+	if err := validateServiceAccountFlag(Args.cbSourceServiceAccount); err != nil {
+		log.Fatalf("Invalid -cbSourceServiceAccount: %s\n", err)
 	}
 
 	if Args.cbSourceRegistryName == "" {
@@ -135,10 +274,10 @@ func validateCBFlags(registryRegion string) {
 		Args.cbServiceAccount = value
 	}
 
-	// validate that path to service account file exists
-	printfColored(colorGreen, "\u2713 Validating service account location")
-	if _, err := os.Stat(Args.cbServiceAccount); errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("Could not locate service account file %s. Please make sure the path is correct", Args.cbServiceAccount)
+	// validate that the service account can be read and is well formed
+	printfColored(colorGreen, "\u2713 Validating service account contents")
+	if err := validateServiceAccountFlag(Args.cbServiceAccount); err != nil {
+		log.Fatalf("Invalid -cbServiceAccount: %s\n", err)
 	}
 
 	printfColored(colorGreen, "\u2713 Validating registry name")
@@ -171,12 +310,12 @@ func validateCBFlags(registryRegion string) {
 	}
 }
 
-func getIoTCoreService(serviceAccountFilePath string) (*cbiotcore.Service, error) {
-	err := os.Setenv("CLEARBLADE_CONFIGURATION", serviceAccountFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to set CLEARBLADE_CONFIGURATION env variable: %w", err)
+func validateServiceAccountFlag(serviceAccount string) error {
+	if serviceAccount == "-" && !Args.silentMode {
+		return errors.New("reading a service account from stdin (-) requires -silentMode")
 	}
-	return cbiotcore.NewService(context.Background())
+	_, err := loadServiceAccountCredentials(serviceAccount)
+	return err
 }
 
 func verifyRegistryDetails(service *cbiotcore.Service, registryName, region string) error {
@@ -195,65 +334,303 @@ func main() {
 		log.Fatalln("No flags supplied. Use clearblade-iot-core-migration --help to view details.")
 	}
 
-	if os.Args[1] == "version" {
+	args := os.Args[1:]
+	switch os.Args[1] {
+	case "version":
 		fmt.Println(cbIotCoreMigrationVersion)
 		os.Exit(0)
+	case "rules":
+		if len(os.Args) < 3 || os.Args[2] != "test" {
+			log.Fatalln("Usage: clearblade-iot-core-migration rules test -rulesFile <rules.json> -device <device.json>")
+		}
+		var devicePath string
+		flag.StringVar(&devicePath, "device", "", "JSON file with a sample device or list of devices to test rules against")
+		initMigrationFlags(os.Args[3:])
+		if !runRulesTest(devicePath) {
+			os.Exit(1)
+		}
+		return
+	case "config-history":
+		if len(os.Args) < 3 || os.Args[2] != "import" {
+			log.Fatalln("Usage: clearblade-iot-core-migration config-history import -configHistoryDir <dir> -cbServiceAccount <file> -cbRegistryName <name> -cbRegistryRegion <region>")
+		}
+		initMigrationFlags(os.Args[3:])
+		runConfigHistoryImport()
+		return
+	case "preflight":
+		initMigrationFlags(os.Args[2:])
+		if !runPreflight() {
+			os.Exit(1)
+		}
+		return
+	case "manifest":
+		if len(os.Args) < 3 || os.Args[2] != "verify" {
+			log.Fatalln("Usage: clearblade-iot-core-migration manifest verify -manifest <manifest.json> -manifestPublicKey <key.pem> [-archiveFile <archive> | destination flags]")
+		}
+		var manifestPath string
+		flag.StringVar(&manifestPath, "manifest", "", "Signed manifest to verify")
+		initMigrationFlags(os.Args[3:])
+		if !runManifestVerify(manifestPath) {
+			os.Exit(1)
+		}
+		return
+	case "snapshot":
+		if len(os.Args) < 3 || (os.Args[2] != "source" && os.Args[2] != "destination") {
+			log.Fatalln("Usage: clearblade-iot-core-migration snapshot <source|destination> [-snapshotFile <snapshot.json>] <registry flags>")
+		}
+		var snapshotPath string
+		flag.StringVar(&snapshotPath, "snapshotFile", "", "File the snapshot is written to. Default is <workDir>/snapshot_<registry>_<time>.json")
+		initMigrationFlags(os.Args[3:])
+		runSnapshot(os.Args[2], snapshotPath)
+		return
+	case "diff":
+		var format string
+		flag.StringVar(&format, "format", "text", "Output format: text or json")
+		initMigrationFlags(os.Args[2:])
+		if flag.NArg() != 2 {
+			log.Fatalln("Usage: clearblade-iot-core-migration diff [-format text|json] [-idMappingCsv <mapping.csv>] <from> <to>")
+		}
+		if !runDiff(flag.Arg(0), flag.Arg(1), format) {
+			os.Exit(1)
+		}
+		return
+	case "run-batches":
+		var batchDir string
+		var parallelism int
+		flag.StringVar(&batchDir, "batchDir", "", "Directory of CSV batch files written by -exportBatchSize. Default is <workDir>/batches")
+		flag.IntVar(&parallelism, "batchParallelism", 2, "Number of batches migrated at once. Default is 2")
+		initMigrationFlags(os.Args[2:])
+		if !runBatches(batchDir, parallelism) {
+			os.Exit(1)
+		}
+		return
+	case "export-archive":
+		archiveMode = ArchiveExport
+		args = os.Args[2:]
+	case "import-archive":
+		archiveMode = ArchiveImport
+		args = os.Args[2:]
+	}
+
+	initMigrationFlags(args)
+
+	switch Args.validationPolicy {
+	case ValidationPolicySkip, ValidationPolicyTruncate, ValidationPolicyAbort, ValidationPolicyOff:
+	default:
+		log.Fatalf("Invalid -validationPolicy %q. Must be one of: skip, truncate, abort, off\n", Args.validationPolicy)
 	}
 
-	initMigrationFlags()
+	switch Args.registryCACheck {
+	case CACheckOff, CACheckLog, CACheckSkip:
+	default:
+		log.Fatalf("Invalid -registryCACheck %q. Must be one of: off, log, skip\n", Args.registryCACheck)
+	}
+
+	validateConflictFlags()
+	validateConfigHistoryFlags()
+	validateBatchExportFlags()
+	if Args.preserveConfigVersions && Args.skipConfig {
+		log.Fatalln("-preserveConfigVersions cannot be used with -skipConfig")
+	}
+	if Args.exportConfigHistory && !Args.configHistory {
+		log.Fatalln("-exportConfigHistory cannot be used with -configHistory=false")
+	}
+
+	if _, err := NewDeviceFilterFromArgs(); err != nil {
+		log.Fatalln(err)
+	}
+	loadMigrationRules()
+	loadDeviceIdMapper()
+	loadMergeSources()
+	loadSplitDestinations()
+	validateArchiveFlags()
+	validateDistributedFlags()
+	validateStreamingFlags()
+	validateTransactionFlags()
+	loadManifestKey()
+	loadCheckpointStore()
+
+	if !isMergeMode() && archiveMode != ArchiveImport {
+		printfColored(colorGreen, "\u2713 Validating source flags")
+		validateSourceCBFlags()
+	}
+	if needsDestination() {
+		printfColored(colorGreen, "\u2713 Validating destination flags")
+		validateCBFlags(Args.cbSourceRegion)
+	}
 
+	// The checkpoint fingerprint depends on flags that may have been entered interactively.
 	if err := InitializeCheckpointSystem(); err != nil {
 		log.Fatalf("Failed to initialize checkpoint system: %s\n", err)
 	}
 
-	printfColored(colorGreen, "\u2713 Validating source flags")
-	validateSourceCBFlags()
-	printfColored(colorGreen, "\u2713 Validating destination flags")
-	validateCBFlags(Args.cbSourceRegion)
-
 	printfColored(colorGreen, "\u2713 All Flags validated")
 	printfColored(colorCyan, "================= Starting Device Migration =================\nRunning Version: %s\n", cbIotCoreMigrationVersion)
 
+	var err error
+	if needsDestination() {
+		destinationEndpoint, err = NewClearBladeEndpoint(Args.cbServiceAccount, Args.cbRegistryName, Args.cbRegistryRegion)
+		if err != nil {
+			log.Fatalf("Unable to load destination service account: %s\n", err)
+		}
+	}
+
 	// --------------------- Fetch data from source ---------------------
 
-	sourceService, err := getIoTCoreService(Args.cbSourceServiceAccount)
-	if err != nil {
-		log.Fatalf("Unable to connect to source registry: %s\n", err)
+	var sourceService *cbiotcore.Service
+	var archive *RegistryArchive
+	var devices []*cbiotcore.Device
+	if archiveMode == ArchiveImport {
+		archive, err = openArchive(archiveFile(), filepath.Join(Args.workDir, "archive-import"))
+		if err != nil {
+			log.Fatalf("Unable to open archive %s: %s\n", archiveFile(), err)
+		}
+		archive.printSummary(archiveFile())
+		devices = filterDevices(archive.Devices())
+	} else if isMergeMode() {
+		connectMergeSources()
+		devices = filterDevices(fetchMergedDevices())
+	} else {
+		sourceEndpoint, err = NewClearBladeEndpoint(Args.cbSourceServiceAccount, Args.cbSourceRegistryName, Args.cbSourceRegion)
+		if err != nil {
+			log.Fatalf("Unable to load source service account: %s\n", err)
+		}
+		sourceService, err = sourceEndpoint.NewService()
+		if err != nil {
+			log.Fatalf("Unable to connect to source registry: %s\n", err)
+		}
+		err = verifyRegistryDetails(sourceService, Args.cbSourceRegistryName, Args.cbSourceRegion)
+		if err != nil {
+			log.Fatalf("Error verifying registry details: %s\n", err)
+		}
+		if isDistributedMode() {
+			runDistributedMigration(sourceService)
+			return
+		}
+		if Args.streaming {
+			defer errorLogger.WriteToFile()
+			runStreamingMigration(sourceService)
+			printfColored(colorGreen, "\u2713 Migration complete")
+			return
+		}
+		devices = filterDevices(fetchDevices(sourceService))
 	}
-	err = verifyRegistryDetails(sourceService, Args.cbSourceRegistryName, Args.cbSourceRegion)
-	if err != nil {
-		log.Fatalf("Error verifying registry details: %s\n", err)
+
+	if Args.exportBatchSize != 0 {
+		var gatewayBindings map[string][]*cbiotcore.Device
+		if Args.exportShardBy == ShardByGateway {
+			gatewayBindings = fetchSourceGatewayBindings(archive, sourceService, devices)
+		}
+		exportDeviceBatches(devices, gatewayBindings)
+		printfColored(colorGreen, "\u2713 Device batches exported")
+		return
+	}
+
+	// Archives hold devices as fetched. They are validated when imported.
+	var skippedDevices map[string]struct{}
+	if archiveMode != ArchiveExport {
+		devices, skippedDevices = validateDevices(devices)
+		checkCredentialHealth(devices)
 	}
 
-	devices := fetchDevices(sourceService)
+	var deviceConfigs map[string]interface{}
+	if archive != nil {
+		deviceConfigs = archive.ConfigHistory(devices)
+	} else if isMergeMode() {
+		deviceConfigs = fetchMergedConfigHistory(devices)
+	} else {
+		deviceConfigs = fetchConfigHistory(sourceService, devices)
+	}
 
-	if Args.exportBatchSize != 0 { // TODO
-		ExportDeviceBatches(devices, Args.exportBatchSize)
-		printfColored(colorGreen, "\u2713 Device batches exported to csv")
+	if Args.exportConfigHistory {
+		exportConfigHistory(deviceConfigs)
+		printfColored(colorGreen, "\u2713 Config history exported")
 		return
 	}
 
-	deviceConfigs := fetchConfigHistory(sourceService, devices)
-	gatewayBindings := fetchGatewayBindings(sourceService, devices)
+	gatewayBindings := fetchSourceGatewayBindings(archive, sourceService, devices)
+
+	if archiveMode == ArchiveExport {
+		exportArchive(sourceService, devices, deviceConfigs, gatewayBindings)
+		if err := GetCheckpoint().Complete(); err != nil {
+			printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
+		}
+		printfColored(colorGreen, "\u2713 Archive export complete")
+		return
+	}
+	skippedDevices, gatewayBindings = validateGatewayBindings(gatewayBindings, skippedDevices)
+	devices, deviceConfigs, gatewayBindings = excludeDevices(skippedDevices, devices, deviceConfigs, gatewayBindings)
+	resolveDeviceIdMapping(devices, gatewayBindings)
 
 	// --------------------- Push data to destination ---------------------
 
-	destinationService, err := getIoTCoreService(Args.cbServiceAccount)
+	defer errorLogger.WriteToFile()
+
+	if isSplitMode() {
+		if !runSplitMigration(devices, deviceConfigs, gatewayBindings) {
+			// Keep the checkpoint so a rerun skips the completed destinations.
+			if err := GetCheckpoint().FlushToDisk(); err != nil {
+				printfColored(colorYellow, "Warning: Could not save checkpoint: %s", err)
+			}
+			printfColored(colorYellow, "Some destinations are incomplete. Rerun with the same flags to retry their failed devices")
+			return
+		}
+	} else {
+		migrateToDestination(devices, deviceConfigs, gatewayBindings)
+	}
+
+	if err := GetCheckpoint().Complete(); err != nil {
+		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
+	}
+
+	printfColored(colorGreen, "\u2713 Migration complete")
+}
+
+// needsDestination reports whether this run writes to the single destination
+// registry given by the -cbRegistryName flags, rather than exporting or
+// writing to split destinations.
+func needsDestination() bool {
+	return !isSplitMode() && !Args.exportConfigHistory && Args.exportBatchSize == 0 && archiveMode != ArchiveExport
+}
+
+// fetchSourceGatewayBindings returns the bound devices of the gateways among
+// devices from the archive, the merge sources or the source registry.
+func fetchSourceGatewayBindings(archive *RegistryArchive, sourceService *cbiotcore.Service, devices []*cbiotcore.Device) map[string][]*cbiotcore.Device {
+	if archive != nil {
+		return archive.GatewayBindings(devices)
+	}
+	if isMergeMode() {
+		return fetchMergedGatewayBindings(devices)
+	}
+	return fetchGatewayBindings(sourceService, devices)
+}
+
+// migrateToDestination writes the fetched devices, config history and gateway
+// bindings to destinationEndpoint and returns the number of devices migrated.
+func migrateToDestination(devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) int {
+	destinationService, err := destinationEndpoint.NewService()
 	if err != nil {
 		log.Fatalf("Unable to connect to destination registry: %s\n", err)
 	}
-	err = verifyRegistryDetails(destinationService, Args.cbRegistryName, Args.cbRegistryRegion)
+	err = verifyRegistryDetails(destinationService, destinationEndpoint.RegistryName, destinationEndpoint.Region)
 	if err != nil {
 		log.Fatalf("Error verifying destination registry details: %s\n", err)
 	}
 
-	defer errorLogger.WriteToFile()
+	failedCAVerification := verifyDevicesAgainstRegistryCAs(destinationService, devices)
+	devices, deviceConfigs, gatewayBindings = excludeDevices(failedCAVerification, devices, deviceConfigs, gatewayBindings)
 
 	if Args.cleanupCbRegistry {
 		deleteAllFromCbRegistry(destinationService)
 		printfColored(colorGreen, " \u2713 Successfully cleaned up destination ClearBlade registry")
 	}
 
+	if Args.perDeviceTransaction {
+		migrated := migrateDeviceUnits(destinationService, devices, deviceConfigs, gatewayBindings)
+		writeMigrationManifest(devices, deviceConfigs, gatewayBindings)
+		return migrated
+	}
+
 	migrated := addDevicesToClearBlade(destinationService, devices)
 	if migrated == len(devices) {
 		printfColored(colorGreen, " \u2713 Migrated %d/%d devices and gateways", migrated, len(devices))
@@ -278,16 +655,12 @@ func main() {
 	// 	}
 	// }
 
-
 	err = updateConfigHistory(destinationService, deviceConfigs)
 	if err != nil {
 		printfColored(colorRed, "\u2715 Unable to update config version history! Reason: %v", err)
 	}
+	alignConfigVersions(destinationService, devices)
 	migrateBoundDevicesToClearBlade(destinationService, gatewayBindings)
-
-	if err := GetCheckpoint().Complete(); err != nil {
-		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
-	}
-
-	printfColored(colorGreen, "\u2713 Migration complete")
+	writeMigrationManifest(devices, deviceConfigs, gatewayBindings)
+	return migrated
 }
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	ManifestKindMigration     = "migration"
+	ManifestKindArchive       = "archive"
+	ManifestKindConfigHistory = "config-history"
+)
+
+const manifestFormatVersion = 1
+
+// manifestSigningKey is the parsed -manifestKey. Manifests are only written
+// when it is set.
+var manifestSigningKey ed25519.PrivateKey
+
+// SignedManifest is the file written next to an export or in the work
+// directory of a completed migration. Signature is the Ed25519 signature of
+// the exact bytes of Manifest.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	PublicKey string          `json:"publicKey"`
+}
+
+// MigrationManifest lists what an export or migration moved. Devices are
+// sorted by ID and identified by their destination ID.
+type MigrationManifest struct {
+	FormatVersion int              `json:"formatVersion"`
+	ToolVersion   string           `json:"toolVersion"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	Kind          string           `json:"kind"`
+	Target        string           `json:"target"`
+	Credentials   bool             `json:"credentials"`
+	Devices       []ManifestDevice `json:"devices"`
+}
+
+// ManifestDevice holds the hashes of one device. PayloadSha256 covers the
+// transformed device as written to the destination, ConfigHistorySha256 the
+// data of ConfigVersions, and Bindings the devices bound to a gateway.
+type ManifestDevice struct {
+	Id                  string   `json:"id"`
+	SourceId            string   `json:"sourceId,omitempty"`
+	PayloadSha256       string   `json:"payloadSha256,omitempty"`
+	ConfigVersions      []int64  `json:"configVersions,omitempty"`
+	ConfigHistorySha256 string   `json:"configHistorySha256,omitempty"`
+	Bindings            []string `json:"bindings,omitempty"`
+}
+
+// manifestPayload is the part of a device that the destination registry
+// stores as written, normalized so that a device read back from the registry
+// hashes the same as the transformed device that was sent.
+type manifestPayload struct {
+	Id                string            `json:"id"`
+	Blocked           bool              `json:"blocked"`
+	Credentials       []string          `json:"credentials"`
+	LogLevel          string            `json:"logLevel"`
+	Metadata          map[string]string `json:"metadata"`
+	GatewayType       string            `json:"gatewayType"`
+	GatewayAuthMethod string            `json:"gatewayAuthMethod"`
+}
+
+func loadManifestKey() {
+	if Args.manifestKey == "" {
+		return
+	}
+	key, err := readEd25519PrivateKey(Args.manifestKey)
+	if err != nil {
+		log.Fatalf("Invalid -manifestKey: %s\n", err)
+	}
+	manifestSigningKey = key
+}
+
+// readEd25519PrivateKey reads a PEM encoded PKCS #8 Ed25519 private key, as
+// written by `openssl genpkey -algorithm ed25519`.
+func readEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return key, nil
+}
+
+// readEd25519PublicKey reads a PEM encoded PKIX Ed25519 public key, as
+// written by `openssl pkey -pubout`.
+func readEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return key, nil
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	return block, nil
+}
+
+func payloadHash(cbDevice *cbiotcore.Device, credentials bool) string {
+	payload := manifestPayload{
+		Id:                cbDevice.Id,
+		Blocked:           cbDevice.Blocked,
+		Credentials:       []string{},
+		LogLevel:          normalizeLogLevel(cbDevice.LogLevel),
+		Metadata:          cbDevice.Metadata,
+		GatewayAuthMethod: gatewayAuthMethod(cbDevice),
+		GatewayType:       "NON_GATEWAY",
+	}
+	if credentials {
+		payload.Credentials = credentialKeys(cbDevice.Credentials)
+	}
+	if payload.Metadata == nil {
+		payload.Metadata = map[string]string{}
+	}
+	if cbDevice.GatewayConfig != nil && cbDevice.GatewayConfig.GatewayType == "GATEWAY" {
+		payload.GatewayType = "GATEWAY"
+	}
+	if payload.GatewayAuthMethod == "GATEWAY_AUTH_METHOD_UNSPECIFIED" {
+		payload.GatewayAuthMethod = ""
+	}
+
+	content, _ := json.Marshal(payload)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// configHistoryHash hashes the version numbers and data of history, in the
+// deviceConfigs format, in version order. Update and ack times are not
+// covered because the destination records its own.
+func configHistoryHash(history map[string]interface{}) ([]int64, string) {
+	if len(history) == 0 {
+		return nil, ""
+	}
+	versions := make([]int64, 0, len(history))
+	for key := range history {
+		version, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	h := sha256.New()
+	for _, version := range versions {
+		configMap, _ := history[strconv.FormatInt(version, 10)].(map[string]interface{})
+		data, _ := configMap["binaryData"].(string)
+		fmt.Fprintf(h, "%d:%s\n", version, data)
+	}
+	return versions, hex.EncodeToString(h.Sum(nil))
+}
+
+// buildManifestDevices computes the manifest entries of devices, keyed by
+// source ID like deviceConfigs and gatewayBindings. Bound devices that are not
+// in devices get their own entry.
+func buildManifestDevices(devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device, credentials bool) []ManifestDevice {
+	entries := make(map[string]ManifestDevice)
+	add := func(device *cbiotcore.Device) {
+		destId := destinationDeviceId(device.Id)
+		cbDevice, err := transform(device)
+		if err != nil {
+			// The rewrite rules failed, so the device was not migrated.
+			return
+		}
+		entry := ManifestDevice{Id: destId, PayloadSha256: payloadHash(cbDevice, credentials)}
+		if destId != device.Id {
+			entry.SourceId = device.Id
+		}
+		if history, ok := deviceConfigs[device.Id].(map[string]interface{}); ok {
+			entry.ConfigVersions, entry.ConfigHistorySha256 = configHistoryHash(history)
+		}
+		if bound, ok := gatewayBindings[device.Id]; ok {
+			entry.Bindings = boundDestinationIds(bound)
+		}
+		entries[destId] = entry
+	}
+
+	for _, device := range devices {
+		add(device)
+	}
+	for _, bound := range gatewayBindings {
+		for _, device := range bound {
+			if _, ok := entries[destinationDeviceId(device.Id)]; !ok {
+				add(device)
+			}
+		}
+	}
+	return sortedManifestDevices(entries)
+}
+
+func boundDestinationIds(bound []*cbiotcore.Device) []string {
+	ids := make([]string, 0, len(bound))
+	for _, device := range bound {
+		ids = append(ids, destinationDeviceId(device.Id))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedManifestDevices(entries map[string]ManifestDevice) []ManifestDevice {
+	sorted := make([]ManifestDevice, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+	return sorted
+}
+
+// writeSignedManifest signs manifest with -manifestKey and writes it to path.
+func writeSignedManifest(path string, manifest MigrationManifest) {
+	manifest.FormatVersion = manifestFormatVersion
+	manifest.ToolVersion = cbIotCoreMigrationVersion
+	manifest.CreatedAt = time.Now().UTC()
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		log.Fatalf("Unable to encode manifest: %s\n", err)
+	}
+	signed := SignedManifest{
+		Manifest:  body,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(manifestSigningKey, body)),
+		PublicKey: base64.StdEncoding.EncodeToString(manifestSigningKey.Public().(ed25519.PublicKey)),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Unable to create manifest directory: %s\n", err)
+	}
+	if err := writeJSONFile(path, signed); err != nil {
+		log.Fatalf("Unable to write manifest: %s\n", err)
+	}
+	printfColored(colorGreen, " \u2713 Signed manifest of %d devices written to %s", len(manifest.Devices), path)
+}
+
+// writeMigrationManifest records the devices migrated to destinationEndpoint
+// in migration_manifest.json in the work directory. Devices that failed or
+// that -onConflict left untouched are not listed.
+func writeMigrationManifest(devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) {
+	if manifestSigningKey == nil {
+		return
+	}
+
+	checkpoint := GetCheckpoint()
+	failed := errorLogger.DeviceIds()
+	var migrated []*cbiotcore.Device
+	for _, device := range devices {
+		if checkpoint.IsDeviceMigrated(device.Id) && !conflictReport.Untouched(device.Id) {
+			migrated = append(migrated, device)
+		}
+	}
+	bindings := make(map[string][]*cbiotcore.Device, len(gatewayBindings))
+	for gatewayId, bound := range gatewayBindings {
+		var ok []*cbiotcore.Device
+		for _, device := range bound {
+			if _, hasErrors := failed[device.Id]; !hasErrors {
+				ok = append(ok, device)
+			}
+		}
+		bindings[gatewayId] = ok
+	}
+
+	writeSignedManifest(filepath.Join(Args.workDir, "migration_manifest.json"), MigrationManifest{
+		Kind:        ManifestKindMigration,
+		Target:      destinationEndpoint.RegistryPath(),
+		Credentials: Args.updatePublicKeys,
+		Devices:     buildManifestDevices(migrated, trimDeviceConfigs(deviceConfigs), bindings, Args.updatePublicKeys),
+	})
+}
+
+func writeArchiveManifest(target string, devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) {
+	if manifestSigningKey == nil {
+		return
+	}
+	writeSignedManifest(target+".manifest.json", MigrationManifest{
+		Kind:        ManifestKindArchive,
+		Target:      filepath.Base(target),
+		Credentials: Args.updatePublicKeys,
+		Devices:     buildManifestDevices(devices, deviceConfigs, gatewayBindings, Args.updatePublicKeys),
+	})
+}
+
+func writeConfigHistoryManifest(dir string, deviceConfigs map[string]interface{}) {
+	if manifestSigningKey == nil {
+		return
+	}
+	entries := make(map[string]ManifestDevice, len(deviceConfigs))
+	for deviceId, history := range deviceConfigs {
+		historyMap, _ := history.(map[string]interface{})
+		entry := ManifestDevice{Id: deviceId}
+		entry.ConfigVersions, entry.ConfigHistorySha256 = configHistoryHash(historyMap)
+		entries[deviceId] = entry
+	}
+	writeSignedManifest(strings.TrimRight(dir, `/\`)+".manifest.json", MigrationManifest{
+		Kind:    ManifestKindConfigHistory,
+		Target:  filepath.Base(dir),
+		Devices: sortedManifestDevices(entries),
+	})
+}
+
+// readSignedManifest checks the signature of the manifest at path against
+// publicKey before decoding it.
+func readSignedManifest(path string, publicKey ed25519.PublicKey) (*MigrationManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var signed SignedManifest
+	if err := json.Unmarshal(content, &signed); err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	// The manifest is signed in compact form and stored indented.
+	var body bytes.Buffer
+	if err := json.Compact(&body, signed.Manifest); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, body.Bytes(), signature) {
+		return nil, errors.New("signature does not match the public key")
+	}
+
+	var manifest MigrationManifest
+	if err := json.Unmarshal(signed.Manifest, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.FormatVersion < 1 || manifest.FormatVersion > manifestFormatVersion {
+		return nil, fmt.Errorf("unsupported manifest format version %d", manifest.FormatVersion)
+	}
+	return &manifest, nil
+}
+
+// runManifestVerify checks the signature of a manifest and compares its
+// hashes with the devices in -archiveFile or, without it, in the destination
+// registry.
+func runManifestVerify(manifestPath string) bool {
+	if manifestPath == "" {
+		log.Fatalln("-manifest is a required parameter")
+	}
+	if Args.manifestPublicKey == "" {
+		log.Fatalln("-manifestPublicKey is a required parameter")
+	}
+	publicKey, err := readEd25519PublicKey(Args.manifestPublicKey)
+	if err != nil {
+		log.Fatalf("Invalid -manifestPublicKey: %s\n", err)
+	}
+
+	manifest, err := readSignedManifest(manifestPath, publicKey)
+	if err != nil {
+		printfColored(colorRed, "\u2715 Manifest %s is not valid: %s", manifestPath, err)
+		return false
+	}
+	printfColored(colorGreen, "\u2713 Signature valid: %s manifest of %d devices for %s, created %s", manifest.Kind, len(manifest.Devices), manifest.Target, manifest.CreatedAt.Format(time.RFC3339))
+
+	var actual map[string]ManifestDevice
+	if Args.archiveFile != "" {
+		actual, err = archiveManifestDevices(manifest)
+		if err != nil {
+			log.Fatalf("Unable to read archive %s: %s\n", Args.archiveFile, err)
+		}
+	} else {
+		validateCBFlags(Args.cbRegistryRegion)
+		actual = registryManifestDevices(manifest)
+	}
+
+	// Only an archive manifest lists everything in its archive.
+	complete := Args.archiveFile != "" && manifest.Kind == ManifestKindArchive
+	problems := compareManifestDevices(manifest, actual, complete)
+	if len(problems) > 0 {
+		const maxShown = 20
+		printfColored(colorRed, " \u2715 %d manifest mismatches:", len(problems))
+		for i, p := range problems {
+			if i == maxShown {
+				printfColored(colorRed, "   ... and %d more", len(problems)-maxShown)
+				break
+			}
+			printfColored(colorRed, "   %s", p)
+		}
+		return false
+	}
+	printfColored(colorGreen, "\u2713 All %d devices match the manifest", len(manifest.Devices))
+	return true
+}
+
+// archiveManifestDevices recomputes manifest entries from an archive, with
+// the rewrite rules and ID mapping of this run.
+func archiveManifestDevices(manifest *MigrationManifest) (map[string]ManifestDevice, error) {
+	loadMigrationRules()
+	loadDeviceIdMapper()
+
+	archive, err := openArchive(Args.archiveFile, filepath.Join(Args.workDir, "archive-import"))
+	if err != nil {
+		return nil, err
+	}
+	devices, err := readDevicesJSONL(filepath.Join(archive.dir, archiveDevicesFile))
+	if err != nil {
+		return nil, err
+	}
+	deviceConfigs := archive.ConfigHistory(devices)
+	gatewayBindings := archive.GatewayBindings(devices)
+	resolveDeviceIdMapping(devices, gatewayBindings)
+
+	if manifest.Kind == ManifestKindMigration {
+		deviceConfigs = trimDeviceConfigs(deviceConfigs)
+	}
+	entries := make(map[string]ManifestDevice)
+	for _, entry := range buildManifestDevices(devices, deviceConfigs, gatewayBindings, manifest.Credentials) {
+		if manifest.Kind == ManifestKindConfigHistory {
+			entry = ManifestDevice{Id: entry.Id, ConfigVersions: entry.ConfigVersions, ConfigHistorySha256: entry.ConfigHistorySha256}
+		}
+		entries[entry.Id] = entry
+	}
+	return entries, nil
+}
+
+// registryManifestDevices reads every device listed in the manifest back from
+// the destination registry. Only the config versions and bindings listed in
+// the manifest are compared, since the registry may hold others.
+func registryManifestDevices(manifest *MigrationManifest) map[string]ManifestDevice {
+	var err error
+	destinationEndpoint, err = NewClearBladeEndpoint(Args.cbServiceAccount, Args.cbRegistryName, Args.cbRegistryRegion)
+	if err != nil {
+		log.Fatalf("Unable to load destination service account: %s\n", err)
+	}
+	service, err := destinationEndpoint.NewService()
+	if err != nil {
+		log.Fatalf("Unable to connect to destination registry: %s\n", err)
+	}
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+
+	actual := make(map[string]ManifestDevice, len(manifest.Devices))
+	var actualMutex sync.Mutex
+	bar := getProgressBar(len(manifest.Devices), "Reading manifest devices from destination registry...")
+	wp := NewWorkerPool()
+	wp.Run()
+	for _, expected := range manifest.Devices {
+		wp.AddTask(func() {
+			defer bar.Add(1)
+			entry, ok := registryManifestDevice(deviceService, manifest, expected)
+			if !ok {
+				return
+			}
+			actualMutex.Lock()
+			actual[entry.Id] = entry
+			actualMutex.Unlock()
+		})
+	}
+	wp.Wait()
+	bar.Finish()
+	return actual
+}
+
+func registryManifestDevice(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, manifest *MigrationManifest, expected ManifestDevice) (ManifestDevice, bool) {
+	entry := ManifestDevice{Id: expected.Id, SourceId: expected.SourceId}
+	devicePath := destinationEndpoint.DevicePath(expected.Id)
+
+	if expected.PayloadSha256 != "" {
+		device, err := deviceService.Get(devicePath).Do()
+		if err != nil {
+			return entry, false
+		}
+		entry.PayloadSha256 = payloadHash(device, manifest.Credentials)
+	}
+
+	if len(expected.ConfigVersions) > 0 {
+		resp, err := deviceService.ConfigVersions.List(devicePath).Do()
+		if err != nil {
+			return entry, false
+		}
+		all := make(map[string]*cbiotcore.DeviceConfig, len(resp.DeviceConfigs))
+		for _, config := range resp.DeviceConfigs {
+			all[strconv.FormatInt(config.Version, 10)] = config
+		}
+		history := make(map[string]interface{}, len(expected.ConfigVersions))
+		for _, version := range expected.ConfigVersions {
+			key := strconv.FormatInt(version, 10)
+			if config, ok := all[key]; ok {
+				history[key] = map[string]interface{}{"binaryData": base64.StdEncoding.EncodeToString([]byte(config.BinaryData))}
+			}
+		}
+		entry.ConfigVersions, entry.ConfigHistorySha256 = configHistoryHash(history)
+	}
+
+	if len(expected.Bindings) > 0 {
+		req := deviceService.List(destinationEndpoint.RegistryPath()).GatewayListOptionsAssociationsGatewayId(expected.Id).PageSize(Args.pageSize)
+		bound, err := paginatedFetch(req, "")
+		if err != nil {
+			return entry, false
+		}
+		entry.Bindings = make([]string, 0, len(bound))
+		for _, device := range bound {
+			entry.Bindings = append(entry.Bindings, device.Id)
+		}
+		sort.Strings(entry.Bindings)
+	}
+	return entry, true
+}
+
+// compareManifestDevices lists the differences between the manifest and the
+// recomputed entries. When complete is set, actual holds everything in the
+// source, so devices missing from the manifest are reported as well.
+func compareManifestDevices(manifest *MigrationManifest, actual map[string]ManifestDevice, complete bool) []string {
+	var problems []string
+	listed := make(map[string]struct{}, len(manifest.Devices))
+	for _, expected := range manifest.Devices {
+		listed[expected.Id] = struct{}{}
+		got, ok := actual[expected.Id]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not found", expected.Id))
+			continue
+		}
+		if expected.PayloadSha256 != "" && got.PayloadSha256 != expected.PayloadSha256 {
+			problems = append(problems, fmt.Sprintf("%s: device payload differs", expected.Id))
+		}
+		if got.ConfigHistorySha256 != expected.ConfigHistorySha256 {
+			problems = append(problems, fmt.Sprintf("%s: config history differs (%d of %d versions found)", expected.Id, len(got.ConfigVersions), len(expected.ConfigVersions)))
+		}
+		if strings.Join(got.Bindings, ",") != strings.Join(expected.Bindings, ",") {
+			problems = append(problems, fmt.Sprintf("%s: bound devices differ (%d expected, %d found)", expected.Id, len(expected.Bindings), len(got.Bindings)))
+		}
+	}
+	if complete {
+		for id := range actual {
+			if _, ok := listed[id]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: not in manifest", id))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	CollisionPolicyFail       = "fail"
+	CollisionPolicyPrefix     = "prefix"
+	CollisionPolicyKeepFirst  = "keep-first"
+	CollisionPolicyKeepNewest = "keep-newest"
+)
+
+const collisionContext = "Source Collision"
+
+// mergeSources are the source registries read in multi-source mode, in the
+// order they are listed in -mergeSourcesCsv. It is nil in single-source mode.
+var mergeSources []*MergeSource
+
+// deviceOrigins maps every merged device ID to the source registry and
+// source device ID it was read from, and mergedIds is its inverse keyed by
+// "tag/sourceId". Both are only populated in multi-source mode.
+var (
+	deviceOrigins map[string]DeviceOrigin
+	mergedIds     map[string]string
+)
+
+type MergeSource struct {
+	Tag      string
+	Endpoint *ClearBladeEndpoint
+	service  *cbiotcore.Service
+}
+
+type DeviceOrigin struct {
+	Source   string `json:"source"`
+	SourceId string `json:"sourceId"`
+}
+
+// CollisionRecord is one row of the collision report: a device whose ID was
+// found in more than one source registry and what happened to it.
+type CollisionRecord struct {
+	DeviceId   string
+	Source     string
+	UpdateTime string
+	Resolution string
+	MergedId   string
+}
+
+func isMergeMode() bool {
+	return len(mergeSources) > 0
+}
+
+// loadMergeSources reads -mergeSourcesCsv. The CSV has the columns tag,
+// registryName, region and, optionally, serviceAccount. Sources without a
+// service account use -cbSourceServiceAccount.
+func loadMergeSources() {
+	if Args.mergeSourcesCsv == "" {
+		return
+	}
+
+	switch Args.collisionPolicy {
+	case CollisionPolicyFail, CollisionPolicyPrefix, CollisionPolicyKeepFirst, CollisionPolicyKeepNewest:
+	default:
+		log.Fatalf("Invalid -collisionPolicy %q. Must be one of: fail, prefix, keep-first, keep-newest\n", Args.collisionPolicy)
+	}
+
+	sources, err := readMergeSourcesCsv(Args.mergeSourcesCsv)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mergeSources = sources
+}
+
+func readMergeSourcesCsv(path string) ([]*MergeSource, error) {
+	entries, err := readEndpointsCsv(path, "tag", Args.cbSourceServiceAccount, "-cbSourceServiceAccount")
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]*MergeSource, 0, len(entries))
+	for _, entry := range entries {
+		if !isValidDeviceId(entry.Name) {
+			return nil, fmt.Errorf("%s: tag %q must start with a letter and only contain characters allowed in device IDs", path, entry.Name)
+		}
+		sources = append(sources, &MergeSource{Tag: entry.Name, Endpoint: entry.Endpoint})
+	}
+	return sources, nil
+}
+
+// connectMergeSources connects to every source registry and verifies it.
+func connectMergeSources() {
+	for _, src := range mergeSources {
+		service, err := src.Endpoint.NewService()
+		if err != nil {
+			log.Fatalf("Unable to connect to source registry %s: %s\n", src.Tag, err)
+		}
+		if err := verifyRegistryDetails(service, src.Endpoint.RegistryName, src.Endpoint.Region); err != nil {
+			log.Fatalf("Error verifying registry details of source %s: %s\n", src.Tag, err)
+		}
+		src.service = service
+	}
+}
+
+func mergeSourceByTag(tag string) *MergeSource {
+	for _, src := range mergeSources {
+		if src.Tag == tag {
+			return src
+		}
+	}
+	return nil
+}
+
+func setDeviceOrigins(origins map[string]DeviceOrigin) {
+	deviceOrigins = origins
+	mergedIds = make(map[string]string, len(origins))
+	for mergedId, origin := range origins {
+		mergedIds[origin.Source+"/"+origin.SourceId] = mergedId
+	}
+}
+
+// sourceLocation returns the source registry path and source device ID of a
+// device. Outside multi-source mode these are the source registry and the
+// device ID itself.
+func sourceLocation(deviceId string) (registryPath, sourceId string) {
+	if origin, ok := deviceOrigins[deviceId]; ok {
+		if src := mergeSourceByTag(origin.Source); src != nil {
+			return src.Endpoint.RegistryPath(), origin.SourceId
+		}
+	}
+	return sourceEndpoint.RegistryPath(), deviceId
+}
+
+// mergedBoundDevices renames the devices bound to a gateway to their merged
+// IDs. Bound devices that lost a collision are dropped from the binding.
+func mergedBoundDevices(gatewayId string, bound []*cbiotcore.Device) []*cbiotcore.Device {
+	origin, ok := deviceOrigins[gatewayId]
+	if !ok {
+		return bound
+	}
+
+	kept := make([]*cbiotcore.Device, 0, len(bound))
+	for _, device := range bound {
+		mergedId, ok := mergedIds[origin.Source+"/"+device.Id]
+		if !ok {
+			errorLogger.AddError(collisionContext, device.Id, fmt.Errorf("not bound to gateway %s: device from source %s was dropped by -collisionPolicy", gatewayId, origin.Source))
+			continue
+		}
+		device.Id = mergedId
+		kept = append(kept, device)
+	}
+	return kept
+}
+
+// fetchMergedDevices lists the devices of every source registry and merges
+// them into one list, resolving ID collisions with -collisionPolicy.
+// Collisions are detected before any filters are applied because bound
+// devices are migrated with their gateway whether or not they are selected.
+func fetchMergedDevices() []*cbiotcore.Device {
+	checkpoint := GetCheckpoint()
+
+	var devices []*cbiotcore.Device
+	if checkpoint.IsPhaseCompleted(PhaseDeviceFetch) {
+		printfColored(colorGreen, "\u2713 Device fetch phase already completed, loading from checkpoint")
+		setDeviceOrigins(checkpoint.GetDeviceOrigins())
+		devices = checkpoint.GetFetchedDevices()
+	} else {
+		perSource := make([][]*cbiotcore.Device, len(mergeSources))
+		for i, src := range mergeSources {
+			deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(src.service)
+			req := deviceService.List(src.Endpoint.RegistryPath()).PageSize(Args.pageSize)
+			fetched, err := paginatedFetch(req, fmt.Sprintf("Fetching all devices from source %s...", src.Tag))
+			if err != nil {
+				log.Fatalf("Error fetching devices from source %s: %s\n", src.Tag, err)
+			}
+			perSource[i] = fetched
+		}
+
+		merged, origins, report, err := mergeSourceDevices(perSource)
+
+		reportFile := filepath.Join(Args.workDir, "collision_report.csv")
+		if writeErr := writeCollisionReport(reportFile, report); writeErr != nil {
+			log.Printf("Unable to write collision report: %s\n", writeErr)
+		} else if len(report) > 0 {
+			printfColored(colorYellow, " %d devices share an ID with a device in another source. Collision report written to %s", len(report), reportFile)
+		}
+		if err != nil {
+			printfColored(colorRed, "\u2715 %s", err)
+			os.Exit(1)
+		}
+
+		checkpoint.SetTotalDevices(len(merged))
+		for _, device := range merged {
+			checkpoint.AddFetchedDevice(device)
+		}
+		checkpoint.SetDeviceOrigins(origins)
+		checkpoint.SetPhase(PhaseDeviceMigrate)
+		setDeviceOrigins(origins)
+		devices = merged
+		printfColored(colorGreen, " \u2713 Merged %d devices from %d sources", len(merged), len(mergeSources))
+	}
+
+	if Args.devicesCsvFile == "" {
+		return devices
+	}
+	csvData, err := readCsvFile(Args.devicesCsvFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceIds, err := parseDeviceIds(csvData)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wanted := make(map[string]struct{}, len(deviceIds))
+	for _, id := range deviceIds {
+		wanted[id] = struct{}{}
+	}
+	selected := make([]*cbiotcore.Device, 0, len(deviceIds))
+	for _, device := range devices {
+		if _, ok := wanted[device.Id]; ok {
+			selected = append(selected, device)
+		}
+	}
+	return selected
+}
+
+// mergeSourceDevices merges the devices of each source, given in source
+// order, into one list keyed by merged ID. Devices whose ID is unique across
+// sources keep it; colliding devices are resolved by -collisionPolicy.
+func mergeSourceDevices(perSource [][]*cbiotcore.Device) ([]*cbiotcore.Device, map[string]DeviceOrigin, []CollisionRecord, error) {
+	type candidate struct {
+		source *MergeSource
+		device *cbiotcore.Device
+	}
+
+	var order []string
+	byId := make(map[string][]candidate)
+	for i, devices := range perSource {
+		for _, device := range devices {
+			if _, ok := byId[device.Id]; !ok {
+				order = append(order, device.Id)
+			}
+			byId[device.Id] = append(byId[device.Id], candidate{source: mergeSources[i], device: device})
+		}
+	}
+
+	var merged []*cbiotcore.Device
+	var report []CollisionRecord
+	origins := make(map[string]DeviceOrigin)
+	add := func(mergedId string, c candidate) {
+		origins[mergedId] = DeviceOrigin{Source: c.source.Tag, SourceId: c.device.Id}
+		c.device.Id = mergedId
+		merged = append(merged, c.device)
+	}
+
+	var problems []string
+	collisions := 0
+	for _, id := range order {
+		candidates := byId[id]
+		if len(candidates) == 1 {
+			add(id, candidates[0])
+			continue
+		}
+		collisions++
+
+		winner := -1
+		switch Args.collisionPolicy {
+		case CollisionPolicyKeepFirst:
+			winner = 0
+		case CollisionPolicyKeepNewest:
+			winner = newestCandidate(len(candidates), func(i int) *cbiotcore.Device { return candidates[i].device })
+		}
+
+		for i, c := range candidates {
+			record := CollisionRecord{DeviceId: id, Source: c.source.Tag, UpdateTime: deviceConfigUpdateTime(c.device)}
+			switch {
+			case Args.collisionPolicy == CollisionPolicyFail:
+				record.Resolution = "conflict"
+			case Args.collisionPolicy == CollisionPolicyPrefix:
+				record.Resolution = "renamed"
+				record.MergedId = c.source.Tag + "-" + id
+				if !isValidDeviceId(record.MergedId) {
+					problems = append(problems, fmt.Sprintf("%s: prefixed ID %q is not a valid device ID", id, record.MergedId))
+				} else if _, ok := origins[record.MergedId]; ok || len(byId[record.MergedId]) > 0 {
+					problems = append(problems, fmt.Sprintf("%s: prefixed ID %q is already used by another device", id, record.MergedId))
+				} else {
+					add(record.MergedId, c)
+				}
+			case i == winner:
+				record.Resolution = "kept"
+				record.MergedId = id
+				add(id, c)
+			default:
+				record.Resolution = "dropped"
+				errorLogger.AddError(collisionContext, id, fmt.Errorf("device from source %s dropped in favour of source %s", c.source.Tag, candidates[winner].source.Tag))
+			}
+			report = append(report, record)
+		}
+	}
+
+	if Args.collisionPolicy == CollisionPolicyFail && collisions > 0 {
+		return nil, nil, report, fmt.Errorf("%d device IDs exist in more than one source. Choose a -collisionPolicy other than fail or fix the sources and rerun", collisions)
+	}
+	if len(problems) > 0 {
+		const maxShown = 20
+		printfColored(colorRed, " \u2715 %d prefixed device ID problems:", len(problems))
+		for i, p := range problems {
+			if i == maxShown {
+				printfColored(colorRed, "   ... and %d more", len(problems)-maxShown)
+				break
+			}
+			printfColored(colorRed, "   %s", p)
+		}
+		return nil, nil, report, errors.New("unable to prefix colliding device IDs")
+	}
+	return merged, origins, report, nil
+}
+
+// newestCandidate returns the index of the device with the latest config
+// update time. Devices without one are treated as oldest and ties go to the
+// earlier source.
+func newestCandidate(n int, device func(int) *cbiotcore.Device) int {
+	newest := 0
+	var newestTime time.Time
+	for i := 0; i < n; i++ {
+		t, err := time.Parse(time.RFC3339Nano, deviceConfigUpdateTime(device(i)))
+		if err != nil {
+			continue
+		}
+		if t.After(newestTime) {
+			newest, newestTime = i, t
+		}
+	}
+	return newest
+}
+
+func deviceConfigUpdateTime(device *cbiotcore.Device) string {
+	if device.Config == nil {
+		return ""
+	}
+	return device.Config.CloudUpdateTime
+}
+
+// devicesFromSource returns the devices that were read from src.
+func devicesFromSource(devices []*cbiotcore.Device, src *MergeSource) []*cbiotcore.Device {
+	var fromSource []*cbiotcore.Device
+	for _, device := range devices {
+		if deviceOrigins[device.Id].Source == src.Tag {
+			fromSource = append(fromSource, device)
+		}
+	}
+	return fromSource
+}
+
+func fetchMergedConfigHistory(devices []*cbiotcore.Device) map[string]interface{} {
+	var deviceConfigs map[string]interface{}
+	for _, src := range mergeSources {
+		if fromSource := devicesFromSource(devices, src); len(fromSource) > 0 {
+			deviceConfigs = fetchConfigHistory(src.service, fromSource)
+		}
+	}
+	return deviceConfigs
+}
+
+func fetchMergedGatewayBindings(devices []*cbiotcore.Device) map[string][]*cbiotcore.Device {
+	var gatewayBindings map[string][]*cbiotcore.Device
+	for _, src := range mergeSources {
+		for gatewayId, bound := range fetchGatewayBindings(src.service, devicesFromSource(devices, src)) {
+			if gatewayBindings == nil {
+				gatewayBindings = make(map[string][]*cbiotcore.Device)
+			}
+			gatewayBindings[gatewayId] = bound
+		}
+	}
+	return gatewayBindings
+}
+
+func writeCollisionReport(path string, report []CollisionRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "source", "configUpdateTime", "resolution", "mergedId"}); err != nil {
+		return err
+	}
+	for _, r := range report {
+		if err := w.Write([]string{r.DeviceId, r.Source, r.UpdateTime, r.Resolution, r.MergedId}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func mergeTestDevice(id, updated string) *cbiotcore.Device {
+	device := &cbiotcore.Device{Id: id}
+	if updated != "" {
+		device.Config = &cbiotcore.DeviceConfig{CloudUpdateTime: updated}
+	}
+	return device
+}
+
+// mergeTestSources returns the devices of two sources, a and b, that share
+// the ID "shared". b has the newer copy.
+func mergeTestSources() [][]*cbiotcore.Device {
+	return [][]*cbiotcore.Device{
+		{mergeTestDevice("only-a", ""), mergeTestDevice("shared", "2024-01-01T00:00:00Z")},
+		{mergeTestDevice("shared", "2024-06-01T00:00:00Z"), mergeTestDevice("only-b", "")},
+	}
+}
+
+func setMergeTestSources(t *testing.T, policy string) {
+	t.Helper()
+	savedArgs, savedSources := Args, mergeSources
+	t.Cleanup(func() { Args, mergeSources = savedArgs, savedSources })
+	Args.collisionPolicy = policy
+	mergeSources = []*MergeSource{{Tag: "a"}, {Tag: "b"}}
+	errorLogger = NewErrorLogger()
+}
+
+func mergedIdsOf(devices []*cbiotcore.Device) []string {
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = device.Id
+	}
+	return ids
+}
+
+func TestMergeSourceDevices(t *testing.T) {
+	tests := []struct {
+		policy      string
+		ids         []string
+		origins     map[string]DeviceOrigin
+		resolutions []string
+	}{
+		{
+			policy: CollisionPolicyPrefix,
+			ids:    []string{"only-a", "a-shared", "b-shared", "only-b"},
+			origins: map[string]DeviceOrigin{
+				"only-a":   {Source: "a", SourceId: "only-a"},
+				"a-shared": {Source: "a", SourceId: "shared"},
+				"b-shared": {Source: "b", SourceId: "shared"},
+				"only-b":   {Source: "b", SourceId: "only-b"},
+			},
+			resolutions: []string{"renamed", "renamed"},
+		},
+		{
+			policy: CollisionPolicyKeepFirst,
+			ids:    []string{"only-a", "shared", "only-b"},
+			origins: map[string]DeviceOrigin{
+				"only-a": {Source: "a", SourceId: "only-a"},
+				"shared": {Source: "a", SourceId: "shared"},
+				"only-b": {Source: "b", SourceId: "only-b"},
+			},
+			resolutions: []string{"kept", "dropped"},
+		},
+		{
+			policy: CollisionPolicyKeepNewest,
+			ids:    []string{"only-a", "shared", "only-b"},
+			origins: map[string]DeviceOrigin{
+				"only-a": {Source: "a", SourceId: "only-a"},
+				"shared": {Source: "b", SourceId: "shared"},
+				"only-b": {Source: "b", SourceId: "only-b"},
+			},
+			resolutions: []string{"dropped", "kept"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setMergeTestSources(t, tt.policy)
+			merged, origins, report, err := mergeSourceDevices(mergeTestSources())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := mergedIdsOf(merged); !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("merged IDs = %v, want %v", ids, tt.ids)
+			}
+			if !reflect.DeepEqual(origins, tt.origins) {
+				t.Errorf("origins = %v, want %v", origins, tt.origins)
+			}
+			var resolutions []string
+			for _, record := range report {
+				if record.DeviceId != "shared" {
+					t.Errorf("report has %s, only shared collides", record.DeviceId)
+				}
+				resolutions = append(resolutions, record.Resolution)
+			}
+			if !reflect.DeepEqual(resolutions, tt.resolutions) {
+				t.Errorf("resolutions = %v, want %v", resolutions, tt.resolutions)
+			}
+		})
+	}
+}
+
+func TestMergeSourceDevicesDroppedIsLogged(t *testing.T) {
+	setMergeTestSources(t, CollisionPolicyKeepFirst)
+	if _, _, _, err := mergeSourceDevices(mergeTestSources()); err != nil {
+		t.Fatal(err)
+	}
+	if len(errorLogger.logs) != 1 || errorLogger.logs[0].Context != collisionContext {
+		t.Errorf("logged %v, want one collision error", errorLogger.logs)
+	}
+}
+
+func TestMergeSourceDevicesErrors(t *testing.T) {
+	t.Run("fail", func(t *testing.T) {
+		setMergeTestSources(t, CollisionPolicyFail)
+		merged, _, report, err := mergeSourceDevices(mergeTestSources())
+		if err == nil || !strings.Contains(err.Error(), "1 device IDs exist in more than one source") {
+			t.Fatalf("err = %v, want a collision error", err)
+		}
+		if merged != nil || len(report) != 2 || report[0].Resolution != "conflict" {
+			t.Errorf("merged %v report %v", merged, report)
+		}
+	})
+
+	t.Run("prefix taken", func(t *testing.T) {
+		setMergeTestSources(t, CollisionPolicyPrefix)
+		sources := mergeTestSources()
+		// a-shared, the prefixed ID of a's shared device, already exists in b.
+		sources[1] = append(sources[1], mergeTestDevice("a-shared", ""))
+		_, _, _, err := mergeSourceDevices(sources)
+		if err == nil || !strings.Contains(err.Error(), "unable to prefix") {
+			t.Fatalf("err = %v, want a prefix error", err)
+		}
+	})
+
+	t.Run("prefix invalid", func(t *testing.T) {
+		setMergeTestSources(t, CollisionPolicyPrefix)
+		mergeSources[0].Tag = "a+"
+		sources := [][]*cbiotcore.Device{
+			{mergeTestDevice(strings.Repeat("x", 254), "")},
+			{mergeTestDevice(strings.Repeat("x", 254), "")},
+		}
+		_, _, _, err := mergeSourceDevices(sources)
+		if err == nil || !strings.Contains(err.Error(), "unable to prefix") {
+			t.Fatalf("err = %v, want a prefix error", err)
+		}
+	})
+}
+
+func TestNewestCandidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		updated []string
+		want    int
+	}{
+		{"newest wins", []string{"2024-01-01T00:00:00Z", "2024-06-01T00:00:00Z", "2024-03-01T00:00:00Z"}, 1},
+		{"tie goes to the earlier source", []string{"2024-01-01T00:00:00Z", "2024-01-01T00:00:00Z"}, 0},
+		{"missing time is oldest", []string{"", "2020-01-01T00:00:00Z"}, 1},
+		{"all missing", []string{"", ""}, 0},
+		{"nanoseconds", []string{"2024-01-01T00:00:00.5Z", "2024-01-01T00:00:00.25Z"}, 0},
+	}
+	for _, tt := range tests {
+		devices := make([]*cbiotcore.Device, len(tt.updated))
+		for i, updated := range tt.updated {
+			devices[i] = mergeTestDevice("d", updated)
+		}
+		got := newestCandidate(len(devices), func(i int) *cbiotcore.Device { return devices[i] })
+		if got != tt.want {
+			t.Errorf("%s: newestCandidate = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergedBoundDevices(t *testing.T) {
+	savedOrigins, savedIds := deviceOrigins, mergedIds
+	t.Cleanup(func() { deviceOrigins, mergedIds = savedOrigins, savedIds })
+	errorLogger = NewErrorLogger()
+
+	setDeviceOrigins(map[string]DeviceOrigin{
+		"a-gateway": {Source: "a", SourceId: "gateway"},
+		"a-shared":  {Source: "a", SourceId: "shared"},
+		"only-a":    {Source: "a", SourceId: "only-a"},
+	})
+	bound := []*cbiotcore.Device{{Id: "shared"}, {Id: "only-a"}, {Id: "dropped"}}
+	got := mergedBoundDevices("a-gateway", bound)
+	if ids := mergedIdsOf(got); !reflect.DeepEqual(ids, []string{"a-shared", "only-a"}) {
+		t.Errorf("bound = %v, want [a-shared only-a]", ids)
+	}
+	if len(errorLogger.logs) != 1 || errorLogger.logs[0].DeviceId != "dropped" {
+		t.Errorf("logged %v, want one error for dropped", errorLogger.logs)
+	}
+
+	// Outside multi-source mode bound devices are returned as they are.
+	unknown := []*cbiotcore.Device{{Id: "x"}}
+	if got := mergedBoundDevices("not-merged", unknown); len(got) != 1 || got[0].Id != "x" {
+		t.Errorf("bound = %v, want [x]", mergedIdsOf(got))
+	}
+}
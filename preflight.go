@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+type preflightStatus string
+
+const (
+	preflightPass preflightStatus = "PASS"
+	preflightWarn preflightStatus = "WARN"
+	preflightFail preflightStatus = "FAIL"
+	preflightSkip preflightStatus = "SKIP"
+
+	// preflightProbeId is used for read-only probes that are expected to 404.
+	preflightProbeId = "cb-migration-preflight-probe"
+	// preflightInvalidProbeId is not a valid device ID, so a create with it is
+	// rejected before anything is written.
+	preflightInvalidProbeId = "0 cb-migration-preflight-probe"
+)
+
+type preflightResult struct {
+	Check  string
+	Status preflightStatus
+	Detail string
+}
+
+type preflightReport struct {
+	results   []preflightResult
+	latencies []time.Duration
+}
+
+func (r *preflightReport) add(check string, status preflightStatus, format string, args ...interface{}) {
+	r.results = append(r.results, preflightResult{
+		Check:  check,
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// probe times a single API call so that the estimate can be based on the
+// latency actually observed from this host.
+func (r *preflightReport) probe(call func() error) error {
+	start := time.Now()
+	err := call()
+	r.latencies = append(r.latencies, time.Since(start))
+	return err
+}
+
+// addProbe records the result of a permission probe. A nil error or one of
+// the accepted status codes means the call was authorized.
+func (r *preflightReport) addProbe(check string, err error, accepted ...int) {
+	if err == nil {
+		r.add(check, preflightPass, "permitted")
+		return
+	}
+	for _, code := range accepted {
+		if hasHTTPStatus(err, code) {
+			r.add(check, preflightPass, "permitted (probe returned %d)", code)
+			return
+		}
+	}
+	if hasHTTPStatus(err, http.StatusUnauthorized) || hasHTTPStatus(err, http.StatusForbidden) {
+		r.add(check, preflightFail, "permission denied: %s", err)
+		return
+	}
+	r.add(check, preflightWarn, "inconclusive: %s", err)
+}
+
+func (r *preflightReport) failed() bool {
+	for _, result := range r.results {
+		if result.Status == preflightFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *preflightReport) averageLatency() time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, l := range r.latencies {
+		total += l
+	}
+	return total / time.Duration(len(r.latencies))
+}
+
+func (r *preflightReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+	for _, result := range r.results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Check, result.Status, result.Detail)
+	}
+	w.Flush()
+}
+
+// runPreflight validates credentials, registries, permissions and the devices
+// CSV without writing anything to either registry. It returns false if any
+// check failed.
+func runPreflight() bool {
+	printfColored(colorCyan, "================= Running Preflight Checks =================\nRunning Version: %s\n", cbIotCoreMigrationVersion)
+	report := &preflightReport{}
+
+	if Args.cbRegistryRegion == "" {
+		Args.cbRegistryRegion = Args.cbSourceRegion
+	}
+
+	sourceService := preflightEndpoint(report, "source", &sourceEndpoint, Args.cbSourceServiceAccount, Args.cbSourceRegistryName, Args.cbSourceRegion)
+	destinationService := preflightEndpoint(report, "destination", &destinationEndpoint, Args.cbServiceAccount, Args.cbRegistryName, Args.cbRegistryRegion)
+
+	var sourceIds, gatewayIds []string
+	if sourceService != nil {
+		sourceIds, gatewayIds = preflightSourceProbes(report, sourceService)
+	}
+
+	csvIds := preflightDevicesCsv(report)
+	if csvIds != nil {
+		sourceIds = csvIds
+	}
+
+	var existingIds map[string]struct{}
+	if destinationService != nil {
+		existingIds = preflightDestinationProbes(report, destinationService)
+	}
+
+	if sourceIds != nil && existingIds != nil {
+		conflicts := 0
+		for _, id := range sourceIds {
+			if _, ok := existingIds[id]; ok {
+				conflicts++
+			}
+		}
+		if conflicts > 0 {
+			report.add("destination ID conflicts", preflightWarn, "%d of %d devices already exist on the destination and will be patched", conflicts, len(sourceIds))
+		} else {
+			report.add("destination ID conflicts", preflightPass, "none of %d devices exist on the destination", len(sourceIds))
+		}
+	}
+
+	fmt.Println()
+	report.print()
+	fmt.Println()
+
+	if sourceIds != nil {
+		printPreflightEstimate(report, len(sourceIds), len(gatewayIds), len(existingIds))
+	}
+
+	if report.failed() {
+		printfColored(colorRed, "\u2715 Preflight failed")
+		return false
+	}
+	printfColored(colorGreen, "\u2713 Preflight passed")
+	return true
+}
+
+func preflightEndpoint(report *preflightReport, label string, endpoint **ClearBladeEndpoint, serviceAccount, registryName, region string) *cbiotcore.Service {
+	check := label + " flags"
+	var missing []string
+	if serviceAccount == "" {
+		missing = append(missing, "service account")
+	}
+	if registryName == "" {
+		missing = append(missing, "registry name")
+	}
+	if region == "" {
+		missing = append(missing, "region")
+	}
+	if len(missing) > 0 {
+		report.add(check, preflightFail, "missing %s", strings.Join(missing, ", "))
+		return nil
+	}
+	report.add(check, preflightPass, "registry %s (region: %s)", registryName, region)
+
+	check = label + " service account"
+	e, err := NewClearBladeEndpoint(serviceAccount, registryName, region)
+	if err != nil {
+		report.add(check, preflightFail, "%s", err)
+		return nil
+	}
+	*endpoint = e
+
+	service, err := e.NewService()
+	if err != nil {
+		report.add(check, preflightFail, "%s", err)
+		return nil
+	}
+	report.add(check, preflightPass, "project %s at %s", e.Credentials.Project, e.Credentials.Url)
+
+	check = label + " registry"
+	if err := report.probe(func() error { return verifyRegistryDetails(service, registryName, region) }); err != nil {
+		report.add(check, preflightFail, "%s", err)
+		return nil
+	}
+	report.add(check, preflightPass, "registry credentials resolved")
+
+	return service
+}
+
+// preflightSourceProbes checks list and get permissions on the source and,
+// when no CSV is supplied, lists the registry to size the migration.
+func preflightSourceProbes(report *preflightReport, service *cbiotcore.Service) ([]string, []string) {
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+
+	var firstPage *cbiotcore.ListDevicesResponse
+	err := report.probe(func() error {
+		var err error
+		firstPage, err = deviceService.List(getCBSourceRegistryPath()).PageSize(1).Do()
+		return err
+	})
+	report.addProbe("source list devices", err)
+	if err != nil {
+		return nil, nil
+	}
+
+	if len(firstPage.Devices) == 0 {
+		report.add("source get device", preflightWarn, "source registry is empty")
+	} else {
+		err = report.probe(func() error {
+			_, err := deviceService.Get(getCBSourceDevicePath(firstPage.Devices[0].Id)).Do()
+			return err
+		})
+		report.addProbe("source get device", err)
+	}
+
+	err = report.probe(func() error {
+		_, err := deviceService.ConfigVersions.List(getCBSourceDevicePath(preflightProbeId)).Do()
+		return err
+	})
+	report.addProbe("source list config versions", err, http.StatusNotFound)
+
+	var gatewayIds []string
+	gateways, err := paginatedFetch(deviceService.List(getCBSourceRegistryPath()).GatewayListOptionsGatewayType("GATEWAY").PageSize(Args.pageSize), "Counting gateways in source registry...")
+	if err != nil {
+		report.add("source gateways", preflightWarn, "unable to list gateways: %s", err)
+	} else {
+		for _, gateway := range gateways {
+			gatewayIds = append(gatewayIds, gateway.Id)
+		}
+		report.add("source gateways", preflightPass, "%d gateways", len(gatewayIds))
+	}
+
+	if Args.devicesCsvFile != "" {
+		return nil, gatewayIds
+	}
+
+	devices, err := paginatedFetch(deviceService.List(getCBSourceRegistryPath()).PageSize(Args.pageSize), "Counting devices in source registry...")
+	if err != nil {
+		report.add("source devices", preflightWarn, "unable to list devices: %s", err)
+		return nil, gatewayIds
+	}
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.Id)
+	}
+	report.add("source devices", preflightPass, "%d devices", len(ids))
+	return ids, gatewayIds
+}
+
+// preflightDestinationProbes checks list, get, create and bind permissions on
+// the destination. Create and bind are probed with requests that cannot
+// succeed (an invalid ID or unknown devices), so nothing is written. A
+// rejected create does not prove the permission, so that check can only warn.
+func preflightDestinationProbes(report *preflightReport, service *cbiotcore.Service) map[string]struct{} {
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+	registryService := cbiotcore.NewProjectsLocationsRegistriesService(service)
+
+	err := report.probe(func() error {
+		_, err := deviceService.List(getCBRegistryPath()).PageSize(1).Do()
+		return err
+	})
+	report.addProbe("destination list devices", err)
+	if err != nil {
+		return nil
+	}
+
+	err = report.probe(func() error {
+		_, err := deviceService.Get(getCBDevicePath(preflightProbeId)).Do()
+		return err
+	})
+	report.addProbe("destination get device", err, http.StatusNotFound)
+
+	existing, err := paginatedFetch(deviceService.List(getCBRegistryPath()).PageSize(Args.pageSize), "Listing devices in destination registry...")
+	if err != nil {
+		report.add("destination devices", preflightWarn, "unable to list devices: %s", err)
+		return nil
+	}
+	existingIds := make(map[string]struct{}, len(existing))
+	for _, device := range existing {
+		existingIds[device.Id] = struct{}{}
+	}
+	report.add("destination devices", preflightPass, "%d existing devices", len(existingIds))
+
+	err = report.probe(func() error {
+		_, err := deviceService.Create(getCBRegistryPath(), &cbiotcore.Device{Id: preflightInvalidProbeId}).Do()
+		return err
+	})
+	// A 400 only shows the request was rejected as invalid, which the server
+	// may do before checking permissions, so it does not prove create access.
+	switch {
+	case err == nil:
+		report.add("destination create device", preflightWarn, "a device with the invalid ID %q was created, delete it from the destination registry", preflightInvalidProbeId)
+	case hasHTTPStatus(err, http.StatusBadRequest):
+		report.add("destination create device", preflightWarn, "inconclusive: the probe was rejected as invalid (400), create permission cannot be verified without writing a device")
+	default:
+		report.addProbe("destination create device", err)
+	}
+
+	err = report.probe(func() error {
+		_, err := registryService.BindDeviceToGateway(getCBRegistryPath(), &cbiotcore.BindDeviceToGatewayRequest{
+			DeviceId:  preflightProbeId,
+			GatewayId: preflightProbeId + "-gateway",
+		}).Do()
+		return err
+	})
+	report.addProbe("destination bind device", err, http.StatusNotFound, http.StatusBadRequest)
+
+	return existingIds
+}
+
+// preflightDevicesCsv validates the devices CSV, if one was supplied, and
+// returns the device IDs it contains.
+func preflightDevicesCsv(report *preflightReport) []string {
+	if Args.devicesCsvFile == "" {
+		report.add("devices CSV", preflightSkip, "no -devicesCsv supplied, all devices will be migrated")
+		return nil
+	}
+
+	rows, err := readCsvFile(Args.devicesCsvFile)
+	if err != nil {
+		report.add("devices CSV", preflightFail, "%s", err)
+		return nil
+	}
+	ids, err := parseDeviceIds(rows)
+	if err != nil {
+		report.add("devices CSV", preflightFail, "%s", err)
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(ids))
+	var empty, duplicates, invalid int
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		switch {
+		case id == "":
+			empty++
+			continue
+		case !isValidDeviceId(id):
+			invalid++
+		}
+		if _, ok := seen[id]; ok {
+			duplicates++
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	switch {
+	case len(unique) == 0:
+		report.add("devices CSV", preflightFail, "no device IDs found")
+	case invalid > 0:
+		report.add("devices CSV", preflightFail, "%d device IDs, %d invalid, %d duplicate, %d empty", len(unique), invalid, duplicates, empty)
+	case duplicates > 0 || empty > 0:
+		report.add("devices CSV", preflightWarn, "%d device IDs, %d duplicate, %d empty", len(unique), duplicates, empty)
+	default:
+		report.add("devices CSV", preflightPass, "%d device IDs", len(unique))
+	}
+	return unique
+}
+
+// printPreflightEstimate prints the number of API calls each phase will make
+// and a duration estimate based on the observed probe latency and
+// -workerPoolSize.
+func printPreflightEstimate(report *preflightReport, devices, gateways, existing int) {
+	pages := func(n int) int {
+		return int(math.Ceil(float64(n) / float64(max(Args.pageSize, 1))))
+	}
+
+	type phase struct {
+		name     string
+		calls    int
+		parallel bool
+	}
+
+	var phases []phase
+	if Args.devicesCsvFile != "" {
+		phases = append(phases, phase{"fetch devices", devices, true})
+	} else {
+		phases = append(phases, phase{"fetch devices", max(pages(devices), 1), false})
+	}
+	if Args.configHistory {
+		phases = append(phases, phase{"fetch config history", devices, true})
+	}
+	phases = append(phases, phase{"fetch gateway bindings", gateways, true})
+
+	// Conflicting creates are followed by a patch and, unless skipped, a config update.
+	conflicts := min(existing, devices)
+	retries := conflicts
+	if !Args.skipConfig {
+		retries += conflicts
+	}
+	phases = append(phases, phase{"create devices", devices + retries, true})
+	if Args.configHistory {
+		phases = append(phases, phase{"upload config history", 1, false})
+	}
+	// Each gateway lists its destination bindings; bound devices are fetched
+	// and bound individually, which is at most one get and one bind per device.
+	phases = append(phases, phase{"bind gateways", gateways, true})
+
+	latency := report.averageLatency()
+	workers := max(Args.workerPoolSize, 1)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tAPI CALLS\tESTIMATED DURATION")
+	var totalCalls int
+	var totalDuration time.Duration
+	for _, p := range phases {
+		d := time.Duration(p.calls) * latency
+		if p.parallel {
+			d /= time.Duration(workers)
+		}
+		totalCalls += p.calls
+		totalDuration += d
+		fmt.Fprintf(w, "%s\t%d\t%s\n", p.name, p.calls, d.Round(time.Second))
+	}
+	fmt.Fprintf(w, "total\t%d\t%s\n", totalCalls, totalDuration.Round(time.Second))
+	w.Flush()
+
+	printfColored(colorCyan, "Estimate assumes %s per call (average of %d probes) and %d workers. Gateway binding adds up to two calls per bound device.\n",
+		latency.Round(time.Millisecond), len(report.latencies), workers)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+type CredentialStatus string
+
+const (
+	CredentialOK             CredentialStatus = "ok"
+	CredentialMalformed      CredentialStatus = "malformed"
+	CredentialFormatMismatch CredentialStatus = "format_mismatch"
+	CredentialCertExpired    CredentialStatus = "certificate_expired"
+	CredentialCertExpiring   CredentialStatus = "certificate_expiring"
+	CredentialCertNotYet     CredentialStatus = "certificate_not_yet_valid"
+	CredentialExpired        CredentialStatus = "credential_expired"
+)
+
+type CredentialHealth struct {
+	DeviceId string
+	Index    int
+	Format   string
+	Status   CredentialStatus
+	Detail   string
+	NotAfter string
+}
+
+// parsedCredential is a device public key decoded according to its declared
+// format. Certificate is only set for *_X509_PEM formats.
+type parsedCredential struct {
+	PublicKey   interface{}
+	Certificate *x509.Certificate
+}
+
+// parsePublicKeyCredential decodes key and checks that it matches format,
+// returning a CredentialStatus describing why it does not.
+func parsePublicKeyCredential(format, key string) (*parsedCredential, CredentialStatus, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, CredentialMalformed, errors.New("no PEM block found")
+	}
+
+	isX509 := strings.HasSuffix(format, "_X509_PEM")
+	parsed := &parsedCredential{}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		if !isX509 {
+			return nil, CredentialFormatMismatch, fmt.Errorf("certificate supplied for %s", format)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, CredentialMalformed, fmt.Errorf("invalid certificate: %w", err)
+		}
+		parsed.Certificate = cert
+		parsed.PublicKey = cert.PublicKey
+	case "PUBLIC KEY":
+		if isX509 {
+			return nil, CredentialFormatMismatch, fmt.Errorf("bare public key supplied for %s", format)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, CredentialMalformed, fmt.Errorf("invalid public key: %w", err)
+		}
+		parsed.PublicKey = pub
+	case "RSA PUBLIC KEY":
+		if isX509 {
+			return nil, CredentialFormatMismatch, fmt.Errorf("bare public key supplied for %s", format)
+		}
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, CredentialMalformed, fmt.Errorf("invalid RSA public key: %w", err)
+		}
+		parsed.PublicKey = pub
+	default:
+		return nil, CredentialMalformed, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+
+	switch format {
+	case "RSA_PEM", "RSA_X509_PEM":
+		if _, ok := parsed.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, CredentialFormatMismatch, fmt.Errorf("%s declared but key is %T", format, parsed.PublicKey)
+		}
+	case "ES256_PEM", "ES256_X509_PEM":
+		ecKey, ok := parsed.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, CredentialFormatMismatch, fmt.Errorf("%s declared but key is %T", format, parsed.PublicKey)
+		}
+		if ecKey.Curve != elliptic.P256() {
+			return nil, CredentialFormatMismatch, fmt.Errorf("%s declared but key uses curve %s", format, ecKey.Curve.Params().Name)
+		}
+	default:
+		return nil, CredentialFormatMismatch, fmt.Errorf("unsupported format %q", format)
+	}
+
+	return parsed, CredentialOK, nil
+}
+
+// credentialExpired reports whether a credential's ExpirationTime has passed.
+// IoT Core uses the Unix epoch to mean "never expires".
+func credentialExpired(cred *cbiotcore.DeviceCredential, now time.Time) bool {
+	if cred.ExpirationTime == "" {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339Nano, cred.ExpirationTime)
+	if err != nil || expiry.Unix() <= 0 {
+		return false
+	}
+	return now.After(expiry)
+}
+
+func checkDeviceCredentials(device *cbiotcore.Device, now time.Time) []CredentialHealth {
+	warnBefore := now.Add(time.Duration(Args.certExpiryWarningDays) * 24 * time.Hour)
+
+	results := make([]CredentialHealth, 0, len(device.Credentials))
+	for i, cred := range device.Credentials {
+		health := CredentialHealth{DeviceId: device.Id, Index: i, Status: CredentialOK}
+		if cred.PublicKey == nil {
+			health.Status = CredentialMalformed
+			health.Detail = "no public key"
+			results = append(results, health)
+			continue
+		}
+		health.Format = cred.PublicKey.Format
+
+		parsed, status, err := parsePublicKeyCredential(cred.PublicKey.Format, cred.PublicKey.Key)
+		switch {
+		case err != nil:
+			health.Status = status
+			health.Detail = err.Error()
+		case parsed.Certificate != nil:
+			cert := parsed.Certificate
+			health.NotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+			switch {
+			case now.After(cert.NotAfter):
+				health.Status = CredentialCertExpired
+				health.Detail = fmt.Sprintf("certificate %q expired", cert.Subject.String())
+			case now.Before(cert.NotBefore):
+				health.Status = CredentialCertNotYet
+				health.Detail = fmt.Sprintf("certificate valid from %s", cert.NotBefore.UTC().Format(time.RFC3339))
+			case warnBefore.After(cert.NotAfter):
+				health.Status = CredentialCertExpiring
+				health.Detail = fmt.Sprintf("certificate expires within %d days", Args.certExpiryWarningDays)
+			}
+		}
+
+		// An expired credential takes precedence over certificate validity.
+		if err == nil && credentialExpired(cred, now) {
+			health.Status = CredentialExpired
+			health.Detail = fmt.Sprintf("expirationTime %s has passed", cred.ExpirationTime)
+		}
+
+		results = append(results, health)
+	}
+	return results
+}
+
+// checkCredentialHealth parses every device credential against its declared
+// format, prints a summary and writes the full credential health report to
+// the work directory.
+func checkCredentialHealth(devices []*cbiotcore.Device) {
+	if !Args.updatePublicKeys {
+		return
+	}
+
+	printfColored(colorGreen, "\u2713 Checking device credential health")
+	now := time.Now()
+
+	var report []CredentialHealth
+	counts := make(map[CredentialStatus]int)
+	for _, device := range devices {
+		for _, health := range checkDeviceCredentials(device, now) {
+			report = append(report, health)
+			counts[health.Status]++
+		}
+	}
+
+	if len(report) == 0 {
+		printfColored(colorGreen, " \u2713 No device credentials to check")
+		return
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		color := colorYellow
+		if CredentialStatus(status) == CredentialOK {
+			color = colorGreen
+		}
+		printfColored(color, "   %s: %d", status, counts[CredentialStatus(status)])
+	}
+	if Args.dropExpiredCredentials && counts[CredentialExpired] > 0 {
+		printfColored(colorYellow, " Dropping %d credentials whose expirationTime has passed", counts[CredentialExpired])
+	}
+
+	reportFile := filepath.Join(Args.workDir, "credential_health.csv")
+	if err := writeCredentialHealthReport(reportFile, report); err != nil {
+		log.Printf("Unable to write credential health report: %s\n", err)
+		return
+	}
+	printfColored(colorGreen, " \u2713 Credential health report written to %s", reportFile)
+}
+
+func writeCredentialHealthReport(path string, report []CredentialHealth) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "credentialIndex", "format", "status", "notAfter", "detail"}); err != nil {
+		return err
+	}
+	for _, h := range report {
+		if err := w.Write([]string{h.DeviceId, strconv.Itoa(h.Index), h.Format, string(h.Status), h.NotAfter, h.Detail}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	CACheckOff  = "off"
+	CACheckLog  = "log"
+	CACheckSkip = "skip"
+
+	caVerificationContext = "Registry CA Verification"
+)
+
+type CAVerificationResult struct {
+	DeviceId string
+	Index    int
+	Subject  string
+	Issuer   string
+	Verified bool
+	Detail   string
+}
+
+// fetchRegistryCACertificates returns the CA certificates configured on the
+// destination registry. An empty result means the registry accepts device
+// certificates from any issuer.
+func fetchRegistryCACertificates(service *cbiotcore.Service) ([]*x509.Certificate, error) {
+	registryService := cbiotcore.NewProjectsLocationsRegistriesService(service)
+	registry, err := registryService.Get(getCBRegistryPath()).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*x509.Certificate
+	for i, cred := range registry.Credentials {
+		if cred.PublicKeyCertificate == nil || cred.PublicKeyCertificate.Certificate == "" {
+			continue
+		}
+		block, _ := pem.Decode([]byte(cred.PublicKeyCertificate.Certificate))
+		if block == nil {
+			return nil, fmt.Errorf("registry credential %d is not a PEM certificate", i)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("registry credential %d: %w", i, err)
+		}
+		cas = append(cas, cert)
+	}
+	return cas, nil
+}
+
+// verifyDeviceAgainstCAs checks that every X.509 credential of the device
+// chains to one of the registry CA certificates. Credentials that
+// -dropExpiredCredentials leaves out of the migration are not checked.
+func verifyDeviceAgainstCAs(device *cbiotcore.Device, cas []*x509.Certificate) []CAVerificationResult {
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+
+	now := time.Now()
+	var results []CAVerificationResult
+	for i, cred := range device.Credentials {
+		if cred.PublicKey == nil || !strings.HasSuffix(cred.PublicKey.Format, "_X509_PEM") {
+			continue
+		}
+		if Args.dropExpiredCredentials && credentialExpired(cred, now) {
+			continue
+		}
+		result := CAVerificationResult{DeviceId: device.Id, Index: i}
+
+		parsed, _, err := parsePublicKeyCredential(cred.PublicKey.Format, cred.PublicKey.Key)
+		if err != nil {
+			result.Detail = err.Error()
+			results = append(results, result)
+			continue
+		}
+		cert := parsed.Certificate
+		result.Subject = cert.Subject.String()
+		result.Issuer = cert.Issuer.String()
+
+		// The chain is checked at a time within the certificate's own validity
+		// period; expiry is covered by the credential health report.
+		at := now
+		if at.Before(cert.NotBefore) {
+			at = cert.NotBefore
+		} else if at.After(cert.NotAfter) {
+			at = cert.NotAfter
+		}
+		chains, err := cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: at,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			result.Verified = true
+			result.Detail = fmt.Sprintf("signed by %s", chains[0][len(chains[0])-1].Subject.String())
+		} else {
+			result.Detail = fmt.Sprintf("not signed by any of the %d registry CA certificates: %s", len(cas), err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// verifyDevicesAgainstRegistryCAs checks every X.509 device credential against
+// the destination registry's CA certificates and writes the results to the
+// work directory. It returns the IDs of devices that failed verification.
+func verifyDevicesAgainstRegistryCAs(service *cbiotcore.Service, devices []*cbiotcore.Device) map[string]struct{} {
+	if Args.registryCACheck == CACheckOff {
+		return nil
+	}
+
+	printfColored(colorGreen, "\u2713 Verifying device certificates against destination registry CA certificates")
+	cas, err := fetchRegistryCACertificates(service)
+	if err != nil {
+		log.Fatalf("Unable to fetch destination registry CA certificates: %s\n", err)
+	}
+	if len(cas) == 0 {
+		printfColored(colorGreen, " \u2713 Destination registry has no CA certificates configured, skipping verification")
+		return nil
+	}
+
+	var report []CAVerificationResult
+	failed := make(map[string]struct{})
+	for _, device := range devices {
+		for _, result := range verifyDeviceAgainstCAs(device, cas) {
+			report = append(report, result)
+			if !result.Verified {
+				failed[device.Id] = struct{}{}
+				errorLogger.AddError(caVerificationContext, device.Id, errors.New(result.Detail))
+			}
+		}
+	}
+
+	reportFile := filepath.Join(Args.workDir, "ca_verification.csv")
+	if err := writeCAVerificationReport(reportFile, report); err != nil {
+		log.Printf("Unable to write CA verification report: %s\n", err)
+	} else {
+		printfColored(colorGreen, " \u2713 CA verification report written to %s", reportFile)
+	}
+
+	if len(failed) == 0 {
+		printfColored(colorGreen, " \u2713 All %d X.509 device credentials are signed by a registry CA", len(report))
+		return nil
+	}
+
+	if Args.registryCACheck == CACheckSkip {
+		printfColored(colorYellow, " Skipping %d devices with certificates not signed by a registry CA", len(failed))
+		return failed
+	}
+	printfColored(colorYellow, " %d devices have certificates not signed by a registry CA and may be rejected", len(failed))
+	return nil
+}
+
+func writeCAVerificationReport(path string, report []CAVerificationResult) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "credentialIndex", "subject", "issuer", "verified", "detail"}); err != nil {
+		return err
+	}
+	for _, r := range report {
+		if err := w.Write([]string{r.DeviceId, strconv.Itoa(r.Index), r.Subject, r.Issuer, strconv.FormatBool(r.Verified), r.Detail}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// excludeDevices removes the given device IDs from every migration input so
+// that later phases do not recreate them, e.g. as bound devices of a gateway.
+func excludeDevices(excluded map[string]struct{}, devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) ([]*cbiotcore.Device, map[string]interface{}, map[string][]*cbiotcore.Device) {
+	if len(excluded) == 0 {
+		return devices, deviceConfigs, gatewayBindings
+	}
+
+	keep := func(list []*cbiotcore.Device) []*cbiotcore.Device {
+		kept := make([]*cbiotcore.Device, 0, len(list))
+		for _, device := range list {
+			if _, ok := excluded[device.Id]; !ok {
+				kept = append(kept, device)
+			}
+		}
+		return kept
+	}
+
+	var configs map[string]interface{}
+	if deviceConfigs != nil {
+		configs = make(map[string]interface{}, len(deviceConfigs))
+		for id, config := range deviceConfigs {
+			if _, ok := excluded[id]; !ok {
+				configs[id] = config
+			}
+		}
+	}
+
+	var bindings map[string][]*cbiotcore.Device
+	if gatewayBindings != nil {
+		bindings = make(map[string][]*cbiotcore.Device, len(gatewayBindings))
+		for gatewayId, bound := range gatewayBindings {
+			if _, ok := excluded[gatewayId]; !ok {
+				bindings[gatewayId] = keep(bound)
+			}
+		}
+	}
+
+	return keep(devices), configs, bindings
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate signed by parent, or a self-signed CA when
+// parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, notBefore, notAfter time.Time) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func x509Credential(cert *testCert, expirationTime string) *cbiotcore.DeviceCredential {
+	return &cbiotcore.DeviceCredential{
+		ExpirationTime: expirationTime,
+		PublicKey: &cbiotcore.PublicKeyCredential{
+			Format: "ES256_X509_PEM",
+			Key:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.cert.Raw})),
+		},
+	}
+}
+
+func TestVerifyDeviceAgainstCAs(t *testing.T) {
+	saved := Args
+	t.Cleanup(func() { Args = saved })
+
+	now := time.Now()
+	root := newTestCert(t, "root", nil, true, now.Add(-48*time.Hour), now.Add(48*time.Hour))
+	intermediate := newTestCert(t, "intermediate", root, true, now.Add(-48*time.Hour), now.Add(48*time.Hour))
+	other := newTestCert(t, "other", nil, true, now.Add(-48*time.Hour), now.Add(48*time.Hour))
+
+	direct := newTestCert(t, "direct", root, false, now.Add(-time.Hour), now.Add(time.Hour))
+	viaIntermediate := newTestCert(t, "via-intermediate", intermediate, false, now.Add(-time.Hour), now.Add(time.Hour))
+	expired := newTestCert(t, "expired", root, false, now.Add(-3*time.Hour), now.Add(-2*time.Hour))
+	untrusted := newTestCert(t, "untrusted", other, false, now.Add(-time.Hour), now.Add(time.Hour))
+
+	past := now.Add(-time.Hour).Format(time.RFC3339Nano)
+	device := &cbiotcore.Device{Id: "device-1", Credentials: []*cbiotcore.DeviceCredential{
+		x509Credential(direct, ""),
+		x509Credential(viaIntermediate, ""),
+		x509Credential(expired, ""),
+		x509Credential(untrusted, past),
+	}}
+
+	tests := []struct {
+		name                   string
+		cas                    []*x509.Certificate
+		dropExpiredCredentials bool
+		want                   map[int]bool
+	}{
+		{"root only", []*x509.Certificate{root.cert}, false, map[int]bool{0: true, 1: false, 2: true, 3: false}},
+		{"root and intermediate", []*x509.Certificate{root.cert, intermediate.cert}, false, map[int]bool{0: true, 1: true, 2: true, 3: false}},
+		{"intermediate only", []*x509.Certificate{intermediate.cert}, false, map[int]bool{0: false, 1: true, 2: false, 3: false}},
+		{"dropped credentials", []*x509.Certificate{root.cert}, true, map[int]bool{0: true, 1: false, 2: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Args.dropExpiredCredentials = tt.dropExpiredCredentials
+			got := make(map[int]bool)
+			for _, result := range verifyDeviceAgainstCAs(device, tt.cas) {
+				got[result.Index] = result.Verified
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("verified %v, want %v", got, tt.want)
+			}
+			for index, want := range tt.want {
+				if verified, ok := got[index]; !ok || verified != want {
+					t.Errorf("credential %d verified = %v (checked %v), want %v", index, verified, ok, want)
+				}
+			}
+		})
+	}
+}
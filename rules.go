@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const rulesContext = "Migration Rules"
+
+var migrationRules *RuleSet
+
+// RuleSet holds the device selection and rewrite rules loaded from
+// -rulesFile. The file format is:
+//
+//	{
+//	  "filter": "metadata.fleet in ['A', 'B']",
+//	  "rewrites": [
+//	    {
+//	      "when": "metadata.env == 'staging'",
+//	      "setMetadata": {"migratedFrom": "'us-central1'", "fleet": "upper(metadata.fleet)"},
+//	      "deleteMetadata": ["legacyId"],
+//	      "logLevel": "DEBUG",
+//	      "blocked": false
+//	    }
+//	  ]
+//	}
+//
+// Conditions and metadata values are expressions (see expr.go) evaluated
+// against the source device. Rewrites are applied in order, and evaluated
+// once per device of the migration (see Prepare).
+type RuleSet struct {
+	Filter   *Expr
+	Rewrites []*RewriteRule
+
+	mutex   sync.Mutex
+	results map[string]*rewriteResult
+}
+
+type RewriteRule struct {
+	When           *Expr
+	SetMetadata    map[string]*Expr
+	DeleteMetadata []string
+	LogLevel       string
+	Blocked        *bool
+}
+
+type ruleSetFile struct {
+	Filter   string            `json:"filter"`
+	Rewrites []rewriteRuleFile `json:"rewrites"`
+}
+
+type rewriteRuleFile struct {
+	When           string            `json:"when"`
+	SetMetadata    map[string]string `json:"setMetadata"`
+	DeleteMetadata []string          `json:"deleteMetadata"`
+	LogLevel       string            `json:"logLevel"`
+	Blocked        *bool             `json:"blocked"`
+}
+
+var validLogLevels = map[string]struct{}{
+	"NONE":  {},
+	"ERROR": {},
+	"INFO":  {},
+	"DEBUG": {},
+}
+
+func LoadRuleSet(path string) (*RuleSet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	var file ruleSetFile
+	decoder := json.NewDecoder(strings.NewReader(string(content)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %w", path, err)
+	}
+
+	rules := &RuleSet{}
+	if file.Filter != "" {
+		if rules.Filter, err = CompileExpr(file.Filter); err != nil {
+			return nil, fmt.Errorf("filter: %w", err)
+		}
+	}
+
+	for i, r := range file.Rewrites {
+		rewrite := &RewriteRule{
+			SetMetadata:    make(map[string]*Expr, len(r.SetMetadata)),
+			DeleteMetadata: r.DeleteMetadata,
+			LogLevel:       strings.ToUpper(r.LogLevel),
+			Blocked:        r.Blocked,
+		}
+		if r.When != "" {
+			if rewrite.When, err = CompileExpr(r.When); err != nil {
+				return nil, fmt.Errorf("rewrites[%d].when: %w", i, err)
+			}
+		}
+		for key, src := range r.SetMetadata {
+			if !metadataKeyPattern.MatchString(key) {
+				return nil, fmt.Errorf("rewrites[%d].setMetadata: invalid metadata key %q", i, key)
+			}
+			if rewrite.SetMetadata[key], err = CompileExpr(src); err != nil {
+				return nil, fmt.Errorf("rewrites[%d].setMetadata.%s: %w", i, key, err)
+			}
+		}
+		if rewrite.LogLevel != "" {
+			if _, ok := validLogLevels[rewrite.LogLevel]; !ok {
+				return nil, fmt.Errorf("rewrites[%d].logLevel: invalid log level %q", i, r.LogLevel)
+			}
+		}
+		rules.Rewrites = append(rules.Rewrites, rewrite)
+	}
+
+	return rules, nil
+}
+
+// Selects reports whether the filter expression selects the device. A rule set
+// without a filter selects every device.
+func (rs *RuleSet) Selects(device *cbiotcore.Device) (bool, error) {
+	if rs == nil || rs.Filter == nil {
+		return true, nil
+	}
+	return rs.Filter.EvalBool(device)
+}
+
+// Apply applies the rewrite rules to target, the transformed copy of source.
+// The metadata map is copied before it is modified so the source device is
+// never changed. If any rule fails, target is left unchanged.
+func (rs *RuleSet) Apply(source, target *cbiotcore.Device) error {
+	if !rs.hasRewrites() {
+		return nil
+	}
+	result := rs.rewrite(source)
+	if result.err != nil {
+		return result.err
+	}
+	result.applyTo(target)
+	return nil
+}
+
+func (rs *RuleSet) hasRewrites() bool {
+	return rs != nil && len(rs.Rewrites) > 0
+}
+
+// rewriteResult is the outcome of the rewrite rules for one device. It only
+// holds the changes, which are applied on top of the target metadata, so a
+// copy truncated by -validationPolicy keeps its truncation.
+type rewriteResult struct {
+	setMetadata    map[string]string
+	deleteMetadata map[string]struct{}
+	logLevel       string
+	blocked        *bool
+	err            error
+}
+
+func (r *rewriteResult) applyTo(target *cbiotcore.Device) {
+	metadata := make(map[string]string, len(target.Metadata)+len(r.setMetadata))
+	for k, v := range target.Metadata {
+		if _, ok := r.deleteMetadata[k]; !ok {
+			metadata[k] = v
+		}
+	}
+	for k, v := range r.setMetadata {
+		metadata[k] = v
+	}
+	target.Metadata = metadata
+	if r.logLevel != "" {
+		target.LogLevel = r.logLevel
+	}
+	if r.blocked != nil {
+		target.Blocked = *r.blocked
+	}
+}
+
+func (r *rewriteResult) set(key, value string) {
+	if r.setMetadata == nil {
+		r.setMetadata = make(map[string]string)
+	}
+	r.setMetadata[key] = value
+	delete(r.deleteMetadata, key)
+}
+
+func (r *rewriteResult) delete(key string) {
+	if r.deleteMetadata == nil {
+		r.deleteMetadata = make(map[string]struct{})
+	}
+	r.deleteMetadata[key] = struct{}{}
+	delete(r.setMetadata, key)
+}
+
+func (rs *RuleSet) rewrite(source *cbiotcore.Device) *rewriteResult {
+	result := &rewriteResult{}
+	var errs []error
+	for i, rewrite := range rs.Rewrites {
+		if rewrite.When != nil {
+			match, err := rewrite.When.EvalBool(source)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rewrites[%d].when: %w", i, err))
+				continue
+			}
+			if !match {
+				continue
+			}
+		}
+
+		for _, key := range rewrite.DeleteMetadata {
+			result.delete(key)
+		}
+		for key, valueExpr := range rewrite.SetMetadata {
+			value, err := valueExpr.Eval(source)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rewrites[%d].setMetadata.%s: %w", i, key, err))
+				continue
+			}
+			if value == nil {
+				result.delete(key)
+				continue
+			}
+			result.set(key, exprValueString(value))
+		}
+		if rewrite.LogLevel != "" {
+			result.logLevel = rewrite.LogLevel
+		}
+		if rewrite.Blocked != nil {
+			result.blocked = rewrite.Blocked
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return &rewriteResult{err: err}
+	}
+	return result
+}
+
+// Prepare evaluates the rewrite rules for a device of the migration, once per
+// device ID, and logs them if they fail. transform then reuses the result,
+// so a failing device is reported once and never written with only some of
+// its rewrites applied.
+func (rs *RuleSet) Prepare(device *cbiotcore.Device) error {
+	if !rs.hasRewrites() {
+		return nil
+	}
+	return rs.prepared(device).err
+}
+
+// ApplyPrepared applies the prepared rewrite result of source to target,
+// preparing it first if needed.
+func (rs *RuleSet) ApplyPrepared(source, target *cbiotcore.Device) error {
+	if !rs.hasRewrites() {
+		return nil
+	}
+	result := rs.prepared(source)
+	if result.err != nil {
+		return result.err
+	}
+	result.applyTo(target)
+	if Args.streaming {
+		// A streaming migration transforms each device once, so the result
+		// is not needed again and memory does not grow with the registry.
+		rs.Forget(source.Id)
+	}
+	return nil
+}
+
+// Forget drops the prepared result of a device that will not be transformed
+// again. Failures are kept, so that they are still reported once.
+func (rs *RuleSet) Forget(deviceId string) {
+	if !rs.hasRewrites() {
+		return
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if result, ok := rs.results[deviceId]; ok && result.err == nil {
+		delete(rs.results, deviceId)
+	}
+}
+
+func (rs *RuleSet) prepared(device *cbiotcore.Device) *rewriteResult {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if result, ok := rs.results[device.Id]; ok {
+		return result
+	}
+	result := rs.rewrite(device)
+	if result.err != nil {
+		errorLogger.AddError(rulesContext, device.Id, result.err)
+	}
+	if rs.results == nil {
+		rs.results = make(map[string]*rewriteResult)
+	}
+	rs.results[device.Id] = result
+	return result
+}
+
+func loadMigrationRules() {
+	if Args.rulesFile == "" {
+		return
+	}
+	rules, err := LoadRuleSet(Args.rulesFile)
+	if err != nil {
+		printfColored(colorRed, "\u2715 Invalid rules file %s: %s", Args.rulesFile, err)
+		os.Exit(1)
+	}
+	migrationRules = rules
+}
+
+// runRulesTest loads -rulesFile and evaluates it against the sample device(s)
+// in -device, printing the filter result and the transformed device.
+func runRulesTest(devicePath string) bool {
+	if Args.rulesFile == "" || devicePath == "" {
+		printfColored(colorRed, "\u2715 rules test requires -rulesFile and -device")
+		return false
+	}
+	loadMigrationRules()
+
+	content, err := os.ReadFile(devicePath)
+	if err != nil {
+		printfColored(colorRed, "\u2715 Unable to read sample device: %s", err)
+		return false
+	}
+
+	var devices []*cbiotcore.Device
+	if trimmed := strings.TrimSpace(string(content)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(content, &devices)
+	} else {
+		var device cbiotcore.Device
+		err = json.Unmarshal(content, &device)
+		devices = append(devices, &device)
+	}
+	if err != nil {
+		printfColored(colorRed, "\u2715 Unable to parse sample device: %s", err)
+		return false
+	}
+
+	ok := true
+	for _, device := range devices {
+		selected, err := migrationRules.Selects(device)
+		if err != nil {
+			printfColored(colorRed, "\u2715 %s: filter error: %s", device.Id, err)
+			ok = false
+			continue
+		}
+		if !selected {
+			printfColored(colorYellow, "- %s: not selected by filter", device.Id)
+			continue
+		}
+
+		transformed := transformDevice(device)
+		if err := migrationRules.Apply(device, transformed); err != nil {
+			printfColored(colorRed, "\u2715 %s: rewrite error: %s", device.Id, err)
+			ok = false
+			continue
+		}
+		out, _ := json.MarshalIndent(transformed, "", "  ")
+		printfColored(colorGreen, "\u2713 %s: selected, migrated as:", device.Id)
+		fmt.Println(string(out))
+	}
+	return ok
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func loadTestRuleSet(t *testing.T, content string) (*RuleSet, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRuleSet(path)
+}
+
+func TestLoadRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{`{"filter": "id =="}`, "filter: unexpected end of expression"},
+		{`{"rewrites": [{"when": "id ~ 'a'"}]}`, "rewrites[0].when: unexpected character"},
+		{`{"rewrites": [{"setMetadata": {"bad key": "'a'"}}]}`, `invalid metadata key "bad key"`},
+		{`{"rewrites": [{"setMetadata": {"fleet": "upper("}}]}`, "rewrites[0].setMetadata.fleet"},
+		{`{"rewrites": [{"logLevel": "verbose"}]}`, `invalid log level "verbose"`},
+		{`{"unknown": true}`, "unknown field"},
+	}
+	for _, tt := range tests {
+		_, err := loadTestRuleSet(t, tt.rules)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("LoadRuleSet(%s) = %v, want error containing %q", tt.rules, err, tt.err)
+		}
+	}
+}
+
+func TestRuleSetApply(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{
+		"filter": "metadata.fleet in ['a', 'b']",
+		"rewrites": [
+			{
+				"setMetadata": {"fleet": "upper(metadata.fleet)", "idLength": "len(id)", "legacy": "null"},
+				"deleteMetadata": ["with-dash"]
+			},
+			{"when": "metadata.city startsWith 'Mün'", "logLevel": "debug", "blocked": true},
+			{"when": "metadata.fleet == 'z'", "setMetadata": {"never": "'set'"}}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := exprTestDevice()
+	source.Metadata["legacy"] = "1"
+	if selected, err := rules.Selects(source); err != nil || !selected {
+		t.Fatalf("Selects = %v, %v, want true", selected, err)
+	}
+
+	target := transformDevice(source)
+	if err := rules.Apply(source, target); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"fleet": "A", "city": "München", "idLength": "9"}
+	if !reflect.DeepEqual(target.Metadata, want) {
+		t.Errorf("metadata = %v, want %v", target.Metadata, want)
+	}
+	if target.LogLevel != "DEBUG" || !target.Blocked {
+		t.Errorf("logLevel %q blocked %v, want DEBUG true", target.LogLevel, target.Blocked)
+	}
+	// Conditions and values see the source device, which is never changed.
+	if source.Metadata["fleet"] != "a" || source.Metadata["with-dash"] != "yes" {
+		t.Errorf("source metadata changed: %v", source.Metadata)
+	}
+}
+
+func TestRuleSetApplyError(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{
+		"rewrites": [
+			{"setMetadata": {"fleet": "'x'"}},
+			{"setMetadata": {"upper": "upper(numId)"}}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := exprTestDevice()
+	target := transformDevice(source)
+	err = rules.Apply(source, target)
+	if err == nil || !strings.Contains(err.Error(), "rewrites[1].setMetadata.upper") {
+		t.Fatalf("Apply = %v, want rewrites[1] error", err)
+	}
+	// A failing rule set applies none of its rewrites.
+	if target.Metadata["fleet"] != "a" {
+		t.Errorf("fleet = %q, want the source value", target.Metadata["fleet"])
+	}
+}
+
+func TestRuleSetPrepareOnce(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{
+		"rewrites": [{"when": "metadata.fleet == 'a'", "setMetadata": {"upper": "upper(numId)"}}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorLogger = NewErrorLogger()
+
+	failing := exprTestDevice()
+	passing := exprTestDevice()
+	passing.Id = "sensor-02"
+	passing.Metadata = map[string]string{"fleet": "b"}
+
+	for i := 0; i < 3; i++ {
+		if err := rules.Prepare(failing); err == nil {
+			t.Fatal("Prepare succeeded for a failing device")
+		}
+		if err := rules.ApplyPrepared(failing, transformDevice(failing)); err == nil {
+			t.Fatal("ApplyPrepared succeeded for a failing device")
+		}
+		if err := rules.ApplyPrepared(passing, transformDevice(passing)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(errorLogger.logs) != 1 || errorLogger.logs[0].DeviceId != failing.Id {
+		t.Errorf("logged %v, want one error for %s", errorLogger.logs, failing.Id)
+	}
+
+	var none *RuleSet
+	if err := none.Prepare(failing); err != nil {
+		t.Errorf("Prepare without rules = %v", err)
+	}
+	target := transformDevice(&cbiotcore.Device{Id: "x", Metadata: map[string]string{"k": "v"}})
+	if err := none.ApplyPrepared(target, target); err != nil || target.Metadata["k"] != "v" {
+		t.Errorf("ApplyPrepared without rules = %v, %v", err, target.Metadata)
+	}
+}
+
+func TestRuleSetApplyPreparedKeepsTruncation(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{
+		"rewrites": [{"setMetadata": {"fleet": "upper(metadata.fleet)"}, "deleteMetadata": ["city"]}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := exprTestDevice()
+	// The target is a truncated copy without with-dash.
+	target := transformDevice(source)
+	target.Metadata = map[string]string{"fleet": "a", "city": "München"}
+	for i := 0; i < 2; i++ {
+		if err := rules.ApplyPrepared(source, target); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"fleet": "A"}; !reflect.DeepEqual(target.Metadata, want) {
+			t.Errorf("metadata = %v, want %v", target.Metadata, want)
+		}
+	}
+	if len(source.Metadata) != 3 {
+		t.Errorf("source metadata changed: %v", source.Metadata)
+	}
+}
+
+func TestTransformValidatesRewrites(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{"rewrites": [{"setMetadata": {"copy": "metadata.big"}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedArgs, savedRules := Args, migrationRules
+	t.Cleanup(func() { Args, migrationRules = savedArgs, savedRules })
+	migrationRules = rules
+	errorLogger = NewErrorLogger()
+
+	// The rules are prepared for the device as listed. -validationPolicy
+	// truncate then dropped big, and the rewrite copies it back under
+	// another key.
+	source := &cbiotcore.Device{Id: "big-device", Metadata: map[string]string{"big": strings.Repeat("x", maxMetadataValueBytes+1)}}
+	if err := rules.Prepare(source); err != nil {
+		t.Fatal(err)
+	}
+	truncated := truncateDevice(source)
+
+	Args.validationPolicy = ValidationPolicyTruncate
+	cbDevice, err := transform(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cbDevice.Metadata) != 0 {
+		t.Errorf("metadata has %d keys, want the oversized copy dropped", len(cbDevice.Metadata))
+	}
+
+	Args.validationPolicy = ValidationPolicySkip
+	for i := 0; i < 2; i++ {
+		if _, err := transform(truncated); err == nil {
+			t.Fatal("transform succeeded for a device over the limits")
+		}
+	}
+	if len(errorLogger.logs) != 1 || errorLogger.logs[0].DeviceId != "big-device" {
+		t.Errorf("logged %v, want one error for big-device", errorLogger.logs)
+	}
+
+	Args.validationPolicy = ValidationPolicyOff
+	if cbDevice, err := transform(truncated); err != nil || len(cbDevice.Metadata["copy"]) != maxMetadataValueBytes+1 {
+		t.Errorf("transform without validation = %v", err)
+	}
+}
+
+func TestRuleSetForget(t *testing.T) {
+	rules, err := loadTestRuleSet(t, `{
+		"rewrites": [{"when": "metadata.fleet == 'a'", "setMetadata": {"upper": "upper(numId)"}}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := Args
+	t.Cleanup(func() { Args = saved })
+	Args.streaming = true
+	errorLogger = NewErrorLogger()
+
+	failing := exprTestDevice()
+	passing := exprTestDevice()
+	passing.Id = "sensor-02"
+	passing.Metadata = map[string]string{"fleet": "b"}
+	skipped := exprTestDevice()
+	skipped.Id = "sensor-03"
+	skipped.Metadata = map[string]string{"fleet": "b"}
+
+	for _, device := range []*cbiotcore.Device{failing, passing, skipped} {
+		rules.Prepare(device)
+	}
+	// A streaming migration drops results once a device is transformed, or
+	// when it will not be.
+	if err := rules.ApplyPrepared(passing, transformDevice(passing)); err != nil {
+		t.Fatal(err)
+	}
+	rules.Forget(skipped.Id)
+	rules.Forget(failing.Id)
+	if len(rules.results) != 1 || rules.results[failing.Id] == nil {
+		t.Errorf("results = %v, want only the failure of %s", rules.results, failing.Id)
+	}
+	if err := rules.Prepare(failing); err == nil || len(errorLogger.logs) != 1 {
+		t.Errorf("Prepare = %v, logged %d errors, want the failure once", err, len(errorLogger.logs))
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3CheckpointStore stores objects in an S3-compatible bucket, such as AWS S3
+// or MinIO, with path-style requests signed with AWS Signature Version 4.
+//
+// Writes are conditional. Create sends If-None-Match: *, and Write sends
+// If-Match with the ETag this store last read or wrote, so an object changed
+// by another process is never overwritten.
+type s3CheckpointStore struct {
+	endpoint     string
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+
+	mutex sync.Mutex
+	etags map[string]string
+}
+
+// NewS3CheckpointStore returns a store for location, an s3://bucket/prefix
+// URL. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// optionally AWS_SESSION_TOKEN.
+func NewS3CheckpointStore(location, endpoint, region string) (CheckpointStore, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 location %q. Use s3://bucket/prefix", location)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	store := &s3CheckpointStore{
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		region:       region,
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: time.Minute},
+		etags:        make(map[string]string),
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use an S3 checkpoint store")
+	}
+	return store, nil
+}
+
+func (s *s3CheckpointStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3CheckpointStore) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(name))
+}
+
+func (s *s3CheckpointStore) Read(name string) ([]byte, error) {
+	resp, body, err := s.do(http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", s.Location(name), os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp, body)
+	}
+	s.setETag(name, resp.Header.Get("ETag"))
+	return body, nil
+}
+
+func (s *s3CheckpointStore) Write(name string, data []byte) error {
+	header := http.Header{}
+	if etag := s.getETag(name); etag != "" {
+		header.Set("If-Match", etag)
+	} else {
+		header.Set("If-None-Match", "*")
+	}
+	err := s.put(name, data, header)
+	if errors.Is(err, ErrObjectExists) {
+		return fmt.Errorf("%s: %w", s.Location(name), ErrObjectModified)
+	}
+	return err
+}
+
+func (s *s3CheckpointStore) Create(name string, data []byte) error {
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+	return s.put(name, data, header)
+}
+
+func (s *s3CheckpointStore) put(name string, data []byte, header http.Header) error {
+	resp, body, err := s.do(http.MethodPut, s.key(name), nil, header, data)
+	if err != nil {
+		return err
+	}
+	// 409 is returned when a conflicting conditional write is in progress.
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return ErrObjectExists
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, body)
+	}
+	s.setETag(name, resp.Header.Get("ETag"))
+	return nil
+}
+
+func (s *s3CheckpointStore) Delete(name string) error {
+	resp, body, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp, body)
+	}
+	s.setETag(name, "")
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3CheckpointStore) List(prefix string) ([]string, error) {
+	keyPrefix := s.key(strings.Trim(prefix, "/")) + "/"
+	var names []string
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", keyPrefix)
+		query.Set("delimiter", "/")
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, body, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3Error(resp, body)
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse S3 list response: %w", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, keyPrefix))
+		}
+		for _, p := range result.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, keyPrefix), "/"))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *s3CheckpointStore) getETag(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.etags[name]
+}
+
+func (s *s3CheckpointStore) setETag(name, etag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if etag == "" {
+		delete(s.etags, name)
+	} else {
+		s.etags[name] = etag
+	}
+}
+
+// do sends a signed request for key in the bucket, or for the bucket itself if
+// key is empty, and returns the response with its body read.
+func (s *s3CheckpointStore) do(method, key string, query url.Values, header http.Header, payload []byte) (*http.Response, []byte, error) {
+	path := "/" + s3URIEncode(s.bucket, false)
+	if key != "" {
+		path += "/" + s3URIEncode(key, true)
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	target := s.endpoint + path
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, path, canonicalQuery, payload, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3CheckpointStore) sign(req *http.Request, path, canonicalQuery string, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "if-match" || lower == "if-none-match" {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, path, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode percent-encodes everything except unreserved characters, and
+// slashes if keepSlash is set, as Signature Version 4 requires.
+func s3URIEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3URIEncode(key, false)+"="+s3URIEncode(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func s3Error(resp *http.Response, body []byte) error {
+	var e s3ErrorResponse
+	if err := xml.Unmarshal(body, &e); err == nil && e.Code != "" {
+		return fmt.Errorf("S3 request failed with status %d: %s: %s", resp.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3 request failed with status %d", resp.StatusCode)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory S3 bucket that honours If-Match and If-None-Match on
+// PUT and pages ListObjectsV2 results.
+type fakeS3 struct {
+	mutex     sync.Mutex
+	bucket    string
+	pageSize  int
+	objects   map[string][]byte
+	etags     map[string]string
+	nextETag  int
+	listCalls int
+}
+
+func newFakeS3(t *testing.T, bucket string, pageSize int) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	f := &fakeS3{bucket: bucket, pageSize: pageSize, objects: make(map[string][]byte), etags: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	return f, server
+}
+
+func newTestS3Store(t *testing.T, server *httptest.Server, location string) CheckpointStore {
+	t.Helper()
+	store, err := NewS3CheckpointStore(location, server.URL, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func (f *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", f.etags[key])
+		w.Write(data)
+	case r.Method == http.MethodPut:
+		etag, exists := f.etags[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etag) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.nextETag++
+		f.objects[key] = data
+		f.etags[key] = strconv.Quote(strconv.Itoa(f.nextETag))
+		w.Header().Set("ETag", f.etags[key])
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	f.listCalls++
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	// Entries are keys, or common prefixes ending in the delimiter.
+	seen := make(map[string]bool)
+	var entries []string
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry = key[:len(prefix)+i+len(delimiter)]
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := min(start+f.pageSize, len(entries))
+
+	var result s3ListResult
+	for _, entry := range entries[start:end] {
+		if delimiter != "" && strings.HasSuffix(entry, delimiter) {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{entry})
+		} else {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{entry})
+		}
+	}
+	if end < len(entries) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+	w.Write(data)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
+
+func TestS3CheckpointStoreCreate(t *testing.T) {
+	f, server := newFakeS3(t, "bucket", 1000)
+	store := newTestS3Store(t, server, "s3://bucket/migrations/run-1")
+
+	if err := store.Create("lease.json", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create("lease.json", []byte("second")); !errors.Is(err, ErrObjectExists) {
+		t.Fatalf("second Create = %v, want ErrObjectExists", err)
+	}
+	// Another process loses the race the same way.
+	other := newTestS3Store(t, server, "s3://bucket/migrations/run-1")
+	if err := other.Create("lease.json", []byte("other")); !errors.Is(err, ErrObjectExists) {
+		t.Fatalf("Create by another store = %v, want ErrObjectExists", err)
+	}
+	if data := f.objects["migrations/run-1/lease.json"]; string(data) != "first" {
+		t.Errorf("object = %q, want first", data)
+	}
+
+	data, err := store.Read("lease.json")
+	if err != nil || string(data) != "first" {
+		t.Errorf("Read = %q, %v, want first", data, err)
+	}
+	if _, err := store.Read("missing.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of a missing object = %v, want os.ErrNotExist", err)
+	}
+
+	if err := store.Delete("lease.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("lease.json"); err != nil {
+		t.Errorf("Delete of a missing object = %v", err)
+	}
+	if err := other.Create("lease.json", []byte("again")); err != nil {
+		t.Errorf("Create after Delete = %v", err)
+	}
+	if got, want := store.Location("lease.json"), "s3://bucket/migrations/run-1/lease.json"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestS3CheckpointStoreWriteModified(t *testing.T) {
+	_, server := newFakeS3(t, "bucket", 1000)
+	a := newTestS3Store(t, server, "s3://bucket")
+	b := newTestS3Store(t, server, "s3://bucket")
+
+	if err := a.Write("state.json", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write("state.json", []byte("2")); err != nil {
+		t.Fatalf("Write over its own object = %v", err)
+	}
+	// b never read the object, so it cannot overwrite it.
+	if err := b.Write("state.json", []byte("b")); !errors.Is(err, ErrObjectModified) {
+		t.Fatalf("blind Write = %v, want ErrObjectModified", err)
+	}
+
+	if _, err := b.Read("state.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Write("state.json", []byte("3")); err != nil {
+		t.Fatalf("Write after Read = %v", err)
+	}
+	if err := a.Write("state.json", []byte("4")); !errors.Is(err, ErrObjectModified) {
+		t.Fatalf("stale Write = %v, want ErrObjectModified", err)
+	}
+	if data, _ := a.Read("state.json"); string(data) != "3" {
+		t.Errorf("object = %q, want 3", data)
+	}
+}
+
+func TestS3CheckpointStoreList(t *testing.T) {
+	f, server := newFakeS3(t, "bucket", 2)
+	store := newTestS3Store(t, server, "s3://bucket/prefix")
+
+	for i := 5; i >= 1; i-- {
+		if err := store.Create(leaseObject("shard-0", i), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"leases/shard-0/old/00000001.json", "leases/shard-00/00000001.json", "checkpoint.json"} {
+		if err := store.Create(name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := store.List(leasePrefix("shard-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"00000001.json", "00000002.json", "00000003.json", "00000004.json", "00000005.json", "old"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("List = %v, want %v", names, want)
+	}
+	if f.listCalls != 3 {
+		t.Errorf("List made %d requests, want 3 pages", f.listCalls)
+	}
+
+	if names, err := store.List("missing"); err != nil || len(names) != 0 {
+		t.Errorf("List of a missing prefix = %v, %v", names, err)
+	}
+}
+
+func TestS3CheckpointResume(t *testing.T) {
+	_, server := newFakeS3(t, "bucket", 1000)
+	saved := Args
+	t.Cleanup(func() { Args = saved })
+	Args.workDir = t.TempDir()
+
+	if checkpoint, err := LoadCheckpointFrom(newTestS3Store(t, server, "s3://bucket/run")); err != nil || checkpoint != nil {
+		t.Fatalf("LoadCheckpointFrom an empty bucket = %v, %v", checkpoint, err)
+	}
+
+	first := NewCheckpointStateIn(newTestS3Store(t, server, "s3://bucket/run"))
+	first.SetPhase(PhaseDeviceMigrate)
+	first.AddMigratedDevice("device-1")
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second process resumes from the saved checkpoint.
+	resumed, err := LoadCheckpointFrom(newTestS3Store(t, server, "s3://bucket/run"))
+	if err != nil || resumed == nil {
+		t.Fatalf("LoadCheckpointFrom = %v, %v", resumed, err)
+	}
+	defer resumed.Close()
+	if resumed.CurrentPhase != PhaseDeviceMigrate || !resumed.IsPhaseCompleted(PhaseDeviceFetch) {
+		t.Errorf("phase %s, completed %v", resumed.CurrentPhase, resumed.CompletedPhases)
+	}
+	if !resumed.IsDeviceMigrated("device-1") || resumed.Fingerprint != first.Fingerprint {
+		t.Errorf("resumed checkpoint lost state: %v", resumed.DevicesMigrated)
+	}
+	resumed.AddMigratedDevice("device-2")
+	if err := resumed.FlushToDisk(); err != nil {
+		t.Fatalf("save of the resumed checkpoint = %v", err)
+	}
+
+	// The first process must not overwrite the checkpoint it no longer owns.
+	if err := first.Save(); !errors.Is(err, ErrObjectModified) {
+		t.Errorf("stale save = %v, want ErrObjectModified", err)
+	}
+	reloaded, err := LoadCheckpointFrom(newTestS3Store(t, server, "s3://bucket/run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if !reloaded.IsDeviceMigrated("device-2") {
+		t.Errorf("devices %v, want device-2 saved", reloaded.DevicesMigrated)
+	}
+}
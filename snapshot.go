@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const snapshotFormatVersion = 1
+
+// RegistrySnapshot is a normalized dump of a registry written by the snapshot
+// command. Devices are sorted by ID and hold only fields that the registry
+// stores, so two snapshots of an unchanged registry are identical apart from
+// CreatedAt.
+type RegistrySnapshot struct {
+	FormatVersion int              `json:"formatVersion"`
+	ToolVersion   string           `json:"toolVersion"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	RegistryName  string           `json:"registryName"`
+	Region        string           `json:"region"`
+	Devices       []SnapshotDevice `json:"devices"`
+}
+
+type SnapshotDevice struct {
+	Id                string               `json:"id"`
+	Blocked           bool                 `json:"blocked"`
+	Metadata          map[string]string    `json:"metadata"`
+	LogLevel          string               `json:"logLevel"`
+	GatewayType       string               `json:"gatewayType"`
+	GatewayAuthMethod string               `json:"gatewayAuthMethod,omitempty"`
+	Credentials       []SnapshotCredential `json:"credentials"`
+	ConfigVersion     int64                `json:"configVersion"`
+	ConfigSha256      string               `json:"configSha256,omitempty"`
+	Bindings          []string             `json:"bindings,omitempty"`
+}
+
+// SnapshotCredential identifies a public key by the SHA-256 of its trimmed
+// PEM so that snapshots can be shared without the keys themselves.
+type SnapshotCredential struct {
+	Format         string `json:"format"`
+	KeySha256      string `json:"keySha256"`
+	ExpirationTime string `json:"expirationTime,omitempty"`
+}
+
+// SnapshotDiff is the difference between two snapshots or archives.
+type SnapshotDiff struct {
+	From           string               `json:"from"`
+	To             string               `json:"to"`
+	Added          []string             `json:"added"`
+	Removed        []string             `json:"removed"`
+	Changed        []DeviceChange       `json:"changed"`
+	Bindings       []BindingChange      `json:"bindings"`
+	ConfigVersions []ConfigVersionDelta `json:"configVersions"`
+}
+
+type DeviceChange struct {
+	Id     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+type BindingChange struct {
+	GatewayId string   `json:"gatewayId"`
+	Bound     []string `json:"bound,omitempty"`
+	Unbound   []string `json:"unbound,omitempty"`
+}
+
+type ConfigVersionDelta struct {
+	Id   string `json:"id"`
+	From int64  `json:"from"`
+	To   int64  `json:"to"`
+}
+
+func (d *SnapshotDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Bindings) == 0 && len(d.ConfigVersions) == 0
+}
+
+func snapshotDevice(device *cbiotcore.Device, bindings []string) SnapshotDevice {
+	s := SnapshotDevice{
+		Id:                device.Id,
+		Blocked:           device.Blocked,
+		Metadata:          device.Metadata,
+		LogLevel:          normalizeLogLevel(device.LogLevel),
+		GatewayType:       "NON_GATEWAY",
+		GatewayAuthMethod: gatewayAuthMethod(device),
+		Credentials:       []SnapshotCredential{},
+		Bindings:          bindings,
+	}
+	if s.Metadata == nil {
+		s.Metadata = map[string]string{}
+	}
+	if device.GatewayConfig != nil && device.GatewayConfig.GatewayType == "GATEWAY" {
+		s.GatewayType = "GATEWAY"
+	}
+	if s.GatewayAuthMethod == "GATEWAY_AUTH_METHOD_UNSPECIFIED" {
+		s.GatewayAuthMethod = ""
+	}
+	for _, cred := range device.Credentials {
+		var c SnapshotCredential
+		if cred.PublicKey != nil {
+			sum := sha256.Sum256([]byte(strings.TrimSpace(cred.PublicKey.Key)))
+			c.Format, c.KeySha256 = cred.PublicKey.Format, hex.EncodeToString(sum[:])
+		}
+		if t, err := time.Parse(time.RFC3339Nano, cred.ExpirationTime); err == nil && t.Unix() != 0 {
+			c.ExpirationTime = t.UTC().Format(time.RFC3339Nano)
+		}
+		s.Credentials = append(s.Credentials, c)
+	}
+	sort.Slice(s.Credentials, func(i, j int) bool {
+		a, b := s.Credentials[i], s.Credentials[j]
+		return a.Format+a.KeySha256+a.ExpirationTime < b.Format+b.KeySha256+b.ExpirationTime
+	})
+	if device.Config != nil {
+		s.ConfigVersion = device.Config.Version
+		if device.Config.BinaryData != "" {
+			sum := sha256.Sum256([]byte(device.Config.BinaryData))
+			s.ConfigSha256 = hex.EncodeToString(sum[:])
+		}
+	}
+	return s
+}
+
+func newSnapshot(registryName, region string, devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) *RegistrySnapshot {
+	snapshot := &RegistrySnapshot{
+		FormatVersion: snapshotFormatVersion,
+		ToolVersion:   cbIotCoreMigrationVersion,
+		CreatedAt:     time.Now().UTC(),
+		RegistryName:  registryName,
+		Region:        region,
+		Devices:       make([]SnapshotDevice, 0, len(devices)),
+	}
+	for _, device := range devices {
+		var bindings []string
+		if bound, ok := gatewayBindings[device.Id]; ok {
+			bindings = make([]string, 0, len(bound))
+			for _, b := range bound {
+				bindings = append(bindings, b.Id)
+			}
+			sort.Strings(bindings)
+		}
+		snapshot.Devices = append(snapshot.Devices, snapshotDevice(device, bindings))
+	}
+	sort.Slice(snapshot.Devices, func(i, j int) bool { return snapshot.Devices[i].Id < snapshot.Devices[j].Id })
+	return snapshot
+}
+
+// runSnapshot writes a snapshot of the source or destination registry, as
+// selected by side, to path.
+func runSnapshot(side, path string) {
+	var endpoint *ClearBladeEndpoint
+	var err error
+	if side == "source" {
+		validateSourceCBFlags()
+		endpoint, err = NewClearBladeEndpoint(Args.cbSourceServiceAccount, Args.cbSourceRegistryName, Args.cbSourceRegion)
+	} else {
+		validateCBFlags(Args.cbRegistryRegion)
+		endpoint, err = NewClearBladeEndpoint(Args.cbServiceAccount, Args.cbRegistryName, Args.cbRegistryRegion)
+	}
+	if err != nil {
+		log.Fatalf("Unable to load %s service account: %s\n", side, err)
+	}
+	service, err := endpoint.NewService()
+	if err != nil {
+		log.Fatalf("Unable to connect to %s registry: %s\n", side, err)
+	}
+	if err := verifyRegistryDetails(service, endpoint.RegistryName, endpoint.Region); err != nil {
+		log.Fatalf("Error verifying %s registry details: %s\n", side, err)
+	}
+
+	deviceService := cbiotcore.NewProjectsLocationsRegistriesDevicesService(service)
+	devices, err := paginatedFetch(deviceService.List(endpoint.RegistryPath()).PageSize(Args.pageSize), fmt.Sprintf("Fetching all devices from %s registry...", side))
+	if err != nil {
+		log.Fatalln("Error fetching all devices: ", err)
+	}
+	gatewayBindings := fetchSnapshotBindings(deviceService, endpoint, devices)
+
+	if path == "" {
+		path = filepath.Join(Args.workDir, fmt.Sprintf("snapshot_%s_%s.json", endpoint.RegistryName, time.Now().UTC().Format("20060102T150405Z")))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Unable to create snapshot directory: %s\n", err)
+	}
+	snapshot := newSnapshot(endpoint.RegistryName, endpoint.Region, devices, gatewayBindings)
+	if err := writeJSONFile(path, snapshot); err != nil {
+		log.Fatalf("Unable to write snapshot: %s\n", err)
+	}
+	printfColored(colorGreen, "\u2713 Snapshot of %d devices in %s written to %s", len(snapshot.Devices), endpoint.RegistryName, path)
+}
+
+func fetchSnapshotBindings(deviceService *cbiotcore.ProjectsLocationsRegistriesDevicesService, endpoint *ClearBladeEndpoint, devices []*cbiotcore.Device) map[string][]*cbiotcore.Device {
+	var gateways []*cbiotcore.Device
+	for _, device := range devices {
+		if device.GatewayConfig != nil && device.GatewayConfig.GatewayType == "GATEWAY" {
+			gateways = append(gateways, device)
+		}
+	}
+	bindings := make(map[string][]*cbiotcore.Device, len(gateways))
+	if len(gateways) == 0 {
+		return bindings
+	}
+
+	bar := getProgressBar(len(gateways), "Fetching gateway bindings...")
+	defer bar.Finish()
+	var bindingMutex sync.Mutex
+	wp := NewWorkerPool()
+	wp.Run()
+	for _, gateway := range gateways {
+		wp.AddTask(func() {
+			req := deviceService.List(endpoint.RegistryPath()).GatewayListOptionsAssociationsGatewayId(gateway.Id).PageSize(Args.pageSize)
+			bound, err := paginatedFetch(req, "")
+			if err != nil {
+				log.Fatalf("Error fetching bound devices of gateway %s: %s\n", gateway.Id, err)
+			}
+			bindingMutex.Lock()
+			bindings[gateway.Id] = bound
+			bindingMutex.Unlock()
+			bar.Add(1)
+		})
+	}
+	wp.Wait()
+	return bindings
+}
+
+// loadSnapshot reads a snapshot file, or builds a snapshot from an archive
+// written by export-archive. Archives are recognized by their gzip header.
+func loadSnapshot(path string) (*RegistrySnapshot, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		var snapshot RegistrySnapshot
+		if err := json.Unmarshal(content, &snapshot); err != nil {
+			return nil, err
+		}
+		if snapshot.FormatVersion < 1 || snapshot.FormatVersion > snapshotFormatVersion {
+			return nil, fmt.Errorf("unsupported snapshot format version %d", snapshot.FormatVersion)
+		}
+		return &snapshot, nil
+	}
+
+	dir, err := os.MkdirTemp("", "cb-migration-archive-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	archive, err := openArchive(path, dir)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := readDevicesJSONL(filepath.Join(dir, archiveDevicesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var registryName, region string
+	if len(archive.Registries) == 1 {
+		registryName, region = archive.Registries[0].RegistryName, archive.Registries[0].Region
+	}
+	snapshot := newSnapshot(registryName, region, devices, archive.GatewayBindings(devices))
+	snapshot.CreatedAt = archive.Manifest.CreatedAt
+	return snapshot, nil
+}
+
+// mapSnapshotIds renames the devices and bindings of snapshot with
+// -idMappingCsv, so that a source snapshot can be compared with a
+// destination whose devices were renamed.
+func mapSnapshotIds(snapshot *RegistrySnapshot) {
+	if deviceIdMapper == nil {
+		return
+	}
+	for i := range snapshot.Devices {
+		device := &snapshot.Devices[i]
+		device.Id = destinationDeviceId(device.Id)
+		for j, id := range device.Bindings {
+			device.Bindings[j] = destinationDeviceId(id)
+		}
+		sort.Strings(device.Bindings)
+	}
+	sort.Slice(snapshot.Devices, func(i, j int) bool { return snapshot.Devices[i].Id < snapshot.Devices[j].Id })
+}
+
+func diffSnapshots(from, to *RegistrySnapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		Added:          []string{},
+		Removed:        []string{},
+		Changed:        []DeviceChange{},
+		Bindings:       []BindingChange{},
+		ConfigVersions: []ConfigVersionDelta{},
+	}
+	before := make(map[string]SnapshotDevice, len(from.Devices))
+	for _, device := range from.Devices {
+		before[device.Id] = device
+	}
+	after := make(map[string]SnapshotDevice, len(to.Devices))
+	for _, device := range to.Devices {
+		after[device.Id] = device
+	}
+
+	for _, device := range to.Devices {
+		old, ok := before[device.Id]
+		if !ok {
+			diff.Added = append(diff.Added, device.Id)
+			continue
+		}
+		if fields := changedSnapshotFields(old, device); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, DeviceChange{Id: device.Id, Fields: fields})
+		}
+		if old.ConfigVersion != device.ConfigVersion {
+			diff.ConfigVersions = append(diff.ConfigVersions, ConfigVersionDelta{Id: device.Id, From: old.ConfigVersion, To: device.ConfigVersion})
+		}
+	}
+	for _, device := range from.Devices {
+		if _, ok := after[device.Id]; !ok {
+			diff.Removed = append(diff.Removed, device.Id)
+		}
+	}
+
+	gateways := make(map[string]struct{})
+	for id, device := range before {
+		if len(device.Bindings) > 0 {
+			gateways[id] = struct{}{}
+		}
+	}
+	for id, device := range after {
+		if len(device.Bindings) > 0 {
+			gateways[id] = struct{}{}
+		}
+	}
+	for id := range gateways {
+		bound, unbound := stringSetDelta(before[id].Bindings, after[id].Bindings)
+		if len(bound) > 0 || len(unbound) > 0 {
+			diff.Bindings = append(diff.Bindings, BindingChange{GatewayId: id, Bound: bound, Unbound: unbound})
+		}
+	}
+	sort.Slice(diff.Bindings, func(i, j int) bool { return diff.Bindings[i].GatewayId < diff.Bindings[j].GatewayId })
+	return diff
+}
+
+// changedSnapshotFields lists the fields that differ between two versions of
+// a device. Config version changes are reported separately, and the config
+// itself only when its data changed.
+func changedSnapshotFields(from, to SnapshotDevice) []string {
+	var fields []string
+	if from.Blocked != to.Blocked {
+		fields = append(fields, "blocked")
+	}
+	if !equalMetadata(from.Metadata, to.Metadata) {
+		fields = append(fields, "metadata")
+	}
+	if from.LogLevel != to.LogLevel {
+		fields = append(fields, "logLevel")
+	}
+	if from.GatewayType != to.GatewayType {
+		fields = append(fields, "gatewayType")
+	}
+	if from.GatewayAuthMethod != to.GatewayAuthMethod {
+		fields = append(fields, "gatewayAuthMethod")
+	}
+	if fmt.Sprint(from.Credentials) != fmt.Sprint(to.Credentials) {
+		fields = append(fields, "credentials")
+	}
+	if from.ConfigSha256 != to.ConfigSha256 {
+		fields = append(fields, "config")
+	}
+	return fields
+}
+
+// stringSetDelta returns the sorted elements only in to and only in from.
+func stringSetDelta(from, to []string) (added, removed []string) {
+	inFrom := make(map[string]struct{}, len(from))
+	for _, s := range from {
+		inFrom[s] = struct{}{}
+	}
+	inTo := make(map[string]struct{}, len(to))
+	for _, s := range to {
+		inTo[s] = struct{}{}
+		if _, ok := inFrom[s]; !ok {
+			added = append(added, s)
+		}
+	}
+	for _, s := range from {
+		if _, ok := inTo[s]; !ok {
+			removed = append(removed, s)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// runDiff compares two snapshots or archives and prints the difference as
+// text or JSON. It returns false when they differ.
+func runDiff(fromPath, toPath, format string) bool {
+	if format != "text" && format != "json" {
+		log.Fatalf("Invalid -format %q. Must be text or json\n", format)
+	}
+	if Args.idRenameTemplate != "" {
+		log.Fatalln("-idRenameTemplate cannot be used with diff. Use -idMappingCsv instead")
+	}
+	loadDeviceIdMapper()
+
+	from, err := loadSnapshot(fromPath)
+	if err != nil {
+		log.Fatalf("Unable to read %s: %s\n", fromPath, err)
+	}
+	to, err := loadSnapshot(toPath)
+	if err != nil {
+		log.Fatalf("Unable to read %s: %s\n", toPath, err)
+	}
+	mapSnapshotIds(from)
+
+	diff := diffSnapshots(from, to)
+	diff.From, diff.To = fromPath, toPath
+
+	if format == "json" {
+		content, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			log.Fatalf("Unable to encode diff: %s\n", err)
+		}
+		fmt.Println(string(content))
+	} else {
+		printSnapshotDiff(diff, from, to)
+	}
+	return diff.Empty()
+}
+
+func printSnapshotDiff(diff *SnapshotDiff, from, to *RegistrySnapshot) {
+	fmt.Printf("--- %s (%s, %d devices, %s)\n", diff.From, from.RegistryName, len(from.Devices), from.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("+++ %s (%s, %d devices, %s)\n", diff.To, to.RegistryName, len(to.Devices), to.CreatedAt.Format(time.RFC3339))
+	if diff.Empty() {
+		printfColored(colorGreen, "\u2713 No differences")
+		return
+	}
+
+	if len(diff.Added) > 0 {
+		fmt.Println()
+		printfColored(colorGreen, "Added devices (%d):", len(diff.Added))
+		for _, id := range diff.Added {
+			fmt.Printf("  + %s\n", id)
+		}
+	}
+	if len(diff.Removed) > 0 {
+		fmt.Println()
+		printfColored(colorRed, "Removed devices (%d):", len(diff.Removed))
+		for _, id := range diff.Removed {
+			fmt.Printf("  - %s\n", id)
+		}
+	}
+	if len(diff.Changed) > 0 {
+		fmt.Println()
+		printfColored(colorYellow, "Changed devices (%d):", len(diff.Changed))
+		for _, change := range diff.Changed {
+			fmt.Printf("  ~ %s: %s\n", change.Id, strings.Join(change.Fields, ", "))
+		}
+	}
+	if len(diff.Bindings) > 0 {
+		fmt.Println()
+		printfColored(colorYellow, "Binding changes (%d gateways):", len(diff.Bindings))
+		for _, change := range diff.Bindings {
+			var parts []string
+			for _, id := range change.Bound {
+				parts = append(parts, "+"+id)
+			}
+			for _, id := range change.Unbound {
+				parts = append(parts, "-"+id)
+			}
+			fmt.Printf("  %s: %s\n", change.GatewayId, strings.Join(parts, " "))
+		}
+	}
+	if len(diff.ConfigVersions) > 0 {
+		fmt.Println()
+		printfColored(colorYellow, "Config version deltas (%d):", len(diff.ConfigVersions))
+		for _, delta := range diff.ConfigVersions {
+			fmt.Printf("  %s: %d -> %d (%+d)\n", delta.Id, delta.From, delta.To, delta.To-delta.From)
+		}
+	}
+	fmt.Printf("\n%d added, %d removed, %d changed, %d binding changes, %d config version deltas\n",
+		len(diff.Added), len(diff.Removed), len(diff.Changed), len(diff.Bindings), len(diff.ConfigVersions))
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const (
+	RouteByMetadata = "metadata"
+	RouteByIdPrefix = "idPrefix"
+	RouteByCsv      = "csv"
+)
+
+const routingContext = "Routing"
+
+// splitDestinations are the destination registries of a split migration, in
+// the order they are listed in -splitDestinationsCsv. It is nil when all
+// devices go to the single -cbRegistryName destination.
+var splitDestinations []*SplitDestination
+
+var deviceRouter *DeviceRouter
+
+type SplitDestination struct {
+	Name     string
+	Endpoint *ClearBladeEndpoint
+}
+
+// DeviceRouter assigns each device to a split destination by name. With
+// -routeBy metadata:<key> the name is the value of that metadata key, with
+// idPrefix:<separator> it is the part of the device ID before the first
+// separator, and with csv it is the destination column of -routingCsv.
+// Devices whose name is not a known destination go to -defaultDestination,
+// or are not migrated when it is not set.
+type DeviceRouter struct {
+	kind               string
+	metadataKey        string
+	separator          string
+	csvRoutes          map[string]string
+	destinations       map[string]*SplitDestination
+	defaultDestination string
+}
+
+func isSplitMode() bool {
+	return len(splitDestinations) > 0
+}
+
+func NewDeviceRouterFromArgs(destinations []*SplitDestination) (*DeviceRouter, error) {
+	r := &DeviceRouter{
+		destinations:       make(map[string]*SplitDestination, len(destinations)),
+		defaultDestination: Args.defaultDestination,
+	}
+	for _, dest := range destinations {
+		r.destinations[dest.Name] = dest
+	}
+	if r.defaultDestination != "" {
+		if _, ok := r.destinations[r.defaultDestination]; !ok {
+			return nil, fmt.Errorf("-defaultDestination %q is not listed in -splitDestinationsCsv", r.defaultDestination)
+		}
+	}
+
+	kind, param, _ := strings.Cut(Args.routeBy, ":")
+	switch kind {
+	case RouteByMetadata:
+		if param == "" {
+			return nil, errors.New("-routeBy metadata requires a key, e.g. metadata:customer")
+		}
+		r.metadataKey = param
+	case RouteByIdPrefix:
+		if param == "" {
+			return nil, errors.New("-routeBy idPrefix requires a separator, e.g. idPrefix:-")
+		}
+		r.separator = param
+	case RouteByCsv:
+		if Args.routingCsv == "" {
+			return nil, errors.New("-routeBy csv requires -routingCsv")
+		}
+		routes, err := readRoutingCsv(Args.routingCsv)
+		if err != nil {
+			return nil, err
+		}
+		r.csvRoutes = routes
+	case "":
+		if r.defaultDestination == "" {
+			return nil, errors.New("-splitDestinationsCsv requires -routeBy or -defaultDestination")
+		}
+	default:
+		return nil, fmt.Errorf("invalid -routeBy %q. Must be metadata:<key>, idPrefix:<separator> or csv", Args.routeBy)
+	}
+	r.kind = kind
+	return r, nil
+}
+
+func readRoutingCsv(path string) (map[string]string, error) {
+	rows, err := readCsvFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("routing CSV %s is empty", path)
+	}
+
+	idIdx, destIdx := -1, -1
+	for i, name := range rows[0] {
+		switch name {
+		case "deviceId":
+			idIdx = i
+		case "destination":
+			destIdx = i
+		}
+	}
+	if idIdx == -1 || destIdx == -1 {
+		return nil, fmt.Errorf("routing CSV %s must have deviceId and destination columns", path)
+	}
+
+	routes := make(map[string]string, len(rows)-1)
+	for line, row := range rows[1:] {
+		if len(row) <= idIdx || len(row) <= destIdx {
+			return nil, fmt.Errorf("routing CSV line %d: missing columns", line+2)
+		}
+		deviceId, dest := row[idIdx], row[destIdx]
+		if existing, ok := routes[deviceId]; ok && existing != dest {
+			return nil, fmt.Errorf("routing CSV line %d: %s is routed to both %s and %s", line+2, deviceId, existing, dest)
+		}
+		routes[deviceId] = dest
+	}
+	return routes, nil
+}
+
+// Route returns the destination of a device and what it was routed by. An
+// empty destination means the device is not migrated.
+func (r *DeviceRouter) Route(device *cbiotcore.Device) (destination, routedBy string) {
+	var name string
+	switch r.kind {
+	case RouteByMetadata:
+		name = device.Metadata[r.metadataKey]
+	case RouteByIdPrefix:
+		if prefix, _, found := strings.Cut(device.Id, r.separator); found {
+			name = prefix
+		}
+	case RouteByCsv:
+		name = r.csvRoutes[device.Id]
+	}
+	if _, ok := r.destinations[name]; ok {
+		return name, r.kind
+	}
+	if r.defaultDestination != "" {
+		return r.defaultDestination, "default"
+	}
+	return "", ""
+}
+
+func loadSplitDestinations() {
+	if Args.splitDestinationsCsv == "" {
+		return
+	}
+
+	entries, err := readEndpointsCsv(Args.splitDestinationsCsv, "name", Args.cbServiceAccount, "-cbServiceAccount")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	destinations := make([]*SplitDestination, 0, len(entries))
+	for _, entry := range entries {
+		if strings.ContainsAny(entry.Name, `/\`) || entry.Name == "." || entry.Name == ".." {
+			log.Fatalf("%s: destination name %q cannot be used as a directory name\n", Args.splitDestinationsCsv, entry.Name)
+		}
+		destinations = append(destinations, &SplitDestination{Name: entry.Name, Endpoint: entry.Endpoint})
+	}
+
+	router, err := NewDeviceRouterFromArgs(destinations)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	splitDestinations = destinations
+	deviceRouter = router
+}
+
+type routingRecord struct {
+	DeviceId    string
+	Destination string
+	RoutedBy    string
+	Detail      string
+}
+
+// routeDevices assigns every migrated and bound device to a destination and
+// verifies that each gateway lands in the same registry as all of its bound
+// devices. It writes routing_report.csv to the work directory and aborts
+// before any writes if a gateway and a bound device are routed apart.
+func routeDevices(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) map[string]string {
+	printfColored(colorGreen, "\u2713 Routing devices to destination registries")
+
+	// Bound devices are listed without metadata, so route them using the
+	// fetched device when there is one.
+	fetched := make(map[string]*cbiotcore.Device)
+	for _, device := range GetCheckpoint().GetFetchedDevices() {
+		fetched[device.Id] = device
+	}
+	for _, device := range devices {
+		fetched[device.Id] = device
+	}
+
+	routes := make(map[string]string)
+	var report []routingRecord
+	route := func(device *cbiotcore.Device) string {
+		if dest, ok := routes[device.Id]; ok {
+			return dest
+		}
+		if full, ok := fetched[device.Id]; ok {
+			device = full
+		}
+		dest, routedBy := deviceRouter.Route(device)
+		routes[device.Id] = dest
+		record := routingRecord{DeviceId: device.Id, Destination: dest, RoutedBy: routedBy}
+		if dest == "" {
+			record.Detail = "no matching destination"
+			errorLogger.AddError(routingContext, device.Id, errors.New("no matching destination, device not migrated"))
+		}
+		report = append(report, record)
+		return dest
+	}
+
+	for _, device := range devices {
+		route(device)
+	}
+
+	gatewayIds := make([]string, 0, len(gatewayBindings))
+	for gatewayId := range gatewayBindings {
+		gatewayIds = append(gatewayIds, gatewayId)
+	}
+	sort.Strings(gatewayIds)
+
+	var problems []string
+	misrouted := make(map[string]string)
+	for _, gatewayId := range gatewayIds {
+		gatewayDest := route(&cbiotcore.Device{Id: gatewayId})
+		for _, bound := range gatewayBindings[gatewayId] {
+			if boundDest := route(bound); boundDest != gatewayDest {
+				detail := fmt.Sprintf("routed to %q but bound to gateway %s routed to %q", boundDest, gatewayId, gatewayDest)
+				misrouted[bound.Id] = detail
+				problems = append(problems, bound.Id+": "+detail)
+			}
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].DeviceId < report[j].DeviceId })
+	for i := range report {
+		if detail, ok := misrouted[report[i].DeviceId]; ok {
+			report[i].Detail = detail
+		}
+	}
+	reportFile := filepath.Join(Args.workDir, "routing_report.csv")
+	if err := writeRoutingReport(reportFile, report); err != nil {
+		log.Printf("Unable to write routing report: %s\n", err)
+	} else {
+		printfColored(colorGreen, " \u2713 Routing report written to %s", reportFile)
+	}
+
+	if len(problems) > 0 {
+		const maxShown = 20
+		printfColored(colorRed, " \u2715 %d bound devices are routed to a different registry than their gateway:", len(problems))
+		for i, p := range problems {
+			if i == maxShown {
+				printfColored(colorRed, "   ... and %d more", len(problems)-maxShown)
+				break
+			}
+			printfColored(colorRed, "   %s", p)
+		}
+		log.Fatalln("Aborting before any writes: route each gateway and its bound devices to the same destination and rerun")
+	}
+	return routes
+}
+
+func writeRoutingReport(path string, report []routingRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"deviceId", "destination", "routedBy", "detail"}); err != nil {
+		return err
+	}
+	for _, r := range report {
+		if err := w.Write([]string{r.DeviceId, r.Destination, r.RoutedBy, r.Detail}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// devicesForDestination returns the migration inputs routed to one destination.
+func devicesForDestination(name string, routes map[string]string, devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) ([]*cbiotcore.Device, map[string]interface{}, map[string][]*cbiotcore.Device) {
+	var destDevices []*cbiotcore.Device
+	for _, device := range devices {
+		if routes[device.Id] == name {
+			destDevices = append(destDevices, device)
+		}
+	}
+
+	var destConfigs map[string]interface{}
+	if deviceConfigs != nil {
+		destConfigs = make(map[string]interface{})
+		for id, config := range deviceConfigs {
+			if routes[id] == name {
+				destConfigs[id] = config
+			}
+		}
+	}
+
+	var destBindings map[string][]*cbiotcore.Device
+	for gatewayId, bound := range gatewayBindings {
+		if routes[gatewayId] != name {
+			continue
+		}
+		if destBindings == nil {
+			destBindings = make(map[string][]*cbiotcore.Device)
+		}
+		destBindings[gatewayId] = bound
+	}
+	return destDevices, destConfigs, destBindings
+}
+
+type splitSummary struct {
+	Destination  string
+	RegistryName string
+	Region       string
+	Devices      int
+	Gateways     int
+	Migrated     int
+	Failed       int
+	Status       string
+}
+
+// runSplitMigration migrates each destination's share of the devices in
+// turn. Every destination has its own work directory under
+// <workDir>/destinations/<name> holding its checkpoint, failed devices CSV
+// and reports. Destinations completed by an earlier run are skipped, and
+// incomplete ones, including any with a logged error, keep their checkpoint
+// so a rerun retries their failed devices. It reports whether every
+// destination is completed.
+func runSplitMigration(devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) bool {
+	routes := routeDevices(devices, gatewayBindings)
+
+	rootCheckpoint := GetCheckpoint()
+	rootWorkDir := Args.workDir
+	rootErrorLogger := errorLogger
+	defer func() {
+		Args.workDir = rootWorkDir
+		globalCheckpoint = rootCheckpoint
+		errorLogger = rootErrorLogger
+	}()
+
+	var summary []splitSummary
+	completed := true
+	for _, dest := range splitDestinations {
+		destDevices, destConfigs, destBindings := devicesForDestination(dest.Name, routes, devices, deviceConfigs, gatewayBindings)
+		row := splitSummary{
+			Destination:  dest.Name,
+			RegistryName: dest.Endpoint.RegistryName,
+			Region:       dest.Endpoint.Region,
+			Devices:      len(destDevices),
+			Gateways:     len(destBindings),
+		}
+
+		if rootCheckpoint.IsDestinationCompleted(dest.Name) {
+			printfColored(colorGreen, "\u2713 Destination %s already completed", dest.Name)
+			row.Status = "completed earlier"
+			summary = append(summary, row)
+			continue
+		}
+
+		printfColored(colorCyan, "================= Destination %s (%s, %s) =================", dest.Name, dest.Endpoint.RegistryName, dest.Endpoint.Region)
+		Args.workDir = filepath.Join(rootWorkDir, "destinations", dest.Name)
+		destinationEndpoint = dest.Endpoint
+		errorLogger = NewErrorLogger()
+		if err := InitializeCheckpointSystem(); err != nil {
+			log.Fatalf("Failed to initialize checkpoint for destination %s: %s\n", dest.Name, err)
+		}
+		// Devices were fetched once for all destinations.
+		if checkpoint := GetCheckpoint(); !checkpoint.IsPhaseCompleted(PhaseDeviceFetch) {
+			checkpoint.SetPhase(PhaseDeviceMigrate)
+		}
+
+		row.Migrated = migrateToDestination(destDevices, destConfigs, destBindings)
+		errorLogger.WriteToDir(Args.workDir)
+		// Config history and binding failures leave every device created, so
+		// the error log decides whether anything is left to retry.
+		row.Failed = len(errorLogger.DeviceIds())
+		if row.Migrated == len(destDevices) && row.Failed == 0 {
+			row.Status = "completed"
+			if err := GetCheckpoint().Complete(); err != nil {
+				printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup for destination %s: %s", dest.Name, err)
+			}
+			rootCheckpoint.AddCompletedDestination(dest.Name)
+		} else {
+			row.Status = "incomplete"
+			completed = false
+			if err := GetCheckpoint().Reopen(); err != nil {
+				printfColored(colorYellow, "Warning: Could not save checkpoint for destination %s: %s", dest.Name, err)
+			}
+			GetCheckpoint().Close()
+		}
+		summary = append(summary, row)
+	}
+
+	reportFile := filepath.Join(rootWorkDir, "split_summary.csv")
+	if err := writeSplitSummary(reportFile, summary); err != nil {
+		log.Printf("Unable to write split summary: %s\n", err)
+	} else {
+		printfColored(colorGreen, "\u2713 Split summary written to %s", reportFile)
+	}
+	for _, row := range summary {
+		switch row.Status {
+		case "completed earlier":
+			printfColored(colorGreen, " %s: completed by an earlier run", row.Destination)
+		case "incomplete":
+			printfColored(colorRed, " %s: migrated %d/%d devices, %d gateways, %d devices with errors", row.Destination, row.Migrated, row.Devices, row.Gateways, row.Failed)
+		default:
+			printfColored(colorGreen, " %s: migrated %d/%d devices, %d gateways", row.Destination, row.Migrated, row.Devices, row.Gateways)
+		}
+	}
+	return completed
+}
+
+func writeSplitSummary(path string, summary []splitSummary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"destination", "registryName", "region", "devices", "gateways", "migrated", "failed", "status"}); err != nil {
+		return err
+	}
+	for _, r := range summary {
+		if err := w.Write([]string{r.Destination, r.RegistryName, r.Region, strconv.Itoa(r.Devices), strconv.Itoa(r.Gateways), strconv.Itoa(r.Migrated), strconv.Itoa(r.Failed), r.Status}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
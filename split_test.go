@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+func splitTestDestinations() []*SplitDestination {
+	return []*SplitDestination{{Name: "acme"}, {Name: "globex"}}
+}
+
+func writeSplitTestCsv(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routing.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func setSplitTestArgs(t *testing.T, routeBy, defaultDestination, routingCsv string) {
+	t.Helper()
+	saved := Args
+	t.Cleanup(func() { Args = saved })
+	Args.routeBy = routeBy
+	Args.defaultDestination = defaultDestination
+	Args.routingCsv = routingCsv
+}
+
+func TestDeviceRouterRoute(t *testing.T) {
+	routingCsv := "deviceId,destination\nsensor-1,globex\nsensor-2,unknown\n"
+
+	devices := map[string]*cbiotcore.Device{
+		"acme-1":   {Id: "acme-1", Metadata: map[string]string{"customer": "globex"}},
+		"sensor-1": {Id: "sensor-1", Metadata: map[string]string{"customer": "acme"}},
+		"sensor-2": {Id: "sensor-2", Metadata: map[string]string{"customer": "initech"}},
+		"plain":    {Id: "plain"},
+	}
+
+	tests := []struct {
+		routeBy, defaultDestination string
+		want                        map[string][2]string
+	}{
+		{"metadata:customer", "", map[string][2]string{
+			"acme-1":   {"globex", RouteByMetadata},
+			"sensor-1": {"acme", RouteByMetadata},
+			"sensor-2": {"", ""},
+			"plain":    {"", ""},
+		}},
+		{"idPrefix:-", "globex", map[string][2]string{
+			"acme-1":   {"acme", RouteByIdPrefix},
+			"sensor-1": {"globex", "default"},
+			"sensor-2": {"globex", "default"},
+			"plain":    {"globex", "default"},
+		}},
+		{"csv", "", map[string][2]string{
+			"acme-1":   {"", ""},
+			"sensor-1": {"globex", RouteByCsv},
+			"sensor-2": {"", ""},
+			"plain":    {"", ""},
+		}},
+		{"", "acme", map[string][2]string{
+			"acme-1":   {"acme", "default"},
+			"sensor-1": {"acme", "default"},
+			"sensor-2": {"acme", "default"},
+			"plain":    {"acme", "default"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.routeBy, func(t *testing.T) {
+			setSplitTestArgs(t, tt.routeBy, tt.defaultDestination, writeSplitTestCsv(t, routingCsv))
+			router, err := NewDeviceRouterFromArgs(splitTestDestinations())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range tt.want {
+				dest, routedBy := router.Route(devices[id])
+				if dest != want[0] || routedBy != want[1] {
+					t.Errorf("Route(%s) = %q, %q, want %q, %q", id, dest, routedBy, want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestNewDeviceRouterFromArgsErrors(t *testing.T) {
+	tests := []struct {
+		routeBy, defaultDestination, routingCsv string
+		err                                     string
+	}{
+		{"metadata", "", "", "requires a key"},
+		{"idPrefix:", "", "", "requires a separator"},
+		{"csv", "", "", "requires -routingCsv"},
+		{"", "", "", "requires -routeBy or -defaultDestination"},
+		{"region:x", "", "", `invalid -routeBy "region:x"`},
+		{"idPrefix:-", "initech", "", `-defaultDestination "initech" is not listed`},
+	}
+	for _, tt := range tests {
+		setSplitTestArgs(t, tt.routeBy, tt.defaultDestination, tt.routingCsv)
+		_, err := NewDeviceRouterFromArgs(splitTestDestinations())
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("routeBy %q: err = %v, want %q", tt.routeBy, err, tt.err)
+		}
+	}
+}
+
+func TestReadRoutingCsv(t *testing.T) {
+	routes, err := readRoutingCsv(writeSplitTestCsv(t, "destination,deviceId\nacme,a\nglobex,b\nacme,a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "acme", "b": "globex"}; !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes = %v, want %v", routes, want)
+	}
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"", "is empty"},
+		{"id,destination\na,acme\n", "must have deviceId and destination columns"},
+		{"deviceId,destination\na,acme\na,globex\n", "line 3: a is routed to both acme and globex"},
+	}
+	for _, tt := range tests {
+		_, err := readRoutingCsv(writeSplitTestCsv(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("readRoutingCsv(%q) = %v, want %q", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestDevicesForDestination(t *testing.T) {
+	routes := map[string]string{"gw": "acme", "bound": "acme", "a": "acme", "g": "globex", "lost": ""}
+	devices := []*cbiotcore.Device{{Id: "gw"}, {Id: "a"}, {Id: "g"}, {Id: "lost"}}
+	configs := map[string]interface{}{"a": "history-a", "g": "history-g", "bound": "history-bound"}
+	bindings := map[string][]*cbiotcore.Device{"gw": {{Id: "bound"}}}
+
+	destDevices, destConfigs, destBindings := devicesForDestination("acme", routes, devices, configs, bindings)
+	if ids := mergedIdsOf(destDevices); !reflect.DeepEqual(ids, []string{"gw", "a"}) {
+		t.Errorf("devices = %v, want [gw a]", ids)
+	}
+	if want := map[string]interface{}{"a": "history-a", "bound": "history-bound"}; !reflect.DeepEqual(destConfigs, want) {
+		t.Errorf("configs = %v, want %v", destConfigs, want)
+	}
+	if len(destBindings) != 1 || len(destBindings["gw"]) != 1 {
+		t.Errorf("bindings = %v, want gw only", destBindings)
+	}
+
+	destDevices, destConfigs, destBindings = devicesForDestination("globex", routes, devices, nil, bindings)
+	if ids := mergedIdsOf(destDevices); !reflect.DeepEqual(ids, []string{"g"}) {
+		t.Errorf("devices = %v, want [g]", ids)
+	}
+	if destConfigs != nil || destBindings != nil {
+		t.Errorf("configs %v bindings %v, want none", destConfigs, destBindings)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// streamHistoryBatchSize is the number of devices whose config history is
+// uploaded to the destination in one request.
+const streamHistoryBatchSize = 100
+
+// validateStreamingFlags rejects the options that need every device of the
+// registry before the first one can be written.
+func validateStreamingFlags() {
+	if !Args.streaming {
+		return
+	}
+	if isMergeMode() || isSplitMode() || isDistributedMode() || archiveMode != "" {
+		log.Fatalln("-streaming cannot be used with -mergeSourcesCsv, -splitDestinationsCsv, -sharedDir or archives")
+	}
+	if Args.exportBatchSize != 0 || Args.exportConfigHistory {
+		log.Fatalln("-streaming cannot be used with -exportBatchSize or -exportConfigHistory")
+	}
+	if Args.idMappingCsv != "" || Args.idRenameTemplate != "" {
+		log.Fatalln("-streaming cannot be used with -idMappingCsv or -idRenameTemplate, since ID collisions are detected across the whole registry")
+	}
+	if Args.validationPolicy == ValidationPolicyAbort {
+		log.Fatalln("-streaming cannot be used with -validationPolicy=abort, since devices are written before the whole registry is validated")
+	}
+	if Args.manifestKey != "" {
+		log.Fatalln("-streaming cannot be used with -manifestKey, since the manifest covers the whole registry")
+	}
+}
+
+type pendingHistory struct {
+	device  *cbiotcore.Device
+	history map[string]interface{}
+}
+
+// streamingMigration moves devices from the source registry to the
+// destination page by page. Every stage is a worker pool whose AddTask blocks
+// while all workers are busy, so a slow stage holds back the ones before it
+// and only a few pages of devices are in memory at once.
+type streamingMigration struct {
+	checkpoint          *CheckpointState
+	filter              *DeviceFilter
+	cas                 []*x509.Certificate
+	sourceDevices       *cbiotcore.ProjectsLocationsRegistriesDevicesService
+	destinationService  *cbiotcore.Service
+	destinationDevices  *cbiotcore.ProjectsLocationsRegistriesDevicesService
+	destinationRegistry *cbiotcore.ProjectsLocationsRegistriesService
+
+	createPool  WorkerPool
+	historyPool WorkerPool
+	finishPool  WorkerPool
+	uploads     chan pendingHistory
+	progress    *progressBar
+
+	listed, selected, resumed, completed *counter
+	skipped, truncated, failedCA         *counter
+
+	mutex          sync.Mutex
+	readyGateways  []string
+	skippedIds     map[string]struct{}
+	versionResults []ConfigVersionResult
+}
+
+// runStreamingMigration migrates the source registry without loading it into
+// memory. Devices are created as soon as their page is listed, then their
+// config history is uploaded, and gateways are bound once every device has
+// been created. The stage each device reached is recorded in the checkpoint,
+// so an interrupted migration resumes where every device left off.
+func runStreamingMigration(sourceService *cbiotcore.Service) {
+	destinationService, err := destinationEndpoint.NewService()
+	if err != nil {
+		log.Fatalf("Unable to connect to destination registry: %s\n", err)
+	}
+	err = verifyRegistryDetails(destinationService, destinationEndpoint.RegistryName, destinationEndpoint.Region)
+	if err != nil {
+		log.Fatalf("Error verifying destination registry details: %s\n", err)
+	}
+
+	filter, err := NewDeviceFilterFromArgs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	s := &streamingMigration{
+		checkpoint:          GetCheckpoint(),
+		filter:              filter,
+		sourceDevices:       cbiotcore.NewProjectsLocationsRegistriesDevicesService(sourceService),
+		destinationService:  destinationService,
+		destinationDevices:  cbiotcore.NewProjectsLocationsRegistriesDevicesService(destinationService),
+		destinationRegistry: cbiotcore.NewProjectsLocationsRegistriesService(destinationService),
+		createPool:          NewWorkerPool(),
+		historyPool:         NewWorkerPool(),
+		finishPool:          NewWorkerPool(),
+		uploads:             make(chan pendingHistory, streamHistoryBatchSize),
+		listed:              newCounter(),
+		selected:            newCounter(),
+		resumed:             newCounter(),
+		completed:           newCounter(),
+		skipped:             newCounter(),
+		truncated:           newCounter(),
+		failedCA:            newCounter(),
+		skippedIds:          make(map[string]struct{}),
+	}
+
+	if Args.registryCACheck != CACheckOff {
+		s.cas, err = fetchRegistryCACertificates(destinationService)
+		if err != nil {
+			log.Fatalf("Unable to fetch destination registry CA certificates: %s\n", err)
+		}
+	}
+
+	if Args.cleanupCbRegistry {
+		deleteAllFromCbRegistry(destinationService)
+		printfColored(colorGreen, " \u2713 Successfully cleaned up destination ClearBlade registry")
+	}
+
+	s.createPool.Run()
+	s.historyPool.Run()
+	s.finishPool.Run()
+	uploaderDone := make(chan struct{})
+	go func() {
+		defer close(uploaderDone)
+		s.uploadHistory()
+	}()
+
+	s.progress = getSpinner("Streaming devices to destination registry...")
+	s.listDevices()
+	s.createPool.Wait()
+	s.historyPool.Wait()
+	close(s.uploads)
+	<-uploaderDone
+	s.finishPool.Wait()
+	s.progress.Finish()
+	s.printSummary()
+
+	s.bindGateways(sourceService)
+
+	// Every device went through every phase, so the phase records match
+	// those of a migration that ran the phases one after the other.
+	for _, phase := range []MigrationPhase{PhaseDeviceMigrate, PhaseConfigHistory, PhaseGatewayBinding, PhaseComplete} {
+		s.checkpoint.SetPhase(phase)
+	}
+	writeConflictReport()
+	saveConfigVersionReport(s.versionResults)
+
+	if err := s.checkpoint.Complete(); err != nil {
+		printfColored(colorYellow, "Warning: Could not complete checkpoint cleanup: %s", err)
+	}
+}
+
+// listDevices feeds the pipeline with the devices of -devicesCsv, or with
+// every device of the source registry, one page at a time.
+func (s *streamingMigration) listDevices() {
+	if Args.devicesCsvFile == "" {
+		req := s.sourceDevices.List(getCBSourceRegistryPath()).PageSize(Args.pageSize)
+		if err := paginatedFetchPages(req, s.dispatch); err != nil {
+			log.Fatalln("Error fetching all devices: ", err)
+		}
+		return
+	}
+
+	csvData, err := readCsvFile(Args.devicesCsvFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceIds, err := parseDeviceIds(csvData)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fetchPool := NewWorkerPool()
+	fetchPool.Run()
+	for start := 0; start < len(deviceIds); start += int(Args.pageSize) {
+		end := min(start+int(Args.pageSize), len(deviceIds))
+		page := make([]*cbiotcore.Device, end-start)
+		for i, deviceId := range deviceIds[start:end] {
+			fetchPool.AddTask(func() {
+				device, err := s.sourceDevices.Get(getCBSourceDevicePath(deviceId)).Do()
+				if err != nil {
+					log.Fatalln("Error fetching csv device: ", err.Error())
+				}
+				page[i] = device
+			})
+		}
+		fetchPool.Wait()
+		s.dispatch(page)
+	}
+}
+
+// dispatch selects and validates the devices of one page and sends each to
+// the stage after the last one it completed.
+func (s *streamingMigration) dispatch(page []*cbiotcore.Device) {
+	for _, device := range page {
+		s.listed.Increment()
+		device = s.selectDevice(device)
+		if device == nil {
+			continue
+		}
+		s.selected.Increment()
+
+		stage := s.checkpoint.GetDeviceStage(device.Id, deviceGatewayType(device) == "GATEWAY")
+		if stage != StageNone {
+			// Only devices that are created are transformed.
+			migrationRules.Forget(device.Id)
+		}
+		switch stage {
+		case StageNone:
+			s.createPool.AddTask(func() {
+				if _, ok := createDevice(s.destinationDevices, device); !ok {
+					return
+				}
+				s.checkpoint.SetDeviceStage(device.Id, StageCreated)
+				s.migrateHistory(device)
+			})
+		case StageCreated:
+			s.resumed.Increment()
+			s.migrateHistory(device)
+		case StageHistory:
+			s.resumed.Increment()
+			s.addReadyGateway(device.Id)
+			s.progress.Add(1)
+		default:
+			s.resumed.Increment()
+			s.completed.Increment()
+			s.progress.Add(1)
+		}
+	}
+}
+
+// selectDevice applies the selection filters, -validationPolicy and
+// -registryCACheck to a device. It returns the device to migrate, or nil. The
+// rewrite rules are prepared last, from the device as listed, so that only
+// devices that are migrated keep a prepared result until they are created.
+func (s *streamingMigration) selectDevice(device *cbiotcore.Device) *cbiotcore.Device {
+	listed := device
+	if !s.filter.Matches(device) {
+		return nil
+	}
+	ok, err := migrationRules.Selects(device)
+	if err != nil {
+		errorLogger.AddError(rulesContext, device.Id, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	if Args.validationPolicy != ValidationPolicyOff {
+		if violations := validateDevice(device); len(violations) > 0 {
+			if Args.validationPolicy == ValidationPolicyTruncate && allFixable(violations) {
+				s.truncated.Increment()
+				device = truncateDevice(device)
+			} else {
+				s.skipped.Increment()
+				s.mutex.Lock()
+				s.skippedIds[device.Id] = struct{}{}
+				s.mutex.Unlock()
+				for _, v := range violations {
+					errorLogger.AddError("Validation: "+v.Rule, v.DeviceId, errors.New(v.Detail))
+				}
+				return nil
+			}
+		}
+	}
+
+	if len(s.cas) > 0 {
+		verified := true
+		for _, result := range verifyDeviceAgainstCAs(device, s.cas) {
+			if !result.Verified {
+				verified = false
+				errorLogger.AddError(caVerificationContext, device.Id, errors.New(result.Detail))
+			}
+		}
+		if !verified {
+			s.failedCA.Increment()
+			if Args.registryCACheck == CACheckSkip {
+				return nil
+			}
+		}
+	}
+	if migrationRules.Prepare(listed) != nil {
+		return nil
+	}
+	return device
+}
+
+// migrateHistory fetches the config history of a created device and queues
+// it for upload.
+func (s *streamingMigration) migrateHistory(device *cbiotcore.Device) {
+	if !Args.configHistory {
+		s.finishPool.AddTask(func() { s.finish(device) })
+		return
+	}
+	s.historyPool.AddTask(func() {
+		history, err := fetchConfigVersionHistory(device, s.sourceDevices)
+		if err != nil {
+			errorLogger.AddError("Fetch Config History", device.Id, err)
+			return
+		}
+		if len(history) == 0 || (Args.skipMatchingConfigHistory && destinationHistoryMatches(s.destinationDevices, device.Id, history)) {
+			s.finishPool.AddTask(func() { s.finish(device) })
+			return
+		}
+		s.uploads <- pendingHistory{device: device, history: history}
+	})
+}
+
+// uploadHistory uploads queued config history in batches of
+// streamHistoryBatchSize devices until the queue is closed.
+func (s *streamingMigration) uploadHistory() {
+	batch := make([]pendingHistory, 0, streamHistoryBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		deviceConfigs := make(map[string]interface{}, len(batch))
+		for _, pending := range batch {
+			deviceConfigs[pending.device.Id] = pending.history
+		}
+		err := uploadConfigHistory(s.destinationService, deviceConfigs)
+		for _, pending := range batch {
+			deviceErr := err
+			// One device can fail the whole request, so the devices of a
+			// failed batch are retried one at a time.
+			if deviceErr != nil && len(batch) > 1 {
+				single := map[string]interface{}{pending.device.Id: pending.history}
+				deviceErr = uploadConfigHistory(s.destinationService, single)
+			}
+			if deviceErr != nil {
+				errorLogger.AddError("Config History", pending.device.Id, deviceErr)
+				continue
+			}
+			s.finishPool.AddTask(func() { s.finish(pending.device) })
+		}
+		batch = batch[:0]
+	}
+
+	for pending := range s.uploads {
+		batch = append(batch, pending)
+		if len(batch) == streamHistoryBatchSize {
+			flush()
+		}
+	}
+	flush()
+}
+
+// finish aligns the config version of a device whose history was migrated.
+// Gateways are kept for binding, all other devices are complete.
+func (s *streamingMigration) finish(device *cbiotcore.Device) {
+	if Args.preserveConfigVersions && !conflictReport.Untouched(device.Id) {
+		result := alignConfigVersion(s.destinationService, device)
+		if result.Status == "failed" || result.Status == "not aligned" {
+			errorLogger.AddError(configVersionContext, device.Id, errors.New(result.Detail))
+		}
+		if result.Status != "aligned" {
+			s.mutex.Lock()
+			s.versionResults = append(s.versionResults, result)
+			s.mutex.Unlock()
+		}
+	}
+
+	if deviceGatewayType(device) == "GATEWAY" {
+		s.checkpoint.SetDeviceStage(device.Id, StageHistory)
+		s.addReadyGateway(device.Id)
+	} else {
+		s.checkpoint.SetDeviceStage(device.Id, StageComplete)
+		s.completed.Increment()
+	}
+	s.progress.Add(1)
+}
+
+func (s *streamingMigration) addReadyGateway(gatewayID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readyGateways = append(s.readyGateways, gatewayID)
+}
+
+// bindGateways binds the bound devices of every gateway that reached the
+// history stage. It runs after all devices were created, because bound
+// devices can be listed on any page of the source registry.
+func (s *streamingMigration) bindGateways(sourceService *cbiotcore.Service) {
+	if len(s.readyGateways) == 0 {
+		return
+	}
+
+	bar := getProgressBar(len(s.readyGateways), "Migrating bound devices for gateways...")
+	defer bar.Finish()
+	parent := getCBRegistryPath()
+	wp := NewWorkerPool()
+	wp.Run()
+	for _, gatewayID := range s.readyGateways {
+		wp.AddTask(func() {
+			defer bar.Add(1)
+			registryPath, sourceGatewayId := sourceLocation(gatewayID)
+			req := s.sourceDevices.List(registryPath).GatewayListOptionsAssociationsGatewayId(sourceGatewayId).PageSize(Args.pageSize)
+			boundDevices, err := paginatedFetch(req, "")
+			if err != nil {
+				errorLogger.AddError("Fetch Bound Devices", gatewayID, err)
+				return
+			}
+			// Bound devices are created if missing, so they are validated like
+			// selected ones. Listing has finished, so skippedIds is complete.
+			bindings := map[string][]*cbiotcore.Device{gatewayID: boundDevices}
+			skipped, bindings := validateGatewayBindings(bindings, s.skippedIds)
+			_, _, bindings = excludeDevices(skipped, nil, nil, bindings)
+			bindGatewayDevices(s.destinationDevices, s.destinationRegistry, parent, gatewayID, bindings[gatewayID])
+			s.checkpoint.AddProcessedGateway(gatewayID)
+			s.checkpoint.SetDeviceStage(gatewayID, StageComplete)
+		})
+	}
+	wp.Wait()
+	printfColored(colorGreen, "\u2713 Done migrating bound devices for gateways")
+}
+
+func (s *streamingMigration) printSummary() {
+	printfColored(colorGreen, "\u2713 Selected %d/%d listed devices, %d resumed from checkpoint", s.selected.Count(), s.listed.Count(), s.resumed.Count())
+	if s.truncated.Count() > 0 {
+		printfColored(colorYellow, " Truncated %d devices to fit IoT Core limits", s.truncated.Count())
+	}
+	if s.skipped.Count() > 0 {
+		printfColored(colorYellow, " Skipped %d devices that violate IoT Core limits", s.skipped.Count())
+	}
+	if s.failedCA.Count() > 0 {
+		printfColored(colorYellow, " %d devices have certificates not signed by a registry CA", s.failedCA.Count())
+	}
+
+	done := s.completed.Count() + len(s.readyGateways)
+	if done == s.selected.Count() {
+		printfColored(colorGreen, " \u2713 Migrated %d/%d devices and gateways", done, s.selected.Count())
+	} else {
+		printfColored(colorRed, " \u2715 Failed to migrate all devices. Migrated %d/%d devices", done, s.selected.Count())
+	}
+}
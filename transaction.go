@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+const transactionContext = "Device Transaction"
+
+func validateTransactionFlags() {
+	if Args.perDeviceTransaction && Args.streaming {
+		log.Fatalln("-perDeviceTransaction cannot be used with -streaming")
+	}
+	// A rollback only deletes the devices a unit created. Changes to existing
+	// devices, such as patched fields, config history or config versions,
+	// cannot be undone.
+	if Args.perDeviceTransaction && Args.onConflict != ConflictSkip && Args.onConflict != ConflictFail {
+		log.Fatalf("-perDeviceTransaction cannot roll back changes to existing devices. Use it with -onConflict skip or fail, not %s\n", Args.onConflict)
+	}
+}
+
+// migrationUnit is a device, or gateways together with the devices bound to
+// them, that is migrated as a whole with -perDeviceTransaction.
+type migrationUnit struct {
+	key     string
+	devices []*cbiotcore.Device
+	// boundOnly are bound devices that were not selected. As in a migration
+	// by phases, they are only created if missing.
+	boundOnly []*cbiotcore.Device
+	gateways  []string
+}
+
+// buildMigrationUnits groups devices into units, keeping gateways with the
+// devices bound to them. A unit is named after its smallest device ID.
+func buildMigrationUnits(devices []*cbiotcore.Device, gatewayBindings map[string][]*cbiotcore.Device) []*migrationUnit {
+	selected := make(map[string]struct{}, len(devices))
+	for _, device := range devices {
+		selected[device.Id] = struct{}{}
+	}
+
+	all := append([]*cbiotcore.Device(nil), devices...)
+	seen := make(map[string]struct{})
+	for _, device := range devices {
+		for _, bound := range gatewayBindings[device.Id] {
+			if _, ok := selected[bound.Id]; ok {
+				continue
+			}
+			if _, ok := seen[bound.Id]; ok {
+				continue
+			}
+			seen[bound.Id] = struct{}{}
+			all = append(all, bound)
+		}
+	}
+
+	var units []*migrationUnit
+	for _, group := range gatewayGroups(all, gatewayBindings) {
+		unit := &migrationUnit{key: group[0].Id}
+		for _, device := range group {
+			if device.Id < unit.key {
+				unit.key = device.Id
+			}
+			if _, ok := selected[device.Id]; !ok {
+				unit.boundOnly = append(unit.boundOnly, device)
+				continue
+			}
+			unit.devices = append(unit.devices, device)
+			if _, ok := gatewayBindings[device.Id]; ok {
+				unit.gateways = append(unit.gateways, device.Id)
+			}
+		}
+		units = append(units, unit)
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].key < units[j].key })
+	return units
+}
+
+// contains returns a device of the unit that is in deviceIds, if any.
+func (u *migrationUnit) contains(deviceIds map[string]struct{}) (string, bool) {
+	for _, devices := range [][]*cbiotcore.Device{u.devices, u.boundOnly} {
+		for _, device := range devices {
+			if _, ok := deviceIds[device.Id]; ok {
+				return device.Id, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (u *migrationUnit) deviceIds() []string {
+	ids := make([]string, len(u.devices))
+	for i, device := range u.devices {
+		ids[i] = device.Id
+	}
+	return ids
+}
+
+type unitMigration struct {
+	service         *cbiotcore.Service
+	deviceService   *cbiotcore.ProjectsLocationsRegistriesDevicesService
+	registryService *cbiotcore.ProjectsLocationsRegistriesService
+	checkpoint      *CheckpointState
+	deviceConfigs   map[string]interface{}
+	gatewayBindings map[string][]*cbiotcore.Device
+
+	mutex          sync.Mutex
+	versionResults []ConfigVersionResult
+}
+
+// migrateDeviceUnits migrates each device, or each gateway with its bound
+// devices, through every phase before moving on: create, config history,
+// config version and gateway bindings. If a step fails, the devices the unit
+// created are deleted again. A unit is recorded as complete in the
+// checkpoint in a single update, so every device the checkpoint records as
+// migrated is fully migrated. It returns the number of devices migrated.
+func migrateDeviceUnits(service *cbiotcore.Service, devices []*cbiotcore.Device, deviceConfigs map[string]interface{}, gatewayBindings map[string][]*cbiotcore.Device) int {
+	m := &unitMigration{
+		service:         service,
+		deviceService:   cbiotcore.NewProjectsLocationsRegistriesDevicesService(service),
+		registryService: cbiotcore.NewProjectsLocationsRegistriesService(service),
+		checkpoint:      GetCheckpoint(),
+		deviceConfigs:   deviceConfigs,
+		gatewayBindings: gatewayBindings,
+	}
+	leftover := m.rollbackInterruptedUnits()
+
+	units := buildMigrationUnits(devices, gatewayBindings)
+	migrated := newCounter()
+	var remaining []*migrationUnit
+	for _, unit := range units {
+		if m.isComplete(unit) {
+			migrated.Add(len(unit.devices))
+			continue
+		}
+		// A unit with devices that could not be rolled back would take them
+		// for existing devices. It waits until they are deleted.
+		if deviceId, ok := unit.contains(leftover); ok {
+			for _, device := range unit.devices {
+				errorLogger.AddError(transactionContext, device.Id, fmt.Errorf("unit %s not migrated: %s of an interrupted unit could not be deleted", unit.key, deviceId))
+			}
+			continue
+		}
+		remaining = append(remaining, unit)
+	}
+
+	rolledBack := newCounter()
+	if len(remaining) == 0 {
+		printfColored(colorGreen, "\u2713 All device units already migrated")
+	} else {
+		bar := getProgressBar(len(remaining), "Migrating devices and gateways as units...")
+		wp := NewWorkerPool()
+		wp.Run()
+		for _, unit := range remaining {
+			wp.AddTask(func() {
+				defer bar.Add(1)
+				created, err := m.migrate(unit)
+				if err != nil {
+					m.rollback(unit.key, created)
+					for _, device := range unit.devices {
+						errorLogger.AddError(transactionContext, device.Id, fmt.Errorf("unit %s rolled back: %w", unit.key, err))
+					}
+					rolledBack.Increment()
+					return
+				}
+				m.checkpoint.CompleteUnit(unit.key, unit.deviceIds(), unit.gateways)
+				migrated.Add(len(unit.devices))
+			})
+		}
+		wp.Wait()
+		bar.Finish()
+	}
+
+	if migrated.Count() == len(devices) {
+		printfColored(colorGreen, " \u2713 Migrated %d/%d devices and gateways in %d units", migrated.Count(), len(devices), len(units))
+	} else {
+		printfColored(colorRed, " \u2715 Failed to migrate all devices. Migrated %d/%d devices, rolled back %d units", migrated.Count(), len(devices), rolledBack.Count())
+	}
+
+	// Every unit went through every phase, so the phase records match those
+	// of a migration that ran the phases one after the other.
+	for _, phase := range []MigrationPhase{PhaseDeviceMigrate, PhaseConfigHistory, PhaseGatewayBinding, PhaseComplete} {
+		m.checkpoint.SetPhase(phase)
+	}
+	writeConflictReport()
+	saveConfigVersionReport(m.versionResults)
+	return migrated.Count()
+}
+
+// isComplete reports whether every device of the unit was migrated, by an
+// earlier run with or without -perDeviceTransaction.
+func (m *unitMigration) isComplete(unit *migrationUnit) bool {
+	for _, device := range unit.devices {
+		if m.checkpoint.GetDeviceStage(device.Id, deviceGatewayType(device) == "GATEWAY") != StageComplete {
+			return false
+		}
+	}
+	return true
+}
+
+// migrate runs every step of the unit and returns the devices it created,
+// which are recorded in the checkpoint until the unit is complete.
+func (m *unitMigration) migrate(unit *migrationUnit) (created []string, err error) {
+	for _, device := range unit.devices {
+		_, err := m.deviceService.Get(getCBDevicePath(device.Id)).Do()
+		if err != nil && !strings.Contains(err.Error(), "Error 404") {
+			errorLogger.AddError("Get Device", device.Id, err)
+			return created, fmt.Errorf("device %s could not be fetched", device.Id)
+		}
+		exists := err == nil
+		if !exists {
+			if err := m.recordCreate(unit.key, device.Id); err != nil {
+				return created, err
+			}
+			created = append(created, device.Id)
+		}
+		isNew, ok := createDevice(m.deviceService, device)
+		if !exists && !isNew && ok {
+			// Another process created the device after the Get. It is
+			// left alone like any other existing device.
+			created = created[:len(created)-1]
+			if err := m.checkpoint.RemoveUnitCreatedDevice(unit.key, device.Id); err != nil {
+				printfColored(colorYellow, "Warning: %v", err)
+			}
+		}
+		if !ok {
+			return created, fmt.Errorf("device %s could not be created", device.Id)
+		}
+	}
+	for _, device := range unit.boundOnly {
+		_, err := m.deviceService.Get(getCBDevicePath(device.Id)).Do()
+		if err == nil {
+			continue
+		}
+		if !strings.Contains(err.Error(), "Error 404") {
+			errorLogger.AddError("Get Bound Device", device.Id, err)
+			return created, fmt.Errorf("bound device %s could not be fetched", device.Id)
+		}
+		cbDevice, err := transform(device)
+		if err != nil {
+			return created, fmt.Errorf("rewrite rules failed for bound device %s", device.Id)
+		}
+		if err := m.recordCreate(unit.key, device.Id); err != nil {
+			return created, err
+		}
+		created = append(created, device.Id)
+		if _, err := m.deviceService.Create(getCBRegistryPath(), cbDevice).Do(); err != nil {
+			errorLogger.AddError("Create Bound Device", device.Id, err)
+			return created, fmt.Errorf("bound device %s could not be created", device.Id)
+		}
+	}
+
+	if err := m.uploadHistory(unit); err != nil {
+		return created, err
+	}
+
+	if Args.preserveConfigVersions {
+		for _, device := range unit.devices {
+			if conflictReport.Untouched(device.Id) {
+				continue
+			}
+			result := alignConfigVersion(m.service, device)
+			if result.Status != "aligned" {
+				m.mutex.Lock()
+				m.versionResults = append(m.versionResults, result)
+				m.mutex.Unlock()
+			}
+			switch result.Status {
+			case "failed":
+				errorLogger.AddError(configVersionContext, device.Id, errors.New(result.Detail))
+				return created, fmt.Errorf("config version of %s could not be aligned", device.Id)
+			case "not aligned":
+				errorLogger.AddError(configVersionContext, device.Id, errors.New(result.Detail))
+			}
+		}
+	}
+
+	for _, gatewayID := range unit.gateways {
+		if failed := bindGatewayDevices(m.deviceService, m.registryService, getCBRegistryPath(), gatewayID, m.gatewayBindings[gatewayID]); failed > 0 {
+			return created, fmt.Errorf("%d devices could not be bound to gateway %s", failed, gatewayID)
+		}
+	}
+	return created, nil
+}
+
+// recordCreate saves the device a unit is about to create with the units in
+// progress before it is created, so that an interrupted migration can always
+// find and delete it.
+func (m *unitMigration) recordCreate(unit, deviceId string) error {
+	if err := m.checkpoint.AddUnitCreatedDevice(unit, deviceId); err != nil {
+		return fmt.Errorf("%s could not be recorded before it is created: %w", deviceId, err)
+	}
+	return nil
+}
+
+// uploadHistory uploads the config history of the unit's devices in one
+// request. Existing devices left untouched by -onConflict skip get none, so
+// a rollback never leaves changes behind on them.
+func (m *unitMigration) uploadHistory(unit *migrationUnit) error {
+	if m.deviceConfigs == nil {
+		return nil
+	}
+	deviceConfigs := make(map[string]interface{})
+	for _, device := range unit.devices {
+		if conflictReport.Untouched(device.Id) {
+			continue
+		}
+		if history, ok := m.deviceConfigs[device.Id]; ok {
+			deviceConfigs[device.Id] = history
+		}
+	}
+	deviceConfigs = trimDeviceConfigs(deviceConfigs)
+	if Args.skipMatchingConfigHistory {
+		for deviceId, history := range deviceConfigs {
+			historyMap, _ := history.(map[string]interface{})
+			if historyMap != nil && destinationHistoryMatches(m.deviceService, deviceId, historyMap) {
+				delete(deviceConfigs, deviceId)
+			}
+		}
+	}
+	if len(deviceConfigs) == 0 {
+		return nil
+	}
+
+	if err := uploadConfigHistory(m.service, deviceConfigs); err != nil {
+		for deviceId := range deviceConfigs {
+			errorLogger.AddError("Config History", deviceId, err)
+		}
+		return fmt.Errorf("config history could not be uploaded: %w", err)
+	}
+	return nil
+}
+
+// rollback deletes the devices a unit created or was about to create.
+// Gateways are unbound first, since a gateway with bound devices cannot be
+// deleted. Devices that were never created are ignored, and devices that
+// existed before the unit started are left as they are. Devices that could
+// not be deleted stay recorded for the next run, and are returned.
+func (m *unitMigration) rollback(unit string, created []string) []string {
+	parent := getCBRegistryPath()
+	var remaining []string
+	for _, deviceId := range created {
+		device, err := m.deviceService.Get(getCBDevicePath(deviceId)).Do()
+		if err != nil {
+			if !strings.Contains(err.Error(), "Error 404") {
+				errorLogger.AddError("Rollback", deviceId, err)
+				remaining = append(remaining, deviceId)
+			}
+			continue
+		}
+		if deviceGatewayType(device) == "GATEWAY" {
+			unbindFromGatewayIfAlreadyExistsInCBRegistry(destinationDeviceId(deviceId), parent, m.deviceService, m.registryService)
+		}
+		_, err = m.deviceService.Delete(getCBDevicePath(deviceId)).Do()
+		if err != nil && !strings.Contains(err.Error(), "Error 404") {
+			errorLogger.AddError("Rollback", deviceId, err)
+			remaining = append(remaining, deviceId)
+		}
+	}
+	if err := m.checkpoint.RollbackUnit(unit, remaining); err != nil {
+		printfColored(colorYellow, "Warning: %v", err)
+	}
+	if len(remaining) > 0 {
+		printfColored(colorRed, " \u2715 Unit %s: %d devices could not be rolled back. They are retried when the migration is resumed", unit, len(remaining))
+	}
+	return remaining
+}
+
+// rollbackInterruptedUnits deletes the devices created by units that were in
+// progress when an earlier run stopped, so that those units start over. It
+// returns the devices that could still not be deleted.
+func (m *unitMigration) rollbackInterruptedUnits() map[string]struct{} {
+	units := m.checkpoint.GetUnitsInProgress()
+	if len(units) == 0 {
+		return nil
+	}
+	devices := 0
+	for _, created := range units {
+		devices += len(created)
+	}
+	printfColored(colorYellow, "Rolling back %d devices created by %d interrupted units", devices, len(units))
+	leftover := make(map[string]struct{})
+	for unit, created := range units {
+		for _, deviceId := range m.rollback(unit, created) {
+			leftover[deviceId] = struct{}{}
+		}
+	}
+	return leftover
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
@@ -14,10 +15,6 @@ type GCPConfig struct {
 	Project_id string `json:"project_id"`
 }
 
-type CBConfig struct {
-	Project string `json:"project"`
-}
-
 type ErrorLog struct {
 	Context  string
 	Error    error
@@ -50,22 +47,42 @@ func (el *ErrorLogger) AddErrorLog(log ErrorLog) {
 	el.logs = append(el.logs, log)
 }
 
-func (el *ErrorLogger) WriteToFile() {
+// DeviceIds returns the IDs of all devices with at least one logged error.
+func (el *ErrorLogger) DeviceIds() map[string]struct{} {
 	el.lock.Lock()
 	defer el.lock.Unlock()
+	ids := make(map[string]struct{}, len(el.logs))
+	for _, l := range el.logs {
+		ids[l.DeviceId] = struct{}{}
+	}
+	return ids
+}
 
-	if len(el.logs) == 0 {
+func (el *ErrorLogger) WriteToFile() {
+	if Args.failedDevicesDir != "" {
+		el.WriteToDir(Args.failedDevicesDir)
 		return
 	}
-
 	currDir, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Failed to get current directory: %v", err)
 	}
+	el.WriteToDir(currDir)
+}
 
-	failedDevicesFile := fmt.Sprint(currDir, "/failed_devices_", time.Now().Format("2006-01-02T15:04:05"), ".csv")
+// WriteToDir writes the failed devices CSV to dir instead of the current
+// directory.
+func (el *ErrorLogger) WriteToDir(dir string) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	if len(el.logs) == 0 {
+		return
+	}
+
+	failedDevicesFile := filepath.Join(dir, fmt.Sprint("failed_devices_", time.Now().Format("2006-01-02T15:04:05"), ".csv"))
 	if runtime.GOOS == "windows" {
-		failedDevicesFile = fmt.Sprint(currDir, "\\failed_devices_", time.Now().Format("2006-01-02T15-04-05"), ".csv")
+		failedDevicesFile = filepath.Join(dir, fmt.Sprint("failed_devices_", time.Now().Format("2006-01-02T15-04-05"), ".csv"))
 	}
 
 	f, err := os.OpenFile(failedDevicesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -113,6 +130,12 @@ func (c *counter) Increment() {
 	c.count++
 }
 
+func (c *counter) Add(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.count += n
+}
+
 func (c *counter) Count() int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -2,19 +2,23 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/csv"
-	"encoding/json"
 	"errors"
 	"fmt"
 	cbiotcore "github.com/clearblade/go-iot"
 	"github.com/k0kubun/go-ansi"
 	"github.com/schollz/progressbar/v3"
+	"google.golang.org/api/googleapi"
+	"io"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
+	"time"
 )
 
 var (
@@ -53,7 +57,18 @@ func readCsvFile(filePath string) ([][]string, error) {
 	}
 	defer f.Close()
 
-	records, err := csv.NewReader(f).ReadAll()
+	// Batch files exported with -exportGzip can be passed back as -devicesCsv.
+	var r io.Reader = f
+	if strings.HasSuffix(filePath, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip file: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CSV: %w", err)
 	}
@@ -61,12 +76,12 @@ func readCsvFile(filePath string) ([][]string, error) {
 	return records, nil
 }
 
-func parseDeviceIds(rows [][]string) []string {
+func parseDeviceIds(rows [][]string) ([]string, error) {
 	printfColored(colorGreen, "\u2713 Parsing device IDs")
 	var deviceIDs []string
 
 	if len(rows) == 0 {
-		log.Fatal("empty CSV file")
+		return nil, errors.New("empty CSV file")
 	}
 
 	header := rows[0]
@@ -78,7 +93,7 @@ func parseDeviceIds(rows [][]string) []string {
 		}
 	}
 	if idx == -1 {
-		log.Fatal("deviceId column not found")
+		return nil, errors.New("deviceId column not found")
 	}
 
 	for _, row := range rows[1:] {
@@ -87,42 +102,26 @@ func parseDeviceIds(rows [][]string) []string {
 		}
 	}
 
-	return deviceIDs
-}
-
-func getCBProjectID(filePath string) string {
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Fatalln("Error when opening json file: ", err)
-	}
-
-	var payload CBConfig
-	err = json.Unmarshal(content, &payload)
-	if err != nil {
-		log.Fatalln("Error during Unmarshal(): ", err)
-	}
-
-	return payload.Project
+	return deviceIDs, nil
 }
 
 func getCBSourceDevicePath(deviceId string) string {
-	return fmt.Sprintf("%s/devices/%s", getCBSourceRegistryPath(), deviceId)
+	registryPath, sourceId := sourceLocation(deviceId)
+	return registryPath + "/devices/" + sourceId
 }
 
 func getCBSourceRegistryPath() string {
-	val, _ := getAbsPath(Args.cbSourceServiceAccount)
-	parent := fmt.Sprintf("projects/%s/locations/%s/registries/%s", getCBProjectID(val), Args.cbSourceRegion, Args.cbSourceRegistryName)
-	return parent
+	return sourceEndpoint.RegistryPath()
 }
 
 func getCBRegistryPath() string {
-	val, _ := getAbsPath(Args.cbServiceAccount)
-	parent := fmt.Sprintf("projects/%s/locations/%s/registries/%s", getCBProjectID(val), Args.cbRegistryRegion, Args.cbRegistryName)
-	return parent
+	return destinationEndpoint.RegistryPath()
 }
 
+// getCBDevicePath returns the destination path of a source device, applying
+// any configured device ID mapping.
 func getCBDevicePath(deviceId string) string {
-	return fmt.Sprintf("%s/devices/%s", getCBRegistryPath(), deviceId)
+	return destinationEndpoint.DevicePath(destinationDeviceId(deviceId))
 }
 
 func readInput(msg string) (string, error) {
@@ -202,29 +201,36 @@ func paginatedFetch(req PaginatedRequest, spinnerDesc string) ([]*cbiotcore.Devi
 		defer spinner.Finish()
 	}
 
-	resp, err := req.Do()
+	var allDevices []*cbiotcore.Device
+	err := paginatedFetchPages(req, func(devices []*cbiotcore.Device) {
+		allDevices = append(allDevices, devices...)
+		if spinner != nil {
+			spinner.Add(len(devices))
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
+	return allDevices, nil
+}
 
-	var allDevices []*cbiotcore.Device
-	allDevices = append(allDevices, resp.Devices...)
-	if spinner != nil {
-		spinner.Add(len(resp.Devices))
+// paginatedFetchPages calls page with each page of devices as it is fetched,
+// so callers can process a registry without holding all of it in memory.
+func paginatedFetchPages(req PaginatedRequest, page func(devices []*cbiotcore.Device)) error {
+	resp, err := req.Do()
+	if err != nil {
+		return err
 	}
+	page(resp.Devices)
 
 	for resp.NextPageToken != "" {
 		resp, err = req.PageToken(resp.NextPageToken).Do()
 		if err != nil {
-			return nil, err
-		}
-		allDevices = append(allDevices, resp.Devices...)
-		if spinner != nil {
-			spinner.Add(len(resp.Devices))
+			return err
 		}
+		page(resp.Devices)
 	}
-
-	return allDevices, nil
+	return nil
 }
 
 func getAbsPath(path string) (string, error) {
@@ -246,10 +252,31 @@ func getAbsPath(path string) (string, error) {
 	return filepath.Join(dir, path[1:]), nil
 }
 
-func transform(device *cbiotcore.Device) *cbiotcore.Device {
+// transform builds the destination copy of a source device with the rewrite
+// rules applied. It fails if the rules fail for the device, which the rule
+// set has already logged.
+func transform(device *cbiotcore.Device) (*cbiotcore.Device, error) {
+	cbDevice := transformDevice(device)
+	if !migrationRules.hasRewrites() {
+		return cbDevice, nil
+	}
+	if err := migrationRules.ApplyPrepared(device, cbDevice); err != nil {
+		return nil, err
+	}
+	// Rewrites can add metadata, so the result is validated again.
+	return validateRewrittenDevice(device.Id, cbDevice)
+}
+
+// transformDevice builds the destination copy of a source device, before any
+// rewrite rules are applied.
+func transformDevice(device *cbiotcore.Device) *cbiotcore.Device {
 	parsedCreds := make([]*cbiotcore.DeviceCredential, 0)
 	if Args.updatePublicKeys {
+		now := time.Now()
 		for _, creds := range device.Credentials {
+			if Args.dropExpiredCredentials && credentialExpired(creds, now) {
+				continue
+			}
 			parsedCreds = append(parsedCreds, &cbiotcore.DeviceCredential{
 				ExpirationTime: creds.ExpirationTime,
 				PublicKey: &cbiotcore.PublicKeyCredential{
@@ -260,13 +287,14 @@ func transform(device *cbiotcore.Device) *cbiotcore.Device {
 		}
 	}
 
+	destId := destinationDeviceId(device.Id)
 	cbDevice := &cbiotcore.Device{
-		Id:          device.Id,
+		Id:          destId,
 		Blocked:     device.Blocked,
 		Credentials: parsedCreds,
 		LogLevel:    device.LogLevel,
 		Metadata:    device.Metadata,
-		Name:        device.Id,
+		Name:        destId,
 		NumId:       device.NumId,
 	}
 
@@ -291,44 +319,21 @@ func transform(device *cbiotcore.Device) *cbiotcore.Device {
 	return cbDevice
 }
 
-func ExportDeviceBatches(devices []*cbiotcore.Device, batchSize int64) {
-	batches := make(map[int][]*cbiotcore.Device)
-
-	for i, device := range devices {
-		batchNumber := i / int(batchSize)
-		batches[batchNumber] = append(batches[batchNumber], device)
+func hasHTTPStatus(err error, code int) bool {
+	if err == nil {
+		return false
 	}
-
-	for i, batch := range batches {
-		WriteBatchFile(batch, fmt.Sprintf("batch_%d.csv", i))
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == code
 	}
+	return strings.Contains(err.Error(), fmt.Sprintf("Error %d", code))
 }
 
-func WriteBatchFile(devices []*cbiotcore.Device, filename string) {
-	currDir, err := os.Getwd()
-	if err != nil {
-		log.Fatalln("Could not get current wd: ", err)
-	}
-
-	failedDevicesFile := fmt.Sprint(currDir, "/", filename)
-
-	if runtime.GOOS == "windows" {
-		failedDevicesFile = fmt.Sprint(currDir, "\\", filename)
-	}
+// deviceIdPattern matches valid IoT Core device IDs: 3 to 255 characters,
+// starting with a letter.
+var deviceIdPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-._~+%]{2,254}$`)
 
-	f, err := os.OpenFile(failedDevicesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalln("Could not open file: ", err)
-	}
-	defer f.Close()
-
-	fileContents := "deviceId\n"
-	for _, device := range devices {
-		fileContents += device.Id
-		fileContents += "\n"
-	}
-
-	if _, err := f.WriteString(fileContents); err != nil {
-		log.Fatalln("Could not write to file: ", err)
-	}
+func isValidDeviceId(deviceId string) bool {
+	return deviceIdPattern.MatchString(deviceId)
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	cbiotcore "github.com/clearblade/go-iot"
+)
+
+// IoT Core device limits enforced by the destination registry.
+const (
+	maxMetadataPairs      = 500
+	maxMetadataKeyBytes   = 128
+	maxMetadataValueBytes = 32 * 1024
+	maxMetadataTotalBytes = 256 * 1024
+	maxDeviceCredentials  = 3
+	maxConfigBytes        = 64 * 1024
+)
+
+const (
+	ValidationPolicySkip     = "skip"
+	ValidationPolicyTruncate = "truncate"
+	ValidationPolicyAbort    = "abort"
+	ValidationPolicyOff      = "off"
+)
+
+var (
+	metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-_]+$`)
+
+	validCredentialFormats = map[string]struct{}{
+		"RSA_PEM":        {},
+		"RSA_X509_PEM":   {},
+		"ES256_PEM":      {},
+		"ES256_X509_PEM": {},
+	}
+)
+
+type DeviceViolation struct {
+	DeviceId string
+	Rule     string
+	Detail   string
+	// Fixable violations can be resolved by the truncate policy without
+	// changing the meaning of the device.
+	Fixable bool
+}
+
+func validateDevice(device *cbiotcore.Device) []DeviceViolation {
+	var violations []DeviceViolation
+	add := func(rule string, fixable bool, format string, args ...interface{}) {
+		violations = append(violations, DeviceViolation{
+			DeviceId: device.Id,
+			Rule:     rule,
+			Detail:   fmt.Sprintf(format, args...),
+			Fixable:  fixable,
+		})
+	}
+
+	if !isValidDeviceId(device.Id) {
+		add("device id", false, "%q does not match %s", device.Id, deviceIdPattern)
+	}
+
+	if len(device.Metadata) > maxMetadataPairs {
+		add("metadata count", true, "%d key-value pairs (max %d)", len(device.Metadata), maxMetadataPairs)
+	}
+	totalBytes := 0
+	for key, value := range device.Metadata {
+		totalBytes += len(key) + len(value)
+		if len(key) >= maxMetadataKeyBytes || !metadataKeyPattern.MatchString(key) {
+			add("metadata key", false, "key %q must match %s and be under %d bytes", key, metadataKeyPattern, maxMetadataKeyBytes)
+		}
+		if len(value) > maxMetadataValueBytes {
+			add("metadata value size", true, "value of %q is %d bytes (max %d)", key, len(value), maxMetadataValueBytes)
+		}
+	}
+	if totalBytes >= maxMetadataTotalBytes {
+		add("metadata total size", true, "%d bytes (max %d)", totalBytes, maxMetadataTotalBytes)
+	}
+
+	if Args.updatePublicKeys {
+		if len(device.Credentials) > maxDeviceCredentials {
+			add("credential count", true, "%d credentials (max %d)", len(device.Credentials), maxDeviceCredentials)
+		}
+		for i, cred := range device.Credentials {
+			if cred.PublicKey == nil {
+				add("credential format", true, "credential %d has no public key", i)
+				continue
+			}
+			if _, ok := validCredentialFormats[cred.PublicKey.Format]; !ok {
+				add("credential format", true, "credential %d has unsupported format %q", i, cred.PublicKey.Format)
+			}
+			if strings.TrimSpace(cred.PublicKey.Key) == "" {
+				add("credential format", true, "credential %d has an empty key", i)
+			}
+		}
+	}
+
+	if device.Config != nil && !Args.skipConfig {
+		if size := configDataSize(device.Config.BinaryData); size > maxConfigBytes {
+			add("config size", false, "config is %d bytes (max %d)", size, maxConfigBytes)
+		}
+	}
+
+	return violations
+}
+
+// configDataSize returns the decoded size of a config payload, falling back to
+// the raw length if the payload is not base64 encoded.
+func configDataSize(binaryData string) int {
+	decoded, err := base64.StdEncoding.DecodeString(binaryData)
+	if err != nil {
+		return len(binaryData)
+	}
+	return len(decoded)
+}
+
+// truncateDevice returns a copy of device with all fixable violations
+// resolved: excess or oversized metadata is dropped, and credentials with an
+// unsupported format or beyond the per-device limit are removed.
+func truncateDevice(device *cbiotcore.Device) *cbiotcore.Device {
+	truncated := *device
+
+	if len(device.Metadata) > 0 {
+		keys := make([]string, 0, len(device.Metadata))
+		for key := range device.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		metadata := make(map[string]string, len(keys))
+		totalBytes := 0
+		for _, key := range keys {
+			value := device.Metadata[key]
+			if len(value) > maxMetadataValueBytes {
+				continue
+			}
+			if len(metadata) == maxMetadataPairs || totalBytes+len(key)+len(value) >= maxMetadataTotalBytes {
+				break
+			}
+			metadata[key] = value
+			totalBytes += len(key) + len(value)
+		}
+		truncated.Metadata = metadata
+	}
+
+	if Args.updatePublicKeys {
+		credentials := make([]*cbiotcore.DeviceCredential, 0, maxDeviceCredentials)
+		for _, cred := range device.Credentials {
+			if len(credentials) == maxDeviceCredentials {
+				break
+			}
+			if cred.PublicKey == nil || strings.TrimSpace(cred.PublicKey.Key) == "" {
+				continue
+			}
+			if _, ok := validCredentialFormats[cred.PublicKey.Format]; !ok {
+				continue
+			}
+			credentials = append(credentials, cred)
+		}
+		truncated.Credentials = credentials
+	}
+
+	return &truncated
+}
+
+// validateDevices checks every device against IoT Core limits before any are
+// sent to the destination and applies -validationPolicy to the offenders. It
+// returns the devices that should be migrated and the IDs of those skipped.
+func validateDevices(devices []*cbiotcore.Device) ([]*cbiotcore.Device, map[string]struct{}) {
+	if Args.validationPolicy == ValidationPolicyOff {
+		return devices, nil
+	}
+
+	printfColored(colorGreen, "\u2713 Validating %d devices against IoT Core limits", len(devices))
+
+	var violations []DeviceViolation
+	valid := make([]*cbiotcore.Device, 0, len(devices))
+	skipped := make(map[string]struct{})
+	truncated := 0
+
+	for _, device := range devices {
+		deviceViolations := validateDevice(device)
+		if len(deviceViolations) == 0 {
+			valid = append(valid, device)
+			continue
+		}
+		violations = append(violations, deviceViolations...)
+
+		if Args.validationPolicy == ValidationPolicyTruncate && allFixable(deviceViolations) {
+			valid = append(valid, truncateDevice(device))
+			truncated++
+			continue
+		}
+
+		skipped[device.Id] = struct{}{}
+		for _, v := range deviceViolations {
+			errorLogger.AddError("Validation: "+v.Rule, v.DeviceId, errors.New(v.Detail))
+		}
+	}
+
+	if len(violations) == 0 {
+		printfColored(colorGreen, " \u2713 All devices passed validation")
+		return devices, nil
+	}
+
+	printViolationSummary(violations)
+
+	if Args.validationPolicy == ValidationPolicyAbort {
+		log.Fatalf("Aborting: %d devices violate IoT Core limits (-validationPolicy=%s)\n", countDevices(violations), Args.validationPolicy)
+	}
+
+	if truncated > 0 {
+		printfColored(colorYellow, " Truncated %d devices to fit IoT Core limits", truncated)
+	}
+	if len(skipped) > 0 {
+		printfColored(colorYellow, " Skipping %d devices that violate IoT Core limits", len(skipped))
+	}
+	return valid, skipped
+}
+
+// validateGatewayBindings applies -validationPolicy to the bound devices of
+// gateways, which are created in the destination if missing. Bound devices
+// that were not among the validated devices are checked here. It returns
+// skipped extended with the bound devices to leave out, for excludeDevices,
+// and the bindings with truncated copies in place of the fetched devices.
+func validateGatewayBindings(gatewayBindings map[string][]*cbiotcore.Device, skipped map[string]struct{}) (map[string]struct{}, map[string][]*cbiotcore.Device) {
+	if Args.validationPolicy == ValidationPolicyOff || len(gatewayBindings) == 0 {
+		return skipped, gatewayBindings
+	}
+
+	excluded := make(map[string]struct{}, len(skipped))
+	for id := range skipped {
+		excluded[id] = struct{}{}
+	}
+	checked := make(map[string]*cbiotcore.Device)
+	bindings := make(map[string][]*cbiotcore.Device, len(gatewayBindings))
+	for gatewayId, bound := range gatewayBindings {
+		devices := make([]*cbiotcore.Device, 0, len(bound))
+		for _, device := range bound {
+			if _, ok := excluded[device.Id]; ok {
+				devices = append(devices, device)
+				continue
+			}
+			valid, ok := checked[device.Id]
+			if !ok {
+				valid = validateBoundDevice(device)
+				checked[device.Id] = valid
+				if valid == nil {
+					excluded[device.Id] = struct{}{}
+					valid = device
+				}
+			}
+			devices = append(devices, valid)
+		}
+		bindings[gatewayId] = devices
+	}
+	return excluded, bindings
+}
+
+// validateBoundDevice returns the device or its truncated copy, or nil if
+// -validationPolicy skips it.
+func validateBoundDevice(device *cbiotcore.Device) *cbiotcore.Device {
+	violations := validateDevice(device)
+	if len(violations) == 0 {
+		return device
+	}
+	if Args.validationPolicy == ValidationPolicyTruncate && allFixable(violations) {
+		return truncateDevice(device)
+	}
+	if Args.validationPolicy == ValidationPolicyAbort {
+		printViolationSummary(violations)
+		log.Fatalf("Aborting: bound device %s violates IoT Core limits (-validationPolicy=%s)\n", device.Id, Args.validationPolicy)
+	}
+	for _, v := range violations {
+		errorLogger.AddError("Validation: "+v.Rule, v.DeviceId, errors.New(v.Detail))
+	}
+	return nil
+}
+
+// rewriteViolations records the devices whose rewritten copy violated IoT
+// Core limits, so that each is logged once however often it is transformed.
+var rewriteViolations = struct {
+	sync.Mutex
+	logged map[string]struct{}
+}{logged: make(map[string]struct{})}
+
+// validateRewrittenDevice applies -validationPolicy to cbDevice, the
+// destination copy of the source device sourceId after the rewrite rules. It
+// returns cbDevice or its truncated copy, or an error if the device is
+// skipped.
+func validateRewrittenDevice(sourceId string, cbDevice *cbiotcore.Device) (*cbiotcore.Device, error) {
+	if Args.validationPolicy == ValidationPolicyOff {
+		return cbDevice, nil
+	}
+	violations := validateDevice(cbDevice)
+	if len(violations) == 0 {
+		return cbDevice, nil
+	}
+	if Args.validationPolicy == ValidationPolicyTruncate && allFixable(violations) {
+		return truncateDevice(cbDevice), nil
+	}
+	if Args.validationPolicy == ValidationPolicyAbort {
+		printViolationSummary(violations)
+		log.Fatalf("Aborting: device %s violates IoT Core limits after the rewrite rules (-validationPolicy=%s)\n", sourceId, Args.validationPolicy)
+	}
+
+	rewriteViolations.Lock()
+	_, logged := rewriteViolations.logged[sourceId]
+	rewriteViolations.logged[sourceId] = struct{}{}
+	rewriteViolations.Unlock()
+	if !logged {
+		for _, v := range violations {
+			errorLogger.AddError("Validation: "+v.Rule, sourceId, fmt.Errorf("after rewrite rules: %s", v.Detail))
+		}
+	}
+	return nil, fmt.Errorf("device %s violates IoT Core limits after the rewrite rules", sourceId)
+}
+
+func allFixable(violations []DeviceViolation) bool {
+	for _, v := range violations {
+		if !v.Fixable {
+			return false
+		}
+	}
+	return true
+}
+
+func countDevices(violations []DeviceViolation) int {
+	ids := make(map[string]struct{})
+	for _, v := range violations {
+		ids[v.DeviceId] = struct{}{}
+	}
+	return len(ids)
+}
+
+func printViolationSummary(violations []DeviceViolation) {
+	const examplesPerRule = 5
+
+	byRule := make(map[string][]DeviceViolation)
+	var rules []string
+	for _, v := range violations {
+		if _, ok := byRule[v.Rule]; !ok {
+			rules = append(rules, v.Rule)
+		}
+		byRule[v.Rule] = append(byRule[v.Rule], v)
+	}
+	sort.Strings(rules)
+
+	printfColored(colorRed, " \u2715 %d devices violate IoT Core limits:", countDevices(violations))
+	for _, rule := range rules {
+		ruleViolations := byRule[rule]
+		printfColored(colorYellow, "   %s: %d violations", rule, len(ruleViolations))
+		for i, v := range ruleViolations {
+			if i == examplesPerRule {
+				printfColored(colorYellow, "     ... and %d more", len(ruleViolations)-examplesPerRule)
+				break
+			}
+			printfColored(colorYellow, "     %s: %s", v.DeviceId, v.Detail)
+		}
+	}
+}
@@ -16,8 +16,14 @@ type workerPool struct {
 
 // NewWorkerPool will create an instance of WorkerPool.
 func NewWorkerPool() WorkerPool {
+	return NewWorkerPoolWithSize(Args.workerPoolSize)
+}
+
+// NewWorkerPoolWithSize creates a WorkerPool that runs at most size tasks at
+// once.
+func NewWorkerPoolWithSize(size int) WorkerPool {
 	wp := &workerPool{
-		maxWorkers:  Args.workerPoolSize,
+		maxWorkers:  size,
 		queuedTaskC: make(chan func()),
 	}
 